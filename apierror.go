@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Error codes reported in APIError.Code.
+const (
+	codeConflict       = "CONFLICT"
+	codeForbidden      = "FORBIDDEN"
+	codeInternal       = "INTERNAL_ERROR"
+	codeInvalidRequest = "INVALID_REQUEST"
+	codeMethod         = "METHOD_NOT_ALLOWED"
+	codeNotFound       = "NOT_FOUND"
+	codeTooLarge       = "PAYLOAD_TOO_LARGE"
+	codeUnauthorized   = "UNAUTHORIZED"
+	codeUnavailable    = "SERVICE_UNAVAILABLE"
+	codeUpstream       = "UPSTREAM_ERROR"
+)
+
+// APIError is a failure reported to API clients. Status is the HTTP status
+// of the response; Field names the offending request field, if any, and
+// Retryable tells the client whether the same request may succeed later.
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func badRequest(field string, message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: message, Field: field}
+}
+
+func unauthorized(message string) *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: message}
+}
+
+func forbidden(message string) *APIError {
+	return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Message: message}
+}
+
+func notFound(message string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: codeNotFound, Message: message}
+}
+
+func methodNotAllowed(message string) *APIError {
+	return &APIError{Status: http.StatusMethodNotAllowed, Code: codeMethod, Message: message}
+}
+
+func tooLarge(message string) *APIError {
+	return &APIError{Status: http.StatusRequestEntityTooLarge, Code: codeTooLarge, Message: message}
+}
+
+func conflict(message string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: codeConflict, Message: message}
+}
+
+func upstreamFailure(message string) *APIError {
+	return &APIError{Status: http.StatusBadGateway, Code: codeUpstream, Message: message, Retryable: true}
+}
+
+func unavailable(message string) *APIError {
+	return &APIError{Status: http.StatusServiceUnavailable, Code: codeUnavailable, Message: message, Retryable: true}
+}
+
+func internalError(message string) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Code: codeInternal, Message: message}
+}
+
+// toAPIError classifies err. Errors that are not already an APIError or a
+// store sentinel are unexpected, such as database failures: they are logged
+// and reported as a 500 that does not reveal them. Only unavailable and
+// upstream errors are retryable.
+func toAPIError(r *http.Request, err error) *APIError {
+	if e, ok := err.(*APIError); ok {
+		return e
+	}
+	switch err {
+	case errNotFound:
+		return notFound(err.Error())
+	case errConflict:
+		return conflict(err.Error())
+	case errClaimExists:
+		return conflict("Claim existed.")
+	}
+	logError(r, "unexpected error", fields{"error": err})
+	return internalError("Internal server error.")
+}
+
+// setAPIError records e in result. The message is kept in result["error"]
+// for the legacy envelope and the typed error in result["errorDetails"].
+func setAPIError(e *APIError, result map[string]interface{}) {
+	logDebug(nil, "api error", fields{"errorCode": e.Code, "message": e.Message})
+	result["error"] = append(result["error"].([]string), e.Message)
+	details, _ := result["errorDetails"].([]*APIError)
+	result["errorDetails"] = append(details, e)
+}
+
+func setFailure(r *http.Request, err error, result map[string]interface{}) {
+	setAPIError(toAPIError(r, err), result)
+}
+
+// firstAPIError returns the first error recorded in result, if any.
+func firstAPIError(result map[string]interface{}) *APIError {
+	if details, ok := result["errorDetails"].([]*APIError); ok && len(details) > 0 {
+		return details[0]
+	}
+	if messages, ok := result["error"].([]string); ok && len(messages) > 0 {
+		return internalError(messages[0])
+	}
+	return nil
+}
+
+func legacyErrors() bool {
+	return Config() != nil && Config().LegacyErrors
+}
+
+// routeNotFound answers an unknown path below a prefix route.
+func routeNotFound(rw http.ResponseWriter, req *http.Request) {
+	result := map[string]interface{}{}
+	result["error"] = []string{}
+	setAPIError(notFound("No route for "+req.URL.Path+"."), result)
+	nodes := map[string]interface{}{}
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestToAPIError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/claims", nil)
+	tests := []struct {
+		err     error
+		status  int
+		message string
+	}{
+		{badRequest("proxy", "proxy is required."), 400, "proxy is required."},
+		{errNotFound, 404, errNotFound.Error()},
+		{errConflict, 409, errConflict.Error()},
+		{errClaimExists, 409, "Claim existed."},
+		{errors.New("dial tcp 10.0.0.5:3306: connection refused"), 500, "Internal server error."},
+	}
+	for _, test := range tests {
+		e := toAPIError(r, test.err)
+		if e.Status != test.status || e.Message != test.message {
+			t.Errorf("toAPIError(%v) = %d %q, want %d %q", test.err, e.Status, e.Message, test.status, test.message)
+		}
+	}
+}
+
+func TestEncodeJWTHidesSigningErrors(t *testing.T) {
+	useTestConfig()
+	Config().JWT.ServerPrivateKey = "not a key"
+	result := map[string]interface{}{"error": []string{}}
+	if token := encodeJWT(nil, map[string]interface{}{"sub": "login token"}, result); len(token) > 0 {
+		t.Fatalf("encodeJWT signed with an invalid key")
+	}
+	if e := firstAPIError(result); e == nil || e.Status != 500 || e.Message != "Internal server error." {
+		t.Errorf("error = %v, want the generic 500", e)
+	}
+}
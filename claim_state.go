@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClaimStatus is the lifecycle state of a claim.
+type ClaimStatus string
+
+// Claim states. A claim starts PENDING and is APPROVED or REJECTED by an
+// attestant; an APPROVED claim may later be REVOKED or EXPIRED. REJECTED and
+// EXPIRED claims may be resubmitted, which moves them back to PENDING.
+const (
+	ClaimPending  ClaimStatus = "PENDING"
+	ClaimApproved ClaimStatus = "APPROVED"
+	ClaimRejected ClaimStatus = "REJECTED"
+	ClaimRevoked  ClaimStatus = "REVOKED"
+	ClaimExpired  ClaimStatus = "EXPIRED"
+)
+
+var claimTransitions = map[ClaimStatus][]ClaimStatus{
+	ClaimPending:  {ClaimApproved, ClaimRejected},
+	ClaimApproved: {ClaimRevoked, ClaimExpired},
+	ClaimRejected: {ClaimPending},
+	ClaimExpired:  {ClaimPending},
+	ClaimRevoked:  {},
+}
+
+var errClaimExists = errors.New("claim exists")
+
+// ClaimEvent records one transition of a claim.
+type ClaimEvent struct {
+	ID      int64
+	ClaimID int64
+	From    string
+	To      string
+	Actor   string
+	Created string
+}
+
+func parseClaimStatus(status string) (ClaimStatus, error) {
+	s := ClaimStatus(strings.ToUpper(strings.TrimSpace(status)))
+	if _, ok := claimTransitions[s]; !ok {
+		return "", badRequest("status", fmt.Sprintf("unknown claim status: %s", status))
+	}
+	return s, nil
+}
+
+func (s ClaimStatus) canTransition(to ClaimStatus) bool {
+	for _, next := range claimTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// active reports whether a claim in this state blocks a new submission of
+// the same type.
+func (s ClaimStatus) active() bool {
+	return s == ClaimPending || s == ClaimApproved
+}
+
+// resubmittable reports whether a claim in this state may be reopened.
+func (s ClaimStatus) resubmittable() bool {
+	return s.canTransition(ClaimPending)
+}
+
+// transitionClaim moves claim to the state to on behalf of actor and records
+// the transition in the same transaction. A non-empty content replaces the
+// stored claim JWT.
+func transitionClaim(claim *Claim, to ClaimStatus, actor string, content string) error {
+	from := ClaimStatus(claim.Status)
+	if !from.canTransition(to) {
+		return conflict(fmt.Sprintf("illegal claim transition from %s to %s", from, to))
+	}
+	now := getNow()
+	event := &ClaimEvent{
+		ClaimID: claim.ID,
+		From:    string(from),
+		To:      string(to),
+		Actor:   actor,
+		Created: now,
+	}
+	err := Storage().Claims().Transition(claim.ID, string(from), string(to), content, event)
+	if err != nil {
+		return err
+	}
+	claim.Status = string(to)
+	claim.Updated = now
+	if len(content) > 0 {
+		claim.Claim = content
+	}
+	return nil
+}
+
+// attestClaim moves claim to the state to on behalf of attestant and, in
+// the same transaction, applies change: the attestation attestant issues,
+// replaces or revokes, or nil.
+func attestClaim(claim *Claim, to ClaimStatus, attestant string, change *Attestation) error {
+	from := ClaimStatus(claim.Status)
+	if !from.canTransition(to) {
+		return conflict(fmt.Sprintf("illegal claim transition from %s to %s", from, to))
+	}
+	now := getNow()
+	if change != nil {
+		if change.ID == 0 {
+			change.Created = now
+		}
+		if change.Status == attestationRevoked {
+			change.Revoked = now
+		}
+		change.Updated = now
+	}
+	event := &ClaimEvent{
+		ClaimID: claim.ID,
+		From:    string(from),
+		To:      string(to),
+		Actor:   attestant,
+		Created: now,
+	}
+	if err := Storage().Claims().Attest(claim.ID, string(from), string(to), event, change); err != nil {
+		return err
+	}
+	claim.Status = string(to)
+	claim.Updated = now
+	return nil
+}
+
+// submitClaim stores a new PENDING claim, or reopens the latest claim of the
+// same type when it was rejected or has expired. A user may hold at most one
+// pending or approved claim per type.
+func submitClaim(proxy string, claimType string, content string) (*Claim, error) {
+	claims := Storage().Claims()
+	_, err := claims.FindByContent(proxy, claimType, content)
+	if err == nil {
+		return nil, errClaimExists
+	} else if err != errNotFound {
+		return nil, err
+	}
+
+	latest, err := claims.FindLatest(proxy, claimType)
+	if err != nil && err != errNotFound {
+		return nil, err
+	} else if err == nil {
+		status := ClaimStatus(latest.Status)
+		if status.active() {
+			return nil, conflict(fmt.Sprintf("a %s claim is already %s", claimType, status))
+		}
+		if status.resubmittable() {
+			if err := transitionClaim(latest, ClaimPending, proxy, content); err != nil {
+				return nil, err
+			}
+			return latest, nil
+		}
+	}
+
+	now := getNow()
+	claim := &Claim{
+		Proxy:   proxy,
+		Type:    claimType,
+		Status:  string(ClaimPending),
+		Claim:   content,
+		Created: now,
+		Updated: now,
+	}
+	event := &ClaimEvent{
+		To:      claim.Status,
+		Actor:   proxy,
+		Created: now,
+	}
+	if err := claims.Create(claim, event); err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// getClaimHistory serves /api/v1/claims/{id}/history.
+func getClaimHistory(rw http.ResponseWriter, req *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	events := []map[string]string{}
+	path := strings.TrimPrefix(req.URL.Path, "/api/v1/claims/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 || parts[1] != "history" {
+		routeNotFound(rw, req)
+		return
+	}
+	claimID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		setAPIError(badRequest("id", "Invalid claim ID."), result)
+	} else if _, err = Storage().Claims().Find(claimID); err == errNotFound {
+		setAPIError(notFound("Claim not found."), result)
+	} else if err != nil {
+		setFailure(req, err, result)
+	} else {
+		rows, err := Storage().ClaimEvents().List(claimID)
+		if err != nil {
+			setFailure(req, err, result)
+		}
+		for _, row := range rows {
+			events = append(events, map[string]string{
+				"from":    row.From,
+				"to":      row.To,
+				"actor":   row.Actor,
+				"created": row.Created,
+			})
+		}
+	}
+	nodes := map[string]interface{}{}
+	nodes["count"] = len(events)
+	result["items"] = events
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
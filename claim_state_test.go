@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestClaimTransitions(t *testing.T) {
+	tests := []struct {
+		from  ClaimStatus
+		to    ClaimStatus
+		valid bool
+	}{
+		{ClaimPending, ClaimApproved, true},
+		{ClaimPending, ClaimRejected, true},
+		{ClaimPending, ClaimRevoked, false},
+		{ClaimApproved, ClaimRevoked, true},
+		{ClaimApproved, ClaimExpired, true},
+		{ClaimApproved, ClaimPending, false},
+		{ClaimRejected, ClaimPending, true},
+		{ClaimRejected, ClaimApproved, false},
+		{ClaimExpired, ClaimPending, true},
+		{ClaimRevoked, ClaimPending, false},
+		{ClaimRevoked, ClaimApproved, false},
+	}
+	for _, test := range tests {
+		if valid := test.from.canTransition(test.to); valid != test.valid {
+			t.Errorf("%s -> %s: canTransition = %v, want %v", test.from, test.to, valid, test.valid)
+		}
+	}
+}
+
+func TestParseClaimStatus(t *testing.T) {
+	if status, err := parseClaimStatus(" approved "); err != nil || status != ClaimApproved {
+		t.Errorf("parseClaimStatus(approved) = %q, %v", status, err)
+	}
+	if _, err := parseClaimStatus("DONE"); err == nil {
+		t.Errorf("parseClaimStatus(DONE) accepted an unknown status")
+	}
+}
+
+func TestSubmitClaim(t *testing.T) {
+	useTestConfig()
+	claim, err := submitClaim(testUserProxy, "EMAIL", "first")
+	if err != nil || claim.Status != string(ClaimPending) {
+		t.Fatalf("submitClaim = %v, %v", claim, err)
+	}
+	if _, err := submitClaim(testUserProxy, "EMAIL", "first"); err != errClaimExists {
+		t.Errorf("same content: err = %v, want errClaimExists", err)
+	}
+	if _, err := submitClaim(testUserProxy, "EMAIL", "second"); toAPIError(nil, err).Status != 409 {
+		t.Errorf("while pending: err = %v, want a conflict", err)
+	}
+	if err := transitionClaim(claim, ClaimRevoked, "idhub", ""); toAPIError(nil, err).Status != 409 {
+		t.Errorf("PENDING -> REVOKED: err = %v, want a conflict", err)
+	}
+	if err := transitionClaim(claim, ClaimRejected, "idhub", ""); err != nil {
+		t.Fatalf("PENDING -> REJECTED: %v", err)
+	}
+	reopened, err := submitClaim(testUserProxy, "EMAIL", "second")
+	if err != nil || reopened.ID != claim.ID || reopened.Status != string(ClaimPending) || reopened.Claim != "second" {
+		t.Fatalf("resubmission = %v, %v, want claim %d reopened", reopened, err, claim.ID)
+	}
+	stale := &Claim{ID: claim.ID, Status: string(ClaimRejected)}
+	if err := transitionClaim(stale, ClaimPending, testUserProxy, ""); err != errConflict {
+		t.Errorf("stale transition: err = %v, want errConflict", err)
+	}
+	events, _ := Storage().ClaimEvents().List(claim.ID)
+	want := []string{"->PENDING", "PENDING->REJECTED", "REJECTED->PENDING"}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i, event := range events {
+		if got := event.From + "->" + event.To; got != want[i] {
+			t.Errorf("event %d = %s, want %s", i, got, want[i])
+		}
+	}
+}
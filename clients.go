@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Client states. Suspended clients cannot obtain tokens.
+const (
+	clientActive    = "ACTIVE"
+	clientSuspended = "SUSPENDED"
+)
+
+type clientRequest struct {
+	Name         string   `json:"name" validate:"required,max=128"`
+	PublicKeys   []string `json:"publicKeys"`
+	Scopes       []string `json:"scopes"`
+	RedirectURLs []string `json:"redirectURLs"`
+	Status       string   `json:"status"`
+}
+
+// splitList splits a comma separated list and drops empty items.
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// checkClient validates a client before it is stored.
+func checkClient(client *Client) *APIError {
+	if message := validateString("name", client.Name, "required,max=128"); len(message) > 0 {
+		return badRequest("name", message)
+	}
+	if len(client.PublicKeys) == 0 {
+		return badRequest("publicKeys", "At least one public key is required.")
+	}
+	for _, key := range client.PublicKeys {
+		if message := validateString("publicKeys", key, "required,max=150,hex"); len(message) > 0 {
+			return badRequest("publicKeys", message)
+		}
+	}
+	for _, scope := range client.Scopes {
+		if parsed, err := parseScope(scope); err != nil || len(parsed) != 1 || parsed[0].key() != scope {
+			return badRequest("scopes", "Invalid scope "+scope+".")
+		}
+	}
+	for _, redirect := range client.RedirectURLs {
+		u, err := url.Parse(redirect)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return badRequest("redirectURLs", "Invalid redirect URL "+redirect+".")
+		}
+	}
+	if client.Status != clientActive && client.Status != clientSuspended {
+		return badRequest("status", "status must be ACTIVE or SUSPENDED.")
+	}
+	return nil
+}
+
+// verifyClientJWT checks that token is signed by one of the client's
+// registered keys.
+func verifyClientJWT(r *http.Request, client *Client, token string, result map[string]interface{}) bool {
+	for _, key := range client.PublicKeys {
+		attempt := map[string]interface{}{
+			"error": []string{},
+		}
+		if verifyJWT(r, key, token, attempt) {
+			return true
+		}
+		if e := firstAPIError(attempt); e != nil && e.Status != http.StatusUnauthorized {
+			setAPIError(e, result)
+			return false
+		}
+	}
+	setAPIError(unauthorized("JWT is not signed by a registered key of client "+client.Name+"."), result)
+	return false
+}
+
+// authorizeClient returns the client registered as name once token has been
+// verified against its keys and scope against its allowed scopes.
+func authorizeClient(r *http.Request, name string, token string, scope Scope, result map[string]interface{}) *Client {
+	client, err := Storage().Clients().Find(name)
+	if err == errNotFound {
+		setAPIError(unauthorized("Unknown client "+name+"."), result)
+		return nil
+	} else if err != nil {
+		setFailure(r, err, result)
+		return nil
+	}
+	if client.Status != clientActive {
+		setAPIError(forbidden("Client "+name+" is suspended."), result)
+		return nil
+	}
+	if !verifyClientJWT(r, client, token, result) {
+		return nil
+	}
+	if denied := scope.exceeds(client.Scopes); len(denied) > 0 {
+		setAPIError(forbidden("Client "+name+" may not request scope "+denied+"."), result)
+		return nil
+	}
+	return client
+}
+
+func listView(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+func clientView(client *Client) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         client.Name,
+		"publicKeys":   listView(client.PublicKeys),
+		"scopes":       listView(client.Scopes),
+		"redirectURLs": listView(client.RedirectURLs),
+		"status":       client.Status,
+		"created":      client.Created,
+		"updated":      client.Updated,
+	}
+}
+
+// adminAuthorized checks the bearer token of an admin API request. The
+// admin API is disabled unless admin.token is configured.
+func adminAuthorized(req *http.Request, result map[string]interface{}) bool {
+	cfg := Config().Admin
+	if cfg == nil || len(cfg.Token) == 0 {
+		setAPIError(forbidden("Admin API is disabled."), result)
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+		setAPIError(unauthorized("Invalid admin token."), result)
+		return false
+	}
+	return true
+}
+
+// adminClients serves GET (list) and POST (register) on
+// /api/v1/admin/clients.
+func adminClients(rw http.ResponseWriter, req *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	nodes := map[string]interface{}{}
+	if adminAuthorized(req, result) {
+		switch req.Method {
+		case "GET":
+			items := []map[string]interface{}{}
+			rows, err := Storage().Clients().List()
+			if err != nil {
+				setFailure(req, err, result)
+			}
+			for _, row := range rows {
+				items = append(items, clientView(row))
+			}
+			nodes["count"] = len(items)
+			result["items"] = items
+		case "POST":
+			createClient(req, result)
+		default:
+			setAPIError(badRequest("", "Unsupported method "+req.Method+"."), result)
+		}
+	}
+	nodes["result"] = result
+	setResponse(rw, nodes)
+}
+
+func createClient(req *http.Request, result map[string]interface{}) {
+	var body clientRequest
+	if !decodeRequest(req, &body, result) {
+		return
+	}
+	now := getNow()
+	client := &Client{
+		Name:         body.Name,
+		PublicKeys:   body.PublicKeys,
+		Scopes:       body.Scopes,
+		RedirectURLs: body.RedirectURLs,
+		Status:       body.Status,
+		Created:      now,
+		Updated:      now,
+	}
+	if len(client.Status) == 0 {
+		client.Status = clientActive
+	}
+	if e := checkClient(client); e != nil {
+		setAPIError(e, result)
+	} else if err := Storage().Clients().Create(client); err == errConflict {
+		setAPIError(conflict("Client "+client.Name+" is already registered."), result)
+	} else if err != nil {
+		setFailure(req, err, result)
+	} else {
+		result["items"] = clientView(client)
+	}
+}
+
+// adminClient serves GET and PUT on /api/v1/admin/clients/{name}. PUT
+// replaces the keys, scopes, redirect URLs and status of the client.
+func adminClient(rw http.ResponseWriter, req *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	name := strings.TrimPrefix(req.URL.Path, "/api/v1/admin/clients/")
+	if len(name) == 0 || strings.Contains(name, "/") {
+		routeNotFound(rw, req)
+		return
+	}
+	if adminAuthorized(req, result) {
+		client, err := Storage().Clients().Find(name)
+		if err == errNotFound {
+			setAPIError(notFound("Client "+name+" is not registered."), result)
+		} else if err != nil {
+			setFailure(req, err, result)
+		} else if req.Method == "GET" {
+			result["items"] = clientView(client)
+		} else if req.Method == "PUT" {
+			updateClient(req, client, result)
+		} else {
+			setAPIError(badRequest("", "Unsupported method "+req.Method+"."), result)
+		}
+	}
+	nodes := map[string]interface{}{}
+	nodes["result"] = result
+	setResponse(rw, nodes)
+}
+
+func updateClient(req *http.Request, client *Client, result map[string]interface{}) {
+	body := clientRequest{Name: client.Name}
+	if !decodeRequest(req, &body, result) {
+		return
+	}
+	if body.Name != client.Name {
+		setAPIError(badRequest("name", "Clients cannot be renamed."), result)
+		return
+	}
+	client.PublicKeys = body.PublicKeys
+	client.Scopes = body.Scopes
+	client.RedirectURLs = body.RedirectURLs
+	if len(body.Status) > 0 {
+		client.Status = body.Status
+	}
+	client.Updated = getNow()
+	if e := checkClient(client); e != nil {
+		setAPIError(e, result)
+	} else if err := Storage().Clients().Update(client); err != nil {
+		setFailure(req, err, result)
+	} else {
+		result["items"] = clientView(client)
+	}
+}
+
+// runClients manages the client registry from the command line.
+func runClients(args []string) {
+	usage := "usage: winter clients list | show NAME | add NAME -keys K1,K2 [-scopes S1,S2] [-redirects URL1,URL2]" +
+		" | update NAME [-keys ...] [-scopes ...] [-redirects ...] | suspend NAME | activate NAME"
+	if len(args) == 0 || (args[0] != "list" && len(args) < 2) {
+		log.Fatalln(usage)
+	}
+	clients := Storage().Clients()
+	if args[0] == "list" {
+		rows, err := clients.List()
+		if err != nil {
+			log.Fatalln("clients error:", err.Error())
+		}
+		for _, row := range rows {
+			fmt.Fprintf(os.Stdout, "%-30s  %-9s  %s\n", row.Name, row.Status, strings.Join(row.Scopes, ","))
+		}
+		return
+	}
+
+	name := args[1]
+	flags := flag.NewFlagSet("clients", flag.ExitOnError)
+	keys := flags.String("keys", "", "comma separated public keys")
+	scopes := flags.String("scopes", "", "comma separated allowed scopes")
+	redirects := flags.String("redirects", "", "comma separated redirect URLs")
+	flags.Parse(args[2:])
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	now := getNow()
+	client, err := clients.Find(name)
+	if args[0] == "add" {
+		if err == nil {
+			log.Fatalln("client already registered:", name)
+		} else if err != errNotFound {
+			log.Fatalln("clients error:", err.Error())
+		}
+		client = &Client{Name: name, Status: clientActive, Created: now}
+	} else if err == errNotFound {
+		log.Fatalln("client not registered:", name)
+	} else if err != nil {
+		log.Fatalln("clients error:", err.Error())
+	}
+
+	switch args[0] {
+	case "show":
+		fmt.Fprintf(os.Stdout, "name:       %s\nstatus:     %s\nkeys:       %s\nscopes:     %s\nredirects:  %s\ncreated:    %s\n",
+			client.Name, client.Status, strings.Join(client.PublicKeys, ","),
+			strings.Join(client.Scopes, ","), strings.Join(client.RedirectURLs, ","), client.Created)
+		return
+	case "add", "update":
+		if set["keys"] {
+			client.PublicKeys = splitList(*keys)
+		}
+		if set["scopes"] {
+			client.Scopes = splitList(*scopes)
+		}
+		if set["redirects"] {
+			client.RedirectURLs = splitList(*redirects)
+		}
+	case "suspend":
+		client.Status = clientSuspended
+	case "activate":
+		client.Status = clientActive
+	default:
+		log.Fatalln(usage)
+	}
+	client.Updated = now
+	if e := checkClient(client); e != nil {
+		log.Fatalln("invalid client:", e.Message)
+	}
+	if args[0] == "add" {
+		err = clients.Create(client)
+	} else {
+		err = clients.Update(client)
+	}
+	if err != nil {
+		log.Fatalln("clients error:", err.Error())
+	}
+	log.Println("saved client", client.Name, "status", client.Status)
+}
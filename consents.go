@@ -0,0 +1,150 @@
+package main
+
+import "net/http"
+
+// Consent states. Revoked consents no longer stand for new requests.
+const (
+	consentActive  = "ACTIVE"
+	consentRevoked = "REVOKED"
+)
+
+// Subjects of the JWTs a user signs to manage their consents.
+const (
+	consentHistorySubject    = "consent history"
+	consentRevocationSubject = "consent revocation"
+)
+
+type consentRequest struct {
+	ConsentJWT string `json:"consentJWT" validate:"required,jwt"`
+}
+
+type consentContext struct {
+	UserProxy     string `json:"userProxy" validate:"required,max=50,address"`
+	UserPublicKey string `json:"userPublicKey" validate:"required,max=150,hex"`
+	RequesterName string `json:"requesterName" validate:"max=128"`
+}
+
+func consentView(consent *Consent) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        consent.ID,
+		"requester": consent.Requester,
+		"scope":     consent.Scope,
+		"evidence":  consent.Evidence,
+		"status":    consent.Status,
+		"created":   consent.Created,
+		"revoked":   consent.Revoked,
+	}
+}
+
+// recordConsent stores the disclosure of scope by proxy to requester,
+// backed by the signed JWT evidence.
+func recordConsent(r *http.Request, proxy string, requester string, scope Scope, evidence string, result map[string]interface{}) {
+	consent := &Consent{
+		Proxy:     proxy,
+		Requester: requester,
+		Scope:     scope.String(),
+		Evidence:  evidence,
+		Status:    consentActive,
+		Created:   getNow(),
+	}
+	if err := Storage().Consents().Create(consent); err != nil {
+		setFailure(r, err, result)
+	}
+}
+
+// applyStandingConsent validates item at once when proxy has an active
+// consent for requester that covers its scope. It reports whether item was
+// validated.
+func applyStandingConsent(r *http.Request, item *Token, proxy string, requester string, result map[string]interface{}) bool {
+	consent, err := Storage().Consents().FindActive(proxy, requester)
+	if err == errNotFound {
+		return false
+	} else if err != nil {
+		setFailure(r, err, result)
+		return false
+	}
+	issued, err := parseScope(item.Scope)
+	if err != nil {
+		return false
+	}
+	granted, err := parseScope(consent.Scope)
+	if err != nil {
+		return false
+	}
+	approved, ok := issued.within(granted)
+	if !ok || !consumeToken(r, item, proxy, approved, true, result) {
+		return false
+	}
+	recordConsent(r, proxy, requester, approved, consent.Evidence, result)
+	return true
+}
+
+// getConsents lists the consent history of the user who signed the
+// request, optionally only for one requester.
+func getConsents(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req consentRequest
+	var context consentContext
+	nodes := map[string]interface{}{}
+	if r.Method != "POST" {
+		setAPIError(badRequest("", "Consent history must be requested with POST."), result)
+	} else if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ConsentJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) &&
+			checkSubject(body, consentHistorySubject, result) &&
+			authenticateUser(r, req.ConsentJWT, body, context.UserProxy, context.UserPublicKey, result) {
+			rows, err := Storage().Consents().List(context.UserProxy, context.RequesterName)
+			if err != nil {
+				setFailure(r, err, result)
+			}
+			items := []map[string]interface{}{}
+			for _, row := range rows {
+				items = append(items, consentView(row))
+			}
+			nodes["count"] = len(items)
+			result["items"] = items
+		}
+	}
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+// revokeConsents revokes the standing consents of the user who signed the
+// request for one requester, whose next request needs a new approval.
+func revokeConsents(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req consentRequest
+	var context consentContext
+	revoked := int64(0)
+	if r.Method != "POST" {
+		setAPIError(badRequest("", "Revocation must be posted."), result)
+	} else if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ConsentJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) {
+			if len(context.RequesterName) == 0 {
+				setAPIError(badRequest("requesterName", "requesterName is required."), result)
+			} else if checkSubject(body, consentRevocationSubject, result) &&
+				authenticateUser(r, req.ConsentJWT, body, context.UserProxy, context.UserPublicKey, result) {
+				count, err := Storage().Consents().Revoke(context.UserProxy, context.RequesterName, getNow())
+				if err != nil {
+					setFailure(r, err, result)
+				} else if count == 0 {
+					setAPIError(notFound("No active consent for "+context.RequesterName+"."), result)
+				}
+				revoked = count
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	result["revoked"] = revoked
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"github.com/donh/winter/did"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// W3C Verifiable Credentials export of approved attestations. A credential
+// is issued by the DID of the attestant's proxy to the DID of the user's
+// proxy and carries the attestant's signed attestation JWT: as the proof of
+// the JSON-LD encoding, and as evidence of the JWT-VC encoding, which the
+// server signs on the attestant's behalf.
+
+const (
+	credentialContext    = "https://www.w3.org/2018/credentials/v1"
+	credentialIDPrefix   = "urn:winter:claim:"
+	credentialSubject    = "credential for "
+	formatJSONLD         = "jsonld"
+	formatJWT            = "jwt"
+	attestationProofType = "JwtProof2020"
+	credentialType       = "AttestedClaimCredential"
+)
+
+func rfc3339(value string) string {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		return value
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// attestantDID returns the DID of the registered user whose key signed the
+// attestation.
+func attestantDID(attestation string) (string, error) {
+	publicKey := attestantPublicKey(attestation)
+	if len(publicKey) == 0 {
+		return "", internalError("Attestation has no attestant public key.")
+	}
+	user, err := Storage().Users().FindByPublicKey(publicKey)
+	if err == errNotFound {
+		return "", conflict("Attestant has no registered proxy to derive its DID from.")
+	} else if err != nil {
+		return "", err
+	}
+	return did.FromAddress(user.Proxy), nil
+}
+
+// buildCredential returns the unsigned credential for an approved claim and
+// its active attestation.
+func buildCredential(claim *Claim, attestation *Attestation, issuer string) map[string]interface{} {
+	return map[string]interface{}{
+		"@context":     []string{credentialContext},
+		"id":           credentialIDPrefix + strconv.FormatInt(claim.ID, 10),
+		"type":         []string{"VerifiableCredential", credentialType},
+		"issuer":       issuer,
+		"issuanceDate": rfc3339(attestation.Created),
+		"credentialSubject": map[string]interface{}{
+			"id":        did.FromAddress(claim.Proxy),
+			"claimType": claim.Type,
+			"claim":     claim.Claim,
+		},
+		"credentialStatus": map[string]interface{}{
+			"id":   "/api/v1/attestations/" + strconv.FormatInt(attestation.ID, 10) + "/status",
+			"type": "WinterAttestationStatus",
+		},
+	}
+}
+
+// exportCredential encodes the credential of claim in format.
+func exportCredential(r *http.Request, claim *Claim, attestation *Attestation, format string, result map[string]interface{}) interface{} {
+	issuer, err := attestantDID(attestation.Attestation)
+	if err != nil {
+		setFailure(r, err, result)
+		return nil
+	}
+	credential := buildCredential(claim, attestation, issuer)
+	if format == formatJWT {
+		credential["evidence"] = []map[string]interface{}{{
+			"type": attestationProofType,
+			"jwt":  attestation.Attestation,
+		}}
+		issued, _ := time.ParseInLocation("2006-01-02 15:04:05", attestation.Created, time.Local)
+		payload := map[string]interface{}{
+			"iss": issuer,
+			"sub": did.FromAddress(claim.Proxy),
+			"jti": credential["id"],
+			"nbf": issued.Unix(),
+			"iat": time.Now().Unix(),
+			"vc":  credential,
+		}
+		return encodeJWT(r, payload, result)
+	}
+	credential["proof"] = map[string]interface{}{
+		"type":               attestationProofType,
+		"created":            rfc3339(attestation.Created),
+		"proofPurpose":       "assertionMethod",
+		"verificationMethod": issuer + "#controller-key",
+		"jwt":                attestation.Attestation,
+	}
+	return credential
+}
+
+// getCredential exports the approved claim named by the subject of a JWT
+// signed by its holder, "credential for <type>", as a Verifiable
+// Credential.
+func getCredential(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req credentialRequest
+	var context userContext
+	item := map[string]interface{}{}
+	if decodeRequest(r, &req, result) {
+		if len(req.Format) == 0 {
+			req.Format = formatJSONLD
+		}
+		body := decodeJWT(r, req.CredentialJWT, result)
+		subject, _ := body["sub"].(string)
+		claimType := strings.ToUpper(strings.TrimPrefix(subject, credentialSubject))
+		if req.Format != formatJSONLD && req.Format != formatJWT {
+			setAPIError(badRequest("format", "format must be jsonld or jwt."), result)
+		} else if firstAPIError(result) == nil &&
+			(!strings.HasPrefix(subject, credentialSubject) || !claimTypePattern.MatchString(claimType)) {
+			setAPIError(badRequest("sub", "JWT subject must be \"credential for <type>\"."), result)
+		} else if firstAPIError(result) == nil && decodeContext(body, &context, result) &&
+			authenticateUser(r, req.CredentialJWT, body, context.UserProxy, context.UserPublicKey, result) {
+			claim, attestation, err := approvedAttestation(context.UserProxy, claimType)
+			if err == errNotFound {
+				setAPIError(notFound("No approved "+claimType+" claim."), result)
+			} else if err != nil {
+				setFailure(r, err, result)
+			} else if credential := exportCredential(r, claim, attestation, req.Format, result); firstAPIError(result) == nil {
+				item["format"] = req.Format
+				item["credential"] = credential
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	result["items"] = item
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+// verifyCredential checks a credential presented by holder, either a
+// JWT-VC signed by the server or a JSON-LD credential, against the stored
+// claim and attestation.
+func verifyCredential(r *http.Request, presented interface{}, holder string) (map[string]interface{}, error) {
+	credential, ok := presented.(map[string]interface{})
+	attestationJWT := ""
+	if token, isJWT := presented.(string); isJWT {
+		result := map[string]interface{}{"error": []string{}}
+		if !verifyJWT(r, Config().JWT.ServerPublicKey, token, result) {
+			return nil, fmt.Errorf("JWT-VC is not signed by this server")
+		}
+		t, err := parseJWT(token)
+		if err != nil {
+			return nil, err
+		}
+		credential, ok = t.payload["vc"].(map[string]interface{})
+		if !ok || t.payload["iss"] != credential["issuer"] {
+			return nil, fmt.Errorf("JWT-VC has no matching vc claim")
+		}
+		evidence, _ := credential["evidence"].([]interface{})
+		if len(evidence) == 1 {
+			first, _ := evidence[0].(map[string]interface{})
+			attestationJWT, _ = first["jwt"].(string)
+		}
+	} else if ok {
+		proof, _ := credential["proof"].(map[string]interface{})
+		attestationJWT, _ = proof["jwt"].(string)
+	} else {
+		return nil, fmt.Errorf("credential must be a JWT or an object")
+	}
+
+	id, _ := credential["id"].(string)
+	subject, _ := credential["credentialSubject"].(map[string]interface{})
+	claimID, err := strconv.ParseInt(strings.TrimPrefix(id, credentialIDPrefix), 10, 64)
+	if !strings.HasPrefix(id, credentialIDPrefix) || err != nil {
+		return credential, fmt.Errorf("unknown credential %s", id)
+	}
+	if subject["id"] != holder {
+		return credential, fmt.Errorf("credential subject is not the holder")
+	}
+	claim, err := Storage().Claims().Find(claimID)
+	if err != nil {
+		return credential, fmt.Errorf("claim %d: %v", claimID, err)
+	}
+	attestation, err := Storage().Attestations().FindLatest(claimID, attestationActive)
+	if err != nil || ClaimStatus(claim.Status) != ClaimApproved {
+		return credential, fmt.Errorf("credential %s is no longer valid", id)
+	}
+	issuer, err := attestantDID(attestation.Attestation)
+	if err != nil {
+		return credential, err
+	}
+	if attestationJWT != attestation.Attestation || credential["issuer"] != issuer ||
+		subject["claim"] != claim.Claim || did.FromAddress(claim.Proxy) != holder {
+		return credential, fmt.Errorf("credential %s does not match the attestation", id)
+	}
+	result := map[string]interface{}{"error": []string{}}
+	if !verifyJWT(r, attestantPublicKey(attestationJWT), attestationJWT, result) {
+		return credential, fmt.Errorf("attestation signature verification failed")
+	}
+	return credential, nil
+}
+
+// verifyPresentation checks a JWT-VP signed by the holder, whose DID must
+// name a registered proxy, and every credential it presents.
+func verifyPresentation(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req presentationRequest
+	item := map[string]interface{}{}
+	valid := false
+	var body map[string]interface{}
+	if decodeRequest(r, &req, result) {
+		body = decodeJWT(r, req.Presentation, result)
+	}
+	if firstAPIError(result) == nil {
+		holder, _ := body["iss"].(string)
+		vp, _ := body["vp"].(map[string]interface{})
+		nonce, _ := body["nonce"].(string)
+		exp, hasExp, _ := claimInt64(body, "exp")
+		proxy, err := did.Address(holder)
+		if vp == nil || err != nil {
+			setAPIError(badRequest("presentation", "Presentation must carry vp and a did:ethr issuer."), result)
+		} else if hasExp && time.Now().Unix() > exp+jwtLeeway() {
+			setAPIError(unauthorized("Presentation has expired."), result)
+		} else if len(req.Challenge) > 0 && nonce != req.Challenge {
+			setAPIError(unauthorized("Presentation nonce does not match the challenge."), result)
+		} else if len(req.Audience) > 0 && !claimHasAudience(body, req.Audience) {
+			setAPIError(unauthorized("Presentation audience does not match."), result)
+		} else {
+			user, err := Storage().Users().FindByProxy(proxy)
+			if err == errNotFound {
+				setAPIError(unauthorized("Unknown holder "+holder+"."), result)
+			} else if err != nil {
+				setFailure(r, err, result)
+			} else if verifyJWT(r, user.PublicKey, req.Presentation, result) {
+				valid = true
+				credentials := []map[string]interface{}{}
+				presented, _ := vp["verifiableCredential"].([]interface{})
+				for _, each := range presented {
+					credential, err := verifyCredential(r, each, holder)
+					check := map[string]interface{}{"valid": err == nil}
+					if credential != nil {
+						check["id"] = credential["id"]
+						check["type"] = credential["type"]
+						check["issuer"] = credential["issuer"]
+					}
+					if err != nil {
+						check["error"] = err.Error()
+						valid = false
+					}
+					credentials = append(credentials, check)
+				}
+				if len(credentials) == 0 {
+					valid = false
+				}
+				item["holder"] = holder
+				item["credentials"] = credentials
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	item["valid"] = valid
+	result["items"] = item
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
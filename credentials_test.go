@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/donh/winter/did"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCredentialSetup stores an approved EMAIL claim of testUserProxy
+// attested by the user at testAttestantProxy, and returns the holder's
+// private key, the claim and its attestation.
+func testCredentialSetup(t *testing.T) (string, *Claim, *Attestation) {
+	useTestConfig()
+	Config().JWT.ServerPrivateKey = testPrivateKey
+	Config().JWT.ServerPublicKey = testPublicKey(t, algES256K)
+	attestantPrivate, attestantPublic := testKeyPair(t, "01")
+	holderPrivate, holderPublic := testKeyPair(t, "02")
+	Storage().Users().Create(&User{PublicKey: attestantPublic, Proxy: testAttestantProxy})
+	Storage().Users().Create(&User{PublicKey: holderPublic, Proxy: testUserProxy})
+	now := getNow()
+	claim := &Claim{Proxy: testUserProxy, Type: "EMAIL", Status: string(ClaimApproved), Claim: "user@example.com", Created: now}
+	Storage().Claims().Create(claim, nil)
+	signed, err := signJWT(map[string]interface{}{
+		"context": map[string]interface{}{"attestantPublicKey": attestantPublic},
+	}, algES256K, attestantPrivate)
+	if err != nil {
+		t.Fatalf("signJWT: %v", err)
+	}
+	attestation := &Attestation{ClaimID: claim.ID, Attestant: "idhub", Attestation: signed, Status: attestationActive, Created: now}
+	Storage().Attestations().Create(attestation)
+	return holderPrivate, claim, attestation
+}
+
+// exportedCredential exports the credential of claim in format as a
+// verifier receives it.
+func exportedCredential(t *testing.T, claim *Claim, attestation *Attestation, format string) interface{} {
+	result := map[string]interface{}{"error": []string{}}
+	credential := exportCredential(nil, claim, attestation, format, result)
+	if err := firstAPIError(result); err != nil {
+		t.Fatalf("exportCredential(%s): %v", format, err)
+	}
+	bs, _ := json.Marshal(credential)
+	var presented interface{}
+	json.Unmarshal(bs, &presented)
+	return presented
+}
+
+func TestVerifyCredential(t *testing.T) {
+	_, claim, attestation := testCredentialSetup(t)
+	holder := did.FromAddress(testUserProxy)
+	for _, format := range []string{formatJSONLD, formatJWT} {
+		credential := exportedCredential(t, claim, attestation, format)
+		if _, err := verifyCredential(nil, credential, holder); err != nil {
+			t.Errorf("%s: %v", format, err)
+		}
+		if _, err := verifyCredential(nil, credential, did.FromAddress(testAttestantProxy)); err == nil {
+			t.Errorf("%s: accepted a credential presented by another holder", format)
+		}
+	}
+
+	tampered := exportedCredential(t, claim, attestation, formatJSONLD).(map[string]interface{})
+	tampered["credentialSubject"].(map[string]interface{})["claim"] = "other@example.com"
+	if _, err := verifyCredential(nil, tampered, holder); err == nil {
+		t.Errorf("accepted a credential with another claim")
+	}
+	forged := exportedCredential(t, claim, attestation, formatJWT).(string)
+	if _, err := verifyCredential(nil, forged[:len(forged)-4]+"AAAA", holder); err == nil {
+		t.Errorf("accepted a JWT-VC with a forged signature")
+	}
+
+	credential := exportedCredential(t, claim, attestation, formatJWT)
+	Storage().Attestations().Revoke(attestation.ID, "reason", getNow(), nil)
+	if _, err := verifyCredential(nil, credential, holder); err == nil {
+		t.Errorf("accepted the credential of a revoked attestation")
+	}
+}
+
+func TestVerifyPresentation(t *testing.T) {
+	holderPrivate, claim, attestation := testCredentialSetup(t)
+	presentation, err := signJWT(map[string]interface{}{
+		"iss":   did.FromAddress(testUserProxy),
+		"nonce": "challenge",
+		"exp":   float64(time.Now().Unix() + 300),
+		"vp": map[string]interface{}{
+			"verifiableCredential": []interface{}{exportedCredential(t, claim, attestation, formatJWT)},
+		},
+	}, algES256K, holderPrivate)
+	if err != nil {
+		t.Fatalf("signJWT: %v", err)
+	}
+	tests := []struct {
+		name      string
+		challenge string
+		status    int
+		valid     bool
+	}{
+		{"matching challenge", "challenge", 200, true},
+		{"other challenge", "other", 401, false},
+	}
+	for _, test := range tests {
+		bs, _ := json.Marshal(map[string]string{"presentation": presentation, "challenge": test.challenge})
+		rw := httptest.NewRecorder()
+		verifyPresentation(rw, httptest.NewRequest("POST", "/api/v1/presentations/verify", bytes.NewReader(bs)))
+		response := map[string]map[string]interface{}{}
+		json.Unmarshal(rw.Body.Bytes(), &response)
+		if valid, _ := response["result"]["valid"].(bool); rw.Code != test.status || valid != test.valid {
+			t.Errorf("%s: status = %d, valid = %v, want %d, %v", test.name, rw.Code, valid, test.status, test.valid)
+		}
+	}
+}
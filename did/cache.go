@@ -0,0 +1,67 @@
+package did
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache remembers successful resolutions of Resolver for TTL. At most Size
+// entries are kept; expired entries are dropped first.
+type Cache struct {
+	Resolver Resolver
+	TTL      time.Duration
+	Size     int
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	resolution *Resolution
+	expires    time.Time
+}
+
+// NewCache returns a cache of resolver.
+func NewCache(resolver Resolver, ttl time.Duration, size int) *Cache {
+	return &Cache{Resolver: resolver, TTL: ttl, Size: size, entries: map[string]cacheEntry{}}
+}
+
+// Resolve implements Resolver.
+func (c *Cache) Resolve(did string) (*Resolution, error) {
+	now := time.Now()
+	c.lock.Lock()
+	entry, ok := c.entries[did]
+	c.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.resolution, nil
+	}
+	resolution, err := c.Resolver.Resolve(did)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= c.Size {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		for key := range c.entries {
+			if len(c.entries) < c.Size {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	c.entries[did] = cacheEntry{resolution: resolution, expires: now.Add(c.TTL)}
+	return resolution, nil
+}
+
+// Invalidate forgets the cached resolution of did, for instance after its
+// keys changed.
+func (c *Cache) Invalidate(did string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, did)
+}
@@ -0,0 +1,152 @@
+// Package did builds and resolves did:ethr documents for winter user
+// proxies. Documents are built from the user record: the registered public
+// key is the only verification method, and the controller and recovery
+// contracts and the IPFS profile are published as services.
+package did
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Prefix starts every DID handled by this package.
+const Prefix = "did:ethr:"
+
+// Resolution errors.
+var (
+	ErrInvalidDID = errors.New("invalid DID")
+	ErrNotFound   = errors.New("DID not found")
+)
+
+var addressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// Contexts of the documents built by this package.
+var Contexts = []string{
+	"https://www.w3.org/ns/did/v1",
+	"https://w3id.org/security/suites/secp256k1-2019/v1",
+}
+
+// Document is a DID document.
+type Document struct {
+	Context            []string             `json:"@context"`
+	ID                 string               `json:"id"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Authentication     []string             `json:"authentication"`
+	AssertionMethod    []string             `json:"assertionMethod"`
+	Service            []Service            `json:"service,omitempty"`
+}
+
+// VerificationMethod is a public key of the subject.
+type VerificationMethod struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	Controller   string `json:"controller"`
+	PublicKeyHex string `json:"publicKeyHex"`
+}
+
+// Service is an endpoint published in a DID document.
+type Service struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// Metadata describes the document rather than the subject.
+type Metadata struct {
+	Created string `json:"created,omitempty"`
+	Updated string `json:"updated,omitempty"`
+}
+
+// ResolutionMetadata describes the outcome of a resolution.
+type ResolutionMetadata struct {
+	ContentType string `json:"contentType,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Resolution is a DID resolution result, as served by the HTTP binding.
+type Resolution struct {
+	Context            string             `json:"@context,omitempty"`
+	Document           *Document          `json:"didDocument"`
+	Metadata           Metadata           `json:"didDocumentMetadata"`
+	ResolutionMetadata ResolutionMetadata `json:"didResolutionMetadata"`
+}
+
+// Record holds the user fields a document is built from. Created and
+// Updated are reported as document metadata unchanged.
+type Record struct {
+	Proxy      string
+	PublicKey  string
+	Controller string
+	Recovery   string
+	IPFS       string
+	Created    string
+	Updated    string
+}
+
+// FromAddress returns the DID of a proxy address.
+func FromAddress(address string) string {
+	return Prefix + address
+}
+
+// Address returns the proxy address named by did.
+func Address(did string) (string, error) {
+	address := strings.TrimPrefix(did, Prefix)
+	if !strings.HasPrefix(did, Prefix) || !addressPattern.MatchString(address) {
+		return "", ErrInvalidDID
+	}
+	return address, nil
+}
+
+// Build returns the document of record. IPFS profiles link to gateway when
+// it is set and to ipfs:// URIs otherwise.
+func Build(record *Record, gateway string) *Resolution {
+	id := FromAddress(record.Proxy)
+	key := id + "#controller-key"
+	doc := &Document{
+		Context:            Contexts,
+		ID:                 id,
+		VerificationMethod: []VerificationMethod{},
+		Authentication:     []string{},
+		AssertionMethod:    []string{},
+	}
+	if len(record.PublicKey) > 0 {
+		doc.VerificationMethod = append(doc.VerificationMethod, VerificationMethod{
+			ID:           key,
+			Type:         "EcdsaSecp256k1VerificationKey2019",
+			Controller:   id,
+			PublicKeyHex: strings.TrimPrefix(record.PublicKey, "0x"),
+		})
+		doc.Authentication = append(doc.Authentication, key)
+		doc.AssertionMethod = append(doc.AssertionMethod, key)
+	}
+	if len(record.Controller) > 0 {
+		doc.Service = append(doc.Service, Service{
+			ID:              id + "#controller",
+			Type:            "ProxyController",
+			ServiceEndpoint: "ethereum:" + record.Controller,
+		})
+	}
+	if len(record.Recovery) > 0 {
+		doc.Service = append(doc.Service, Service{
+			ID:              id + "#recovery",
+			Type:            "ProxyRecovery",
+			ServiceEndpoint: "ethereum:" + record.Recovery,
+		})
+	}
+	if len(record.IPFS) > 0 {
+		endpoint := "ipfs://" + record.IPFS
+		if len(gateway) > 0 {
+			endpoint = strings.TrimRight(gateway, "/") + "/ipfs/" + record.IPFS
+		}
+		doc.Service = append(doc.Service, Service{
+			ID:              id + "#profile",
+			Type:            "IPFSProfile",
+			ServiceEndpoint: endpoint,
+		})
+	}
+	return &Resolution{
+		Document: doc,
+		Metadata: Metadata{Created: record.Created, Updated: record.Updated},
+	}
+}
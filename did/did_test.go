@@ -0,0 +1,74 @@
+package did
+
+import "testing"
+
+const testAddress = "0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5"
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		did   string
+		valid bool
+	}{
+		{Prefix + testAddress, true},
+		{testAddress, false},
+		{"did:web:" + testAddress, false},
+		{Prefix + "0x52bc", false},
+		{Prefix + testAddress + "00", false},
+	}
+	for _, test := range tests {
+		address, err := Address(test.did)
+		if test.valid && (err != nil || address != testAddress) {
+			t.Errorf("Address(%s) = %q, %v", test.did, address, err)
+		} else if !test.valid && err != ErrInvalidDID {
+			t.Errorf("Address(%s): err = %v, want ErrInvalidDID", test.did, err)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	record := &Record{
+		Proxy:      testAddress,
+		PublicKey:  "0x04abcd",
+		Controller: "0x01",
+		Recovery:   "0x02",
+		IPFS:       "QmProfile",
+		Created:    "2026-01-01 00:00:00",
+	}
+	resolution := Build(record, "https://ipfs.example.com/")
+	doc := resolution.Document
+	key := Prefix + testAddress + "#controller-key"
+	if doc.ID != Prefix+testAddress || len(doc.VerificationMethod) != 1 {
+		t.Fatalf("document = %+v", doc)
+	}
+	if method := doc.VerificationMethod[0]; method.ID != key || method.PublicKeyHex != "04abcd" || method.Controller != doc.ID {
+		t.Errorf("verification method = %+v", method)
+	}
+	if len(doc.Authentication) != 1 || doc.Authentication[0] != key || len(doc.AssertionMethod) != 1 {
+		t.Errorf("authentication = %v, assertionMethod = %v", doc.Authentication, doc.AssertionMethod)
+	}
+	endpoints := map[string]string{}
+	for _, service := range doc.Service {
+		endpoints[service.Type] = service.ServiceEndpoint
+	}
+	want := map[string]string{
+		"ProxyController": "ethereum:0x01",
+		"ProxyRecovery":   "ethereum:0x02",
+		"IPFSProfile":     "https://ipfs.example.com/ipfs/QmProfile",
+	}
+	for kind, endpoint := range want {
+		if endpoints[kind] != endpoint {
+			t.Errorf("%s endpoint = %q, want %q", kind, endpoints[kind], endpoint)
+		}
+	}
+	if resolution.Metadata.Created != record.Created {
+		t.Errorf("created = %q, want %q", resolution.Metadata.Created, record.Created)
+	}
+
+	bare := Build(&Record{Proxy: testAddress, IPFS: "QmProfile"}, "").Document
+	if len(bare.VerificationMethod) != 0 || len(bare.Authentication) != 0 {
+		t.Errorf("document without a key has verification methods: %+v", bare)
+	}
+	if len(bare.Service) != 1 || bare.Service[0].ServiceEndpoint != "ipfs://QmProfile" {
+		t.Errorf("services without a gateway = %+v", bare.Service)
+	}
+}
@@ -0,0 +1,98 @@
+package did
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Resolver resolves a DID to its document. Implementations return
+// ErrInvalidDID and ErrNotFound for DIDs they cannot parse or do not know.
+// Results may be shared and must not be modified.
+type Resolver interface {
+	Resolve(did string) (*Resolution, error)
+}
+
+// Source looks up the record of a proxy address. It returns ErrNotFound
+// when there is none.
+type Source interface {
+	Lookup(address string) (*Record, error)
+}
+
+// LocalResolver builds documents from a Source, typically the users table.
+type LocalResolver struct {
+	Source  Source
+	Gateway string
+}
+
+// Resolve implements Resolver.
+func (l *LocalResolver) Resolve(did string) (*Resolution, error) {
+	address, err := Address(did)
+	if err != nil {
+		return nil, err
+	}
+	record, err := l.Source.Lookup(address)
+	if err != nil {
+		return nil, err
+	}
+	return Build(record, l.Gateway), nil
+}
+
+// HTTPResolver resolves DIDs with the HTTP binding of DID resolution:
+// GET BaseURL + did answers a Resolution.
+type HTTPResolver struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewHTTPResolver returns a resolver for baseURL with a bounded timeout.
+func NewHTTPResolver(baseURL string, timeout time.Duration) *HTTPResolver {
+	return &HTTPResolver{BaseURL: baseURL, Client: &http.Client{Timeout: timeout}}
+}
+
+// Resolve implements Resolver.
+func (h *HTTPResolver) Resolve(did string) (*Resolution, error) {
+	if _, err := Address(did); err != nil {
+		return nil, err
+	}
+	resp, err := h.Client.Get(h.BaseURL + url.PathEscape(did))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusBadRequest:
+		return nil, ErrInvalidDID
+	default:
+		return nil, fmt.Errorf("resolver answered %s", resp.Status)
+	}
+	resolution := &Resolution{}
+	if err := json.NewDecoder(resp.Body).Decode(resolution); err != nil {
+		return nil, fmt.Errorf("invalid resolution: %v", err)
+	}
+	if resolution.Document == nil || resolution.Document.ID != did {
+		return nil, fmt.Errorf("resolver answered another DID")
+	}
+	return resolution, nil
+}
+
+// Fallback resolves with Primary and, for DIDs it does not know, with
+// Secondary.
+type Fallback struct {
+	Primary   Resolver
+	Secondary Resolver
+}
+
+// Resolve implements Resolver.
+func (f *Fallback) Resolve(did string) (*Resolution, error) {
+	resolution, err := f.Primary.Resolve(did)
+	if err == ErrNotFound {
+		return f.Secondary.Resolve(did)
+	}
+	return resolution, err
+}
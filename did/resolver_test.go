@@ -0,0 +1,110 @@
+package did
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingResolver builds a bare document for every valid DID and counts
+// its resolutions.
+type countingResolver struct {
+	calls int
+}
+
+func (c *countingResolver) Resolve(did string) (*Resolution, error) {
+	address, err := Address(did)
+	if err != nil {
+		return nil, err
+	}
+	c.calls++
+	return Build(&Record{Proxy: address}, ""), nil
+}
+
+type recordSource map[string]*Record
+
+func (s recordSource) Lookup(address string) (*Record, error) {
+	if record, ok := s[address]; ok {
+		return record, nil
+	}
+	return nil, ErrNotFound
+}
+
+func TestCache(t *testing.T) {
+	counting := &countingResolver{}
+	cache := NewCache(counting, time.Minute, 2)
+	did := FromAddress(testAddress)
+	cache.Resolve(did)
+	cache.Resolve(did)
+	if counting.calls != 1 {
+		t.Errorf("cached resolutions = %d, want 1", counting.calls)
+	}
+	cache.Invalidate(did)
+	cache.Resolve(did)
+	if counting.calls != 2 {
+		t.Errorf("resolutions after Invalidate = %d, want 2", counting.calls)
+	}
+	if _, err := cache.Resolve("did:ethr:0x01"); err != ErrInvalidDID {
+		t.Errorf("invalid DID: err = %v, want ErrInvalidDID", err)
+	}
+	for i := 1; i <= 3; i++ {
+		cache.Resolve(FromAddress("0x" + strings.Repeat(string('0'+rune(i)), 40)))
+	}
+	if len(cache.entries) > 2 {
+		t.Errorf("cache holds %d entries, want at most 2", len(cache.entries))
+	}
+
+	expiring := NewCache(counting, -time.Second, 2)
+	expiring.Resolve(did)
+	expiring.Resolve(did)
+	if counting.calls != 7 {
+		t.Errorf("resolutions with expired entries = %d, want 7", counting.calls)
+	}
+}
+
+func TestLocalResolver(t *testing.T) {
+	local := &LocalResolver{Source: recordSource{testAddress: {Proxy: testAddress, PublicKey: "04abcd"}}}
+	if resolution, err := local.Resolve(FromAddress(testAddress)); err != nil || len(resolution.Document.VerificationMethod) != 1 {
+		t.Errorf("Resolve = %+v, %v", resolution, err)
+	}
+	if _, err := local.Resolve(FromAddress("0x" + strings.Repeat("1", 40))); err != ErrNotFound {
+		t.Errorf("unknown DID: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	other := "0x" + strings.Repeat("2", 40)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/1.0/identifiers/") {
+		case FromAddress(testAddress):
+			json.NewEncoder(rw).Encode(Build(&Record{Proxy: testAddress}, ""))
+		case FromAddress(other):
+			json.NewEncoder(rw).Encode(Build(&Record{Proxy: testAddress}, ""))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+	remote := NewHTTPResolver(server.URL+"/1.0/identifiers/", time.Second)
+	if resolution, err := remote.Resolve(FromAddress(testAddress)); err != nil || resolution.Document.ID != FromAddress(testAddress) {
+		t.Errorf("Resolve = %+v, %v", resolution, err)
+	}
+	if _, err := remote.Resolve(FromAddress(other)); err == nil {
+		t.Errorf("accepted the document of another DID")
+	}
+	unknown := FromAddress("0x" + strings.Repeat("3", 40))
+	if _, err := remote.Resolve(unknown); err != ErrNotFound {
+		t.Errorf("unknown DID: err = %v, want ErrNotFound", err)
+	}
+
+	fallback := &Fallback{Primary: &LocalResolver{Source: recordSource{}}, Secondary: remote}
+	if resolution, err := fallback.Resolve(FromAddress(testAddress)); err != nil || resolution.Document.ID != FromAddress(testAddress) {
+		t.Errorf("Fallback = %+v, %v", resolution, err)
+	}
+	if _, err := fallback.Resolve("did:ethr:bad"); err != ErrInvalidDID {
+		t.Errorf("Fallback of an invalid DID: err = %v, want ErrInvalidDID", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/donh/winter/did"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DID resolution for user proxies. Documents are built from the users table
+// by package did; unless the resolver runs in local mode, DIDs that are not
+// registered here are passed on to an upstream resolver.
+
+const (
+	didModeLocal       = "local"
+	didResolverTimeout = 10 * time.Second
+	didResolutionType  = "application/did+ld+json"
+)
+
+var resolver *did.Cache
+
+// userSource looks up DID records in the users table.
+type userSource struct{}
+
+func (userSource) Lookup(address string) (*did.Record, error) {
+	user, err := Storage().Users().FindByProxy(address)
+	if err == errNotFound {
+		return nil, did.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &did.Record{
+		Proxy:      user.Proxy,
+		PublicKey:  user.PublicKey,
+		Controller: user.Controller,
+		Recovery:   user.Recovery,
+		IPFS:       user.IPFS,
+		Created:    rfc3339(user.Created),
+		Updated:    rfc3339(user.Updated),
+	}, nil
+}
+
+// newResolver returns the cached resolver described by cfg, which may be
+// nil for a local resolver with the default cache.
+func newResolver(cfg *DIDConfig) *did.Cache {
+	if cfg == nil {
+		cfg = &DIDConfig{}
+	}
+	ttl := 60
+	if cfg.CacheTTL != 0 {
+		ttl = cfg.CacheTTL
+	}
+	size := 1000
+	if cfg.CacheSize > 0 {
+		size = cfg.CacheSize
+	}
+	var r did.Resolver = &did.LocalResolver{Source: userSource{}, Gateway: cfg.IPFSGateway}
+	if cfg.Mode != didModeLocal && len(cfg.ResolverURL) > 0 {
+		remote := did.NewHTTPResolver(cfg.ResolverURL, didResolverTimeout)
+		remote.Client.Transport = upstream.transport
+		r = &did.Fallback{Primary: r, Secondary: remote}
+	}
+	return did.NewCache(r, time.Duration(ttl)*time.Second, size)
+}
+
+// resolveDID answers GET /api/v1/dids/<did> with a DID resolution result.
+func resolveDID(rw http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/dids/")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != "GET" {
+		renderJSON(rw, http.StatusMethodNotAllowed, &did.Resolution{
+			ResolutionMetadata: did.ResolutionMetadata{Error: "methodNotSupported"},
+		})
+		return
+	}
+	resolution, err := resolver.Resolve(id)
+	status := http.StatusOK
+	code := ""
+	if err == did.ErrInvalidDID {
+		status, code = http.StatusBadRequest, "invalidDid"
+	} else if err == did.ErrNotFound {
+		status, code = http.StatusNotFound, "notFound"
+	} else if err != nil {
+		logWarn(r, "resolve DID error", fields{"did": id, "error": err})
+		status, code = http.StatusBadGateway, "internalError"
+	}
+	if err != nil {
+		renderJSON(rw, status, &did.Resolution{ResolutionMetadata: did.ResolutionMetadata{Error: code}})
+		return
+	}
+	renderJSON(rw, status, &did.Resolution{
+		Context:            "https://w3id.org/did-resolution/v1",
+		Document:           resolution.Document,
+		Metadata:           resolution.Metadata,
+		ResolutionMetadata: did.ResolutionMetadata{ContentType: didResolutionType},
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Gateways accepted in GlobalConfig.Gateway.
+const (
+	gatewayHTTP      = "http"
+	gatewaySimulator = "simulator"
+)
+
+// ProxyContract holds the addresses of the identity contracts created for a
+// user on chain.
+type ProxyContract struct {
+	Proxy      string
+	Controller string
+	Recovery   string
+}
+
+// ChainGateway performs the blockchain operations needed to onboard a user
+// and to move their proxy to a new key. r is the inbound request on whose
+// behalf the call is made.
+type ChainGateway interface {
+	GetBalance(r *http.Request, address string) (float64, error)
+	Faucet(r *http.Request, address string, amount string) error
+	PrepareProxy(r *http.Request, address string) (string, error)
+	CreateProxy(r *http.Request, address string, signedTx string) (*ProxyContract, error)
+	// PrepareOwnerChange returns the unsigned transaction that makes
+	// newAddress the owner of proxy through contract, its controller or its
+	// recovery contract.
+	PrepareOwnerChange(r *http.Request, contract string, proxy string, newAddress string) (string, error)
+	ChangeOwner(r *http.Request, contract string, proxy string, newAddress string, signedTx string) error
+}
+
+var gateway ChainGateway
+
+func newChainGateway(name string) (ChainGateway, error) {
+	switch name {
+	case "", gatewayHTTP:
+		return &httpGateway{}, nil
+	case gatewaySimulator:
+		return newSimulatorGateway(), nil
+	}
+	return nil, fmt.Errorf("unsupported chain gateway: %s", name)
+}
+
+// prepareOnboarding funds address when needed and returns the unsigned
+// transaction that deploys its proxy contracts. The user signs it with their
+// own key; the server never sees that key.
+func prepareOnboarding(r *http.Request, address string) (string, error) {
+	balance, err := gateway.GetBalance(r, address)
+	if err != nil {
+		return "", err
+	}
+	if balance <= 10 {
+		if err := gateway.Faucet(r, address, "10"); err != nil {
+			return "", err
+		}
+	}
+	return gateway.PrepareProxy(r, address)
+}
+
+// httpGateway talks to the contract services configured in APIConfig.
+type httpGateway struct{}
+
+// upstreamError returns the first error recorded in result, if any,
+// prefixed with the name of the failing service.
+func upstreamError(service string, result map[string]interface{}) error {
+	if e := firstAPIError(result); e != nil {
+		return serviceError(service, e)
+	}
+	return nil
+}
+
+// serviceError returns err with its message prefixed by the name of the
+// failing service. Errors that are not an APIError are upstream failures.
+func serviceError(service string, err error) error {
+	e, ok := err.(*APIError)
+	if !ok {
+		e = upstreamFailure(err.Error())
+	}
+	failure := *e
+	failure.Message = service + ": " + failure.Message
+	return &failure
+}
+
+func newUpstreamResult() map[string]interface{} {
+	return map[string]interface{}{
+		"error": []string{},
+	}
+}
+
+func (g *httpGateway) GetBalance(r *http.Request, address string) (float64, error) {
+	result := newUpstreamResult()
+	response := getByJSON(r, "getBalance", Config().API.GetBalance+"/"+address, result)
+	if err := upstreamError("getBalance", result); err != nil {
+		return 0, err
+	}
+	value, ok := response["1"].(string)
+	if !ok {
+		return 0, nil
+	}
+	balance, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, upstreamFailure(fmt.Sprintf("getBalance: invalid balance %q", value))
+	}
+	return balance, nil
+}
+
+func (g *httpGateway) Faucet(r *http.Request, address string, amount string) error {
+	result := newUpstreamResult()
+	params := map[string]interface{}{
+		"addr":   address,
+		"amount": amount,
+	}
+	postByJSON(r, "getCoin", Config().API.GetCoin, params, result)
+	return upstreamError("getCoin", result)
+}
+
+func (g *httpGateway) PrepareProxy(r *http.Request, address string) (string, error) {
+	result := newUpstreamResult()
+	params := map[string]string{
+		"delegates":     Config().Delegate,
+		"senderAddress": address,
+		"userKey":       address,
+	}
+	response := postByForm(r, "prepareProxy", Config().API.PrepareProxy, params, result)
+	if err := upstreamError("prepareProxy", result); err != nil {
+		return "", err
+	}
+	rawTx, ok := response["rawTx"].(string)
+	if !ok || len(rawTx) == 0 {
+		return "", upstreamFailure("prepareProxy: response has no rawTx")
+	}
+	return rawTx, nil
+}
+
+func (g *httpGateway) CreateProxy(r *http.Request, address string, signedTx string) (*ProxyContract, error) {
+	result := newUpstreamResult()
+	params := map[string]string{
+		"rawTxSigned":   signedTx,
+		"senderAddress": address,
+		"userKey":       address,
+	}
+	response := postByForm(r, "createProxy", Config().API.CreateProxy, params, result)
+	if err := upstreamError("createProxy", result); err != nil {
+		return nil, err
+	}
+	contract, ok := response["contract"].(map[string]interface{})
+	if !ok {
+		return nil, upstreamFailure("createProxy: response has no contract")
+	}
+	proxy, _ := contract["proxy"].(string)
+	controller, _ := contract["controller"].(string)
+	recovery, _ := contract["recovery"].(string)
+	if len(proxy) == 0 {
+		return nil, upstreamFailure("createProxy: contract has no proxy")
+	}
+	return &ProxyContract{
+		Proxy:      proxy,
+		Controller: controller,
+		Recovery:   recovery,
+	}, nil
+}
+
+func (g *httpGateway) PrepareOwnerChange(r *http.Request, contract string, proxy string, newAddress string) (string, error) {
+	result := newUpstreamResult()
+	params := map[string]string{
+		"contract": contract,
+		"newOwner": newAddress,
+		"proxy":    proxy,
+	}
+	response := postByForm(r, "transferProxyChange", Config().API.TransferProxyChange, params, result)
+	if err := upstreamError("transferProxyChange", result); err != nil {
+		return "", err
+	}
+	rawTx, ok := response["rawTx"].(string)
+	if !ok || len(rawTx) == 0 {
+		return "", upstreamFailure("transferProxyChange: response has no rawTx")
+	}
+	return rawTx, nil
+}
+
+func (g *httpGateway) ChangeOwner(r *http.Request, contract string, proxy string, newAddress string, signedTx string) error {
+	result := newUpstreamResult()
+	params := map[string]string{
+		"contract":    contract,
+		"newOwner":    newAddress,
+		"proxy":       proxy,
+		"rawTxSigned": signedTx,
+	}
+	postByForm(r, "transferProxySign", Config().API.TransferProxySign, params, result)
+	return upstreamError("transferProxySign", result)
+}
+
+// simulatorGateway fabricates chain responses in process. Addresses are
+// derived from the user address, so the same user always gets the same
+// contracts.
+type simulatorGateway struct {
+	lock     sync.Mutex
+	balances map[string]float64
+}
+
+func newSimulatorGateway() *simulatorGateway {
+	return &simulatorGateway{
+		balances: map[string]float64{},
+	}
+}
+
+func simulatedHex(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, ":")))
+	return "0x" + hex.EncodeToString(sum[:])
+}
+
+func simulatedAddress(kind string, address string) string {
+	return simulatedHex(kind, strings.ToLower(address))[:42]
+}
+
+func (g *simulatorGateway) GetBalance(r *http.Request, address string) (float64, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.balances[strings.ToLower(address)], nil
+}
+
+func (g *simulatorGateway) Faucet(r *http.Request, address string, amount string) error {
+	value, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return fmt.Errorf("faucet: invalid amount %q", amount)
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.balances[strings.ToLower(address)] += value
+	return nil
+}
+
+func (g *simulatorGateway) PrepareProxy(r *http.Request, address string) (string, error) {
+	return simulatedHex("rawTx", strings.ToLower(address)), nil
+}
+
+func (g *simulatorGateway) CreateProxy(r *http.Request, address string, signedTx string) (*ProxyContract, error) {
+	if len(signedTx) == 0 {
+		return nil, badRequest("rawTxSigned", "createProxy: unsigned transaction")
+	}
+	return &ProxyContract{
+		Proxy:      simulatedAddress("proxy", address),
+		Controller: simulatedAddress("controller", address),
+		Recovery:   simulatedAddress("recovery", address),
+	}, nil
+}
+
+func (g *simulatorGateway) PrepareOwnerChange(r *http.Request, contract string, proxy string, newAddress string) (string, error) {
+	return simulatedHex("rawTx", strings.ToLower(contract), strings.ToLower(proxy), strings.ToLower(newAddress)), nil
+}
+
+func (g *simulatorGateway) ChangeOwner(r *http.Request, contract string, proxy string, newAddress string, signedTx string) error {
+	if len(signedTx) == 0 {
+		return badRequest("rawTxSigned", "transferProxySign: unsigned transaction")
+	}
+	if len(contract) == 0 {
+		return upstreamFailure("transferProxySign: proxy has no such contract")
+	}
+	return nil
+}
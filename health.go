@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/googollee/go-socket.io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds every dependency check of /readyz.
+const readinessTimeout = 2 * time.Second
+
+// sockets is the socket.io server, set once main has created it.
+var sockets *socketio.Server
+
+// check is the outcome of one dependency check. Only its status is
+// served; the reason it failed, which may name hosts and files, is logged.
+type check struct {
+	Status string `json:"status"`
+	reason string
+}
+
+func passed() *check {
+	return &check{Status: "ok"}
+}
+
+func failed(reason string) *check {
+	return &check{Status: "failed", reason: reason}
+}
+
+func (c *check) ok() bool {
+	return c.Status == "ok"
+}
+
+// healthz answers liveness probes: the process is serving requests.
+func healthz(rw http.ResponseWriter, r *http.Request) {
+	renderJSON(rw, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+		"time":   getNow(),
+	})
+}
+
+// readyz answers readiness probes with the state of every dependency. It
+// fails when the config, database or socket.io server is down, while the
+// server shuts down, and when an upstream service listed in
+// UpstreamConfig.Required is unreachable; other upstreams are reported
+// only.
+func readyz(rw http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	configured, database, socket := checkConfig(), checkDatabase(ctx), checkSockets()
+	upstreams := checkUpstreams(ctx)
+	ready := configured.ok() && database.ok() && socket.ok()
+	required := map[string]bool{}
+	for _, service := range upstreamConfig().Required {
+		required[service] = true
+	}
+	for service, c := range upstreams {
+		ready = ready && (c.ok() || !required[service])
+		logCheck(r, "upstreams."+service, c)
+	}
+	logCheck(r, "config", configured)
+	logCheck(r, "database", database)
+	logCheck(r, "socketio", socket)
+	checks := map[string]interface{}{
+		"config":    configured,
+		"database":  database,
+		"socketio":  socket,
+		"upstreams": upstreams,
+	}
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	renderJSON(rw, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+		"time":   getNow(),
+	})
+}
+
+func logCheck(r *http.Request, name string, c *check) {
+	if !c.ok() {
+		logWarn(r, "readiness check failed", fields{"check": name, "error": c.reason})
+	}
+}
+
+func checkConfig() *check {
+	cfg := Config()
+	if cfg == nil {
+		return failed("config not loaded")
+	} else if cfg.Database == nil {
+		return failed("database not configured")
+	} else if cfg.API == nil {
+		return failed("api not configured")
+	}
+	return passed()
+}
+
+func checkDatabase(ctx context.Context) *check {
+	store := Storage()
+	if store == nil || Config().Database == nil {
+		return failed("database not opened")
+	}
+	if err := store.Ping(ctx); err != nil {
+		return failed(err.Error())
+	}
+	return passed()
+}
+
+func checkSockets() *check {
+	select {
+	case <-hub.closing():
+		return failed("shutting down")
+	default:
+	}
+	if sockets == nil {
+		return failed("socket.io server not started")
+	}
+	if sockets.Count() >= sockets.GetMaxConnection() {
+		return failed("connection limit reached")
+	}
+	return passed()
+}
+
+// checkUpstreams dials the host of every service configured in APIConfig,
+// named after its field, and reports services whose circuit is open.
+func checkUpstreams(ctx context.Context) map[string]*check {
+	checks := map[string]*check{}
+	if Config().API == nil {
+		return checks
+	}
+	hosts := map[string][]string{}
+	value := reflect.ValueOf(*Config().API)
+	for i := 0; i < value.NumField(); i++ {
+		service := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		destination := value.Field(i).String()
+		if len(destination) == 0 {
+			continue
+		}
+		host, err := upstreamHost(destination)
+		if err != nil {
+			checks[service] = failed(err.Error())
+			continue
+		}
+		hosts[host] = append(hosts[host], service)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	dialer := &net.Dialer{}
+	for host, services := range hosts {
+		wg.Add(1)
+		go func(host string, services []string) {
+			defer wg.Done()
+			result := passed()
+			conn, err := dialer.DialContext(ctx, "tcp", host)
+			if err != nil {
+				result = failed(err.Error())
+			} else {
+				conn.Close()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, service := range services {
+				item := *result
+				checks[service] = &item
+			}
+		}(host, services)
+	}
+	wg.Wait()
+	cfg := upstreamConfig()
+	for service, c := range checks {
+		if c.ok() && upstream.tripped(service, cfg) {
+			checks[service] = failed("circuit open")
+		}
+	}
+	return checks
+}
+
+// upstreamHost returns the host:port to dial for destination.
+func upstreamHost(destination string) (string, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	if len(u.Host) == 0 {
+		return "", fmt.Errorf("%s has no host", destination)
+	}
+	if len(u.Port()) > 0 {
+		return u.Host, nil
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// tokenHub notifies websocket clients waiting on a login or authorization
+// token as soon as the mobile app has validated it.
+type tokenHub struct {
+	lock    sync.Mutex
+	waiters map[string][]chan *Token
+	done    chan struct{}
+	once    sync.Once
+	// handlers counts the websocket handlers between enter and leave.
+	handlers sync.WaitGroup
+}
+
+var hub = newTokenHub()
+
+func newTokenHub() *tokenHub {
+	return &tokenHub{
+		waiters: map[string][]chan *Token{},
+		done:    make(chan struct{}),
+	}
+}
+
+// subscribe registers interest in token. The returned channel receives the
+// token once it is published; cancel must be called when done waiting.
+func (h *tokenHub) subscribe(token string) (<-chan *Token, func()) {
+	ch := make(chan *Token, 1)
+	h.lock.Lock()
+	h.waiters[token] = append(h.waiters[token], ch)
+	h.lock.Unlock()
+
+	cancel := func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		waiters := h.waiters[token]
+		for i, waiter := range waiters {
+			if waiter == ch {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(h.waiters, token)
+		} else {
+			h.waiters[token] = waiters
+		}
+	}
+	return ch, cancel
+}
+
+func (h *tokenHub) publish(token *Token) {
+	h.lock.Lock()
+	waiters := h.waiters[token.Token]
+	delete(h.waiters, token.Token)
+	h.lock.Unlock()
+
+	for _, ch := range waiters {
+		item := *token
+		ch <- &item
+	}
+}
+
+// pending returns the number of subscribers still waiting.
+func (h *tokenHub) pending() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	count := 0
+	for _, waiters := range h.waiters {
+		count += len(waiters)
+	}
+	return count
+}
+
+// shutdown wakes every subscriber, and any later one, through closing.
+func (h *tokenHub) shutdown() {
+	h.once.Do(func() {
+		h.lock.Lock()
+		close(h.done)
+		h.lock.Unlock()
+	})
+}
+
+// enter registers a websocket handler until it calls leave. It returns
+// false once the server is shutting down.
+func (h *tokenHub) enter() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	select {
+	case <-h.done:
+		return false
+	default:
+	}
+	h.handlers.Add(1)
+	return true
+}
+
+func (h *tokenHub) leave() {
+	h.handlers.Done()
+}
+
+// drain waits until every handler has left or ctx is done, and reports
+// whether they all left.
+func (h *tokenHub) drain(ctx context.Context) bool {
+	left := make(chan struct{})
+	go func() {
+		h.handlers.Wait()
+		close(left)
+	}()
+	select {
+	case <-left:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// closing returns a channel that is closed when the server shuts down.
+func (h *tokenHub) closing() <-chan struct{} {
+	return h.done
+}
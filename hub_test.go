@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenHubPublish(t *testing.T) {
+	h := newTokenHub()
+	first, cancelFirst := h.subscribe("token")
+	second, cancelSecond := h.subscribe("token")
+	defer cancelFirst()
+	defer cancelSecond()
+	if h.pending() != 2 {
+		t.Fatalf("pending = %d, want 2", h.pending())
+	}
+	h.publish(&Token{Token: "token", Valid: true})
+	for _, ch := range []<-chan *Token{first, second} {
+		select {
+		case row := <-ch:
+			if !row.Valid {
+				t.Errorf("published token is not valid")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber was not notified")
+		}
+	}
+	if h.pending() != 0 {
+		t.Errorf("pending after publish = %d, want 0", h.pending())
+	}
+}
+
+func TestTokenHubCancel(t *testing.T) {
+	h := newTokenHub()
+	_, cancel := h.subscribe("token")
+	cancel()
+	if h.pending() != 0 {
+		t.Errorf("pending after cancel = %d, want 0", h.pending())
+	}
+}
+
+func TestTokenHubDrain(t *testing.T) {
+	h := newTokenHub()
+	if !h.enter() {
+		t.Fatalf("enter refused before shutdown")
+	}
+	h.shutdown()
+	if h.enter() {
+		t.Errorf("enter accepted after shutdown")
+	}
+	select {
+	case <-h.closing():
+	default:
+		t.Errorf("closing is not closed after shutdown")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if h.drain(ctx) {
+		t.Errorf("drain returned with a handler still running")
+	}
+	h.leave()
+	if !h.drain(context.Background()) {
+		t.Errorf("drain did not return once the handler left")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Content stores accepted in IPFSConfig.Store.
+const (
+	contentStoreHTTP = "http"
+	contentStoreFS   = "fs"
+)
+
+// maxContentSize keeps published documents within one IPFS chunk, so that
+// their CID is the CIDv1 of a single raw block and can be recomputed from
+// the content.
+const maxContentSize = 256 * 1024
+
+var cidPattern = regexp.MustCompile(`^b[a-z2-7]{58}$`)
+
+// ContentStore stores immutable documents addressed by their CID. r is the
+// inbound request on whose behalf the call is made.
+type ContentStore interface {
+	Put(r *http.Request, content []byte) (string, error)
+	// Get returns the content of cid after checking that it matches cid.
+	Get(r *http.Request, cid string) ([]byte, error)
+}
+
+var contentStore ContentStore
+
+func newContentStore(cfg *IPFSConfig) (ContentStore, error) {
+	if cfg == nil {
+		cfg = &IPFSConfig{}
+	}
+	switch cfg.Store {
+	case "", contentStoreHTTP:
+		return &httpContentStore{}, nil
+	case contentStoreFS:
+		if len(cfg.Dir) == 0 {
+			return nil, fmt.Errorf("ipfs.dir is required for the fs content store")
+		}
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			return nil, err
+		}
+		return &fsContentStore{dir: cfg.Dir}, nil
+	}
+	return nil, fmt.Errorf("unsupported content store: %s", cfg.Store)
+}
+
+// contentID returns the CIDv1 of content stored as one raw block: base32
+// multibase, version 1, raw codec and a sha2-256 multihash.
+func contentID(content []byte) string {
+	sum := sha256.Sum256(content)
+	cid := append([]byte{0x01, 0x55, 0x12, 0x20}, sum[:]...)
+	encoded := base32.StdEncoding.EncodeToString(cid)
+	return "b" + strings.ToLower(strings.TrimRight(encoded, "="))
+}
+
+// checkContent verifies that content is addressed by cid.
+func checkContent(cid string, content []byte) error {
+	if contentID(content) != cid {
+		return upstreamFailure("ipfs: content does not match " + cid)
+	}
+	return nil
+}
+
+// httpContentStore talks to the IPFS HTTP API: APIConfig.PrepareIPFS is
+// its add endpoint and APIConfig.GetIPFS its cat endpoint.
+type httpContentStore struct{}
+
+func (s *httpContentStore) Put(r *http.Request, content []byte) (string, error) {
+	if len(content) > maxContentSize {
+		return "", badRequest("", "Document exceeds 256 KiB.")
+	}
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", "profile.json")
+	if err != nil {
+		return "", err
+	}
+	part.Write(content)
+	form.Close()
+	query := url.Values{}
+	query.Set("cid-version", "1")
+	query.Set("raw-leaves", "true")
+	query.Set("pin", "true")
+	response, err := upstream.do(r, "prepareIPFS", "POST", Config().API.PrepareIPFS+"?"+query.Encode(), form.FormDataContentType(), body.Bytes())
+	if err != nil {
+		return "", serviceError("ipfs add", err)
+	}
+	var added struct {
+		Hash string
+	}
+	if err := json.Unmarshal(response, &added); err != nil {
+		return "", upstreamFailure("ipfs add: " + err.Error())
+	}
+	cid := contentID(content)
+	if added.Hash != cid {
+		return "", upstreamFailure("ipfs add: stored as " + added.Hash + ", expected " + cid)
+	}
+	return cid, nil
+}
+
+func (s *httpContentStore) Get(r *http.Request, cid string) ([]byte, error) {
+	content, err := upstream.do(r, "getIPFS", "POST", Config().API.GetIPFS+"?arg="+url.QueryEscape(cid), "", nil)
+	if err != nil {
+		return nil, serviceError("ipfs cat", err)
+	}
+	return content, checkContent(cid, content)
+}
+
+// fsContentStore keeps documents in a local directory, one file per CID.
+// It stands in for IPFS in development.
+type fsContentStore struct {
+	dir string
+}
+
+func (s *fsContentStore) Put(r *http.Request, content []byte) (string, error) {
+	if len(content) > maxContentSize {
+		return "", badRequest("", "Document exceeds 256 KiB.")
+	}
+	cid := contentID(content)
+	path := filepath.Join(s.dir, cid)
+	if _, err := os.Stat(path); err == nil {
+		return cid, nil
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".put-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	tmp.Close()
+	return cid, os.Rename(tmp.Name(), path)
+}
+
+func (s *fsContentStore) Get(r *http.Request, cid string) ([]byte, error) {
+	if !cidPattern.MatchString(cid) {
+		return nil, errNotFound
+	}
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, cid))
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return content, checkContent(cid, content)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFSContentStore returns a content store in a temporary directory and
+// a function that removes it.
+func testFSContentStore(t *testing.T) (ContentStore, string, func()) {
+	dir, err := ioutil.TempDir("", "ipfs")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	store, err := newContentStore(&IPFSConfig{Store: contentStoreFS, Dir: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("newContentStore: %v", err)
+	}
+	return store, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestContentID(t *testing.T) {
+	// The CIDv1 of the empty raw block, as computed by go-ipfs.
+	if cid := contentID(nil); cid != "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku" {
+		t.Errorf("contentID(empty) = %s", cid)
+	}
+	if cid := contentID([]byte("profile")); !cidPattern.MatchString(cid) {
+		t.Errorf("contentID = %s, does not match cidPattern", cid)
+	}
+}
+
+func TestFSContentStore(t *testing.T) {
+	store, dir, cleanup := testFSContentStore(t)
+	defer cleanup()
+	content := []byte(`{"type":"WinterProfile"}`)
+	cid, err := store.Put(nil, content)
+	if err != nil || cid != contentID(content) {
+		t.Fatalf("Put = %s, %v", cid, err)
+	}
+	if again, err := store.Put(nil, content); err != nil || again != cid {
+		t.Errorf("second Put = %s, %v", again, err)
+	}
+	if stored, err := store.Get(nil, cid); err != nil || string(stored) != string(content) {
+		t.Errorf("Get = %q, %v", stored, err)
+	}
+	if _, err := store.Get(nil, contentID([]byte("other"))); err != errNotFound {
+		t.Errorf("unknown CID: err = %v, want errNotFound", err)
+	}
+	if _, err := store.Get(nil, "../"+cid); err != errNotFound {
+		t.Errorf("path outside the store: err = %v, want errNotFound", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, cid), []byte(`{"type":"Tampered"}`), 0600)
+	if _, err := store.Get(nil, cid); err == nil {
+		t.Errorf("Get returned content that does not match its CID")
+	}
+	if _, err := store.Put(nil, make([]byte, maxContentSize+1)); toAPIError(nil, err).Status != 400 {
+		t.Errorf("oversized Put: err = %v, want a bad request", err)
+	}
+}
+
+func TestHTTPContentStore(t *testing.T) {
+	useTestConfig()
+	content := []byte(`{"type":"WinterProfile"}`)
+	hash := contentID(content)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/add") {
+			rw.Write([]byte(`{"Hash":"` + hash + `"}`))
+			return
+		}
+		rw.Write(content)
+	}))
+	defer server.Close()
+	Config().API = &APIConfig{PrepareIPFS: server.URL + "/add", GetIPFS: server.URL + "/cat"}
+	store, _ := newContentStore(nil)
+
+	if cid, err := store.Put(nil, content); err != nil || cid != hash {
+		t.Errorf("Put = %s, %v", cid, err)
+	}
+	if _, err := store.Put(nil, []byte("other")); err == nil {
+		t.Errorf("Put accepted a CID that does not match the content")
+	}
+	if stored, err := store.Get(nil, hash); err != nil || string(stored) != string(content) {
+		t.Errorf("Get = %q, %v", stored, err)
+	}
+	if _, err := store.Get(nil, contentID([]byte("other"))); err == nil {
+		t.Errorf("Get accepted content that does not match its CID")
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	algES256  = "ES256"
+	algES256K = "ES256K"
+
+	jwtModeNative = "native"
+	jwtModeRemote = "remote"
+
+	serverIssuer = "idhub.chancheng.server"
+	userAudience = "idhub.chancheng.user"
+)
+
+type jwtToken struct {
+	header       map[string]interface{}
+	payload      map[string]interface{}
+	signingInput string
+	signature    []byte
+}
+
+func jwtMode() string {
+	if cfg := Config().JWT; cfg != nil && cfg.Mode == jwtModeRemote {
+		return jwtModeRemote
+	}
+	return jwtModeNative
+}
+
+func jwtAlgorithm() string {
+	if cfg := Config().JWT; cfg != nil && cfg.Algorithm == algES256 {
+		return algES256
+	}
+	return algES256K
+}
+
+// decodeSegment decodes an unpadded base64url segment. Padded segments are
+// rejected so that every token has a single encoding.
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(segment)
+}
+
+func decodeSegmentJSON(segment string) (map[string]interface{}, error) {
+	bs, err := decodeSegment(segment)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+	m := map[string]interface{}{}
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseJWT(token string) (*jwtToken, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT: expected three segments")
+	}
+	header, err := decodeSegmentJSON(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	payload, err := decodeSegmentJSON(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %v", err)
+	}
+	t := &jwtToken{
+		header:       header,
+		payload:      payload,
+		signingInput: parts[0] + "." + parts[1],
+		signature:    signature,
+	}
+	return t, nil
+}
+
+// signingInput returns the header and payload segments of token, which
+// identify it whatever the encoding of its signature.
+func signingInput(token string) string {
+	token = strings.TrimSpace(token)
+	if i := strings.LastIndex(token, "."); i >= 0 {
+		return token[:i]
+	}
+	return token
+}
+
+func decodeHexKey(key string) ([]byte, error) {
+	key = strings.TrimPrefix(strings.TrimSpace(key), "0x")
+	return hex.DecodeString(key)
+}
+
+func parsePublicKey(alg string, key string) (*ecdsa.PublicKey, error) {
+	bs, err := decodeHexKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	switch alg {
+	case algES256K:
+		// Ethereum tooling often drops the 0x04 prefix of uncompressed keys.
+		if len(bs) == 64 {
+			bs = append([]byte{0x04}, bs...)
+		}
+		pub, err := btcec.ParsePubKey(bs, btcec.S256())
+		if err != nil {
+			return nil, fmt.Errorf("invalid secp256k1 public key: %v", err)
+		}
+		return pub.ToECDSA(), nil
+	case algES256:
+		if len(bs) == 64 {
+			bs = append([]byte{0x04}, bs...)
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), bs)
+		if x == nil {
+			return nil, errors.New("invalid P-256 public key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported JWT algorithm: %s", alg)
+}
+
+func parsePrivateKey(alg string, key string) (*ecdsa.PrivateKey, error) {
+	bs, err := decodeHexKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	if len(bs) != 32 {
+		return nil, errors.New("invalid private key: expected 32 bytes")
+	}
+	switch alg {
+	case algES256K:
+		priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), bs)
+		return priv.ToECDSA(), nil
+	case algES256:
+		curve := elliptic.P256()
+		d := new(big.Int).SetBytes(bs)
+		if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+			return nil, errors.New("invalid P-256 private key")
+		}
+		priv := &ecdsa.PrivateKey{D: d}
+		priv.PublicKey.Curve = curve
+		priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(bs)
+		return priv, nil
+	}
+	return nil, fmt.Errorf("unsupported JWT algorithm: %s", alg)
+}
+
+func verifyJWTSignature(t *jwtToken, publicKey string) error {
+	alg, _ := t.header["alg"].(string)
+	pub, err := parsePublicKey(alg, publicKey)
+	if err != nil {
+		return err
+	}
+	// ES256K-R style signatures carry a trailing recovery byte.
+	signature := t.signature
+	if len(signature) == 65 {
+		signature = signature[:64]
+	}
+	if len(signature) != 64 {
+		return errors.New("invalid JWT signature length")
+	}
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	// secp256k1 signers produce a canonical low S; (r, N-s) is the same
+	// signature in another encoding.
+	if alg == algES256K && s.Cmp(new(big.Int).Rsh(btcec.S256().N, 1)) > 0 {
+		return errors.New("JWT signature is not canonical")
+	}
+	hash := sha256.Sum256([]byte(t.signingInput))
+	if !ecdsa.Verify(pub, hash[:], r, s) {
+		return errors.New("JWT signature verification failed")
+	}
+	return nil
+}
+
+func signJWT(payload map[string]interface{}, alg string, privateKey string) (string, error) {
+	priv, err := parsePrivateKey(alg, privateKey)
+	if err != nil {
+		return "", err
+	}
+	header := map[string]interface{}{
+		"alg": alg,
+		"typ": "JWT",
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(payloadJSON)
+	hash := sha256.Sum256([]byte(signingInput))
+
+	var r, s *big.Int
+	if alg == algES256K {
+		// btcec signs deterministically (RFC 6979) with a canonical low S.
+		sig, err := (*btcec.PrivateKey)(priv).Sign(hash[:])
+		if err != nil {
+			return "", err
+		}
+		r, s = sig.R, sig.S
+	} else {
+		r, s, err = ecdsa.Sign(rand.Reader, priv, hash[:])
+		if err != nil {
+			return "", err
+		}
+	}
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func claimInt64(payload map[string]interface{}, name string) (int64, bool, error) {
+	value, ok := payload[name]
+	if !ok {
+		return 0, false, nil
+	}
+	switch v := value.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			f, ferr := v.Float64()
+			if ferr != nil {
+				return 0, true, fmt.Errorf("invalid %s claim", name)
+			}
+			n = int64(f)
+		}
+		return n, true, nil
+	case float64:
+		return int64(v), true, nil
+	}
+	return 0, true, fmt.Errorf("invalid %s claim", name)
+}
+
+func claimHasAudience(payload map[string]interface{}, audience string) bool {
+	switch aud := payload["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, item := range aud {
+			if s, ok := item.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtLeeway is the clock skew, in seconds, tolerated on time claims.
+func jwtLeeway() int64 {
+	if cfg := Config().JWT; cfg != nil && cfg.Leeway > 0 {
+		return int64(cfg.Leeway)
+	}
+	return 60
+}
+
+// validateJWTClaims checks the registered time claims of payload and, when
+// configured, its audience and issuer. requireExp rejects tokens without exp.
+func validateJWTClaims(payload map[string]interface{}, requireExp bool) error {
+	leeway := jwtLeeway()
+	audience := ""
+	issuer := ""
+	if cfg := Config().JWT; cfg != nil {
+		audience = cfg.Audience
+		issuer = cfg.Issuer
+	}
+	now := time.Now().UTC().Unix()
+
+	exp, ok, err := claimInt64(payload, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok && requireExp {
+		return errors.New("JWT has no exp claim")
+	}
+	if ok && now > exp+leeway {
+		return errors.New("JWT expired")
+	}
+	nbf, ok, err := claimInt64(payload, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now+leeway < nbf {
+		return errors.New("JWT not valid yet")
+	}
+	iat, ok, err := claimInt64(payload, "iat")
+	if err != nil {
+		return err
+	}
+	if ok && now+leeway < iat {
+		return errors.New("JWT issued in the future")
+	}
+	if len(audience) > 0 && !claimHasAudience(payload, audience) {
+		return errors.New("JWT audience mismatch")
+	}
+	if len(issuer) > 0 {
+		if iss, _ := payload["iss"].(string); iss != issuer {
+			return errors.New("JWT issuer mismatch")
+		}
+	}
+	return nil
+}
+
+func decodeJWT(r *http.Request, token string, result map[string]interface{}) map[string]interface{} {
+	if jwtMode() == jwtModeRemote {
+		params := map[string]interface{}{
+			"token": token,
+		}
+		response := postByJSON(r, "decodeJWT", Config().API.DecodeJWT, params, result)
+		if body, ok := response["payload"].(map[string]interface{}); ok {
+			return body
+		}
+		if firstAPIError(result) == nil {
+			setAPIError(badRequest("", "Unable to decode JWT."), result)
+		}
+		return map[string]interface{}{}
+	}
+	t, err := parseJWT(token)
+	if err != nil {
+		setAPIError(badRequest("", err.Error()), result)
+		return map[string]interface{}{}
+	}
+	return t.payload
+}
+
+func verifyJWT(r *http.Request, publicKey string, token string, result map[string]interface{}) bool {
+	if jwtMode() == jwtModeRemote {
+		params := map[string]interface{}{
+			"pubkey": publicKey,
+			"token":  token,
+		}
+		response := postByJSON(r, "verifyJWT", Config().API.VerifyJWT, params, result)
+		if response["result"] == "True" {
+			return true
+		}
+		if firstAPIError(result) == nil {
+			setAPIError(unauthorized("JWT signature verification failed."), result)
+		}
+		return false
+	}
+	t, err := parseJWT(token)
+	if err != nil {
+		setAPIError(badRequest("", err.Error()), result)
+		return false
+	}
+	if err = verifyJWTSignature(t, publicKey); err != nil {
+		setAPIError(unauthorized(err.Error()), result)
+		return false
+	}
+	return true
+}
+
+func encodeJWT(r *http.Request, payload map[string]interface{}, result map[string]interface{}) string {
+	if jwtMode() == jwtModeRemote {
+		params := map[string]interface{}{
+			"payload":     payload,
+			"private_key": Config().JWT.ServerPrivateKey,
+		}
+		response := postByJSON(r, "encodeJWT", Config().API.EncodeJWT, params, result)
+		token, _ := response["token"].(string)
+		return token
+	}
+	token, err := signJWT(payload, jwtAlgorithm(), Config().JWT.ServerPrivateKey)
+	if err != nil {
+		setFailure(r, err, result)
+		return ""
+	}
+	return token
+}
+
+func checkJWTClaims(payload map[string]interface{}, requireExp bool, result map[string]interface{}) bool {
+	if err := validateJWTClaims(payload, requireExp); err != nil {
+		setAPIError(unauthorized(err.Error()), result)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/btcsuite/btcd/btcec"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPrivateKey = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+
+// useTestConfig installs a native JWT config with a 60 second leeway and an
+// empty memory store.
+func useTestConfig() {
+	setConfig(&GlobalConfig{JWT: &JWTConfig{Leeway: 60}})
+	setStorage(newMemoryStore())
+}
+
+// testPublicKey returns the uncompressed hex public key of testPrivateKey
+// on the curve of alg.
+func testPublicKey(t *testing.T, alg string) string {
+	priv, err := parsePrivateKey(alg, testPrivateKey)
+	if err != nil {
+		t.Fatalf("parsePrivateKey(%s): %v", alg, err)
+	}
+	return hex.EncodeToString(elliptic.Marshal(priv.Curve, priv.X, priv.Y))
+}
+
+func testJWT(t *testing.T, alg string, payload map[string]interface{}) string {
+	token, err := signJWT(payload, alg, testPrivateKey)
+	if err != nil {
+		t.Fatalf("signJWT(%s): %v", alg, err)
+	}
+	return token
+}
+
+// withHeader replaces the header of token, keeping its signature.
+func withHeader(token string, header string) string {
+	parts := strings.Split(token, ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(header))
+	return strings.Join(parts, ".")
+}
+
+// highS returns the other, non-canonical encoding (r, N-s) of an ES256K
+// signature.
+func highS(signature []byte) string {
+	s := new(big.Int).SetBytes(signature[32:64])
+	s.Sub(btcec.S256().N, s)
+	encoded := append([]byte{}, signature[:32]...)
+	sBytes := s.Bytes()
+	encoded = append(encoded, make([]byte, 32-len(sBytes))...)
+	return base64.RawURLEncoding.EncodeToString(append(encoded, sBytes...))
+}
+
+func TestSignAndVerifyJWT(t *testing.T) {
+	useTestConfig()
+	for _, alg := range []string{algES256K, algES256} {
+		payload := map[string]interface{}{"sub": "login token", "iat": time.Now().Unix()}
+		token := testJWT(t, alg, payload)
+		parsed, err := parseJWT(token)
+		if err != nil {
+			t.Fatalf("%s: parseJWT: %v", alg, err)
+		}
+		if parsed.header["alg"] != alg || parsed.payload["sub"] != "login token" {
+			t.Errorf("%s: parsed header %v and payload %v", alg, parsed.header, parsed.payload)
+		}
+		if err := verifyJWTSignature(parsed, testPublicKey(t, alg)); err != nil {
+			t.Errorf("%s: verifyJWTSignature: %v", alg, err)
+		}
+		// Ethereum tooling drops the 0x04 prefix and adds 0x.
+		if err := verifyJWTSignature(parsed, "0x"+testPublicKey(t, alg)[2:]); err != nil {
+			t.Errorf("%s: verifyJWTSignature without prefix: %v", alg, err)
+		}
+		result := map[string]interface{}{"error": []string{}}
+		if !verifyJWT(nil, testPublicKey(t, alg), token, result) {
+			t.Errorf("%s: verifyJWT rejected a valid token: %v", alg, firstAPIError(result))
+		}
+	}
+}
+
+func TestVerifyJWTRejects(t *testing.T) {
+	useTestConfig()
+	token := testJWT(t, algES256K, map[string]interface{}{"sub": "login token"})
+	parts := strings.Split(token, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	other, _ := parsePrivateKey(algES256K, strings.Repeat("11", 32))
+	otherKey := hex.EncodeToString(elliptic.Marshal(other.Curve, other.X, other.Y))
+	otherPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"claim for EMAIL"}`))
+	tests := []struct {
+		name      string
+		token     string
+		publicKey string
+	}{
+		{"alg mismatch", withHeader(token, `{"alg":"ES256","typ":"JWT"}`), testPublicKey(t, algES256K)},
+		{"alg none", withHeader(token, `{"alg":"none","typ":"JWT"}`), testPublicKey(t, algES256K)},
+		{"alg HS256", withHeader(token, `{"alg":"HS256","typ":"JWT"}`), testPublicKey(t, algES256K)},
+		{"other curve key", withHeader(token, `{"alg":"ES256","typ":"JWT"}`), testPublicKey(t, algES256)},
+		{"other key", token, otherKey},
+		{"tampered payload", parts[0] + "." + otherPayload + "." + parts[2], testPublicKey(t, algES256K)},
+		{"short signature", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature[:63]), testPublicKey(t, algES256K)},
+		{"empty signature", parts[0] + "." + parts[1] + ".", testPublicKey(t, algES256K)},
+		{"signature not base64", parts[0] + "." + parts[1] + ".***", testPublicKey(t, algES256K)},
+		{"two segments", parts[0] + "." + parts[1], testPublicKey(t, algES256K)},
+		{"header not JSON", "bm90IGpzb24." + parts[1] + "." + parts[2], testPublicKey(t, algES256K)},
+		{"padded signature", token + "=", testPublicKey(t, algES256K)},
+		{"high S", parts[0] + "." + parts[1] + "." + highS(signature), testPublicKey(t, algES256K)},
+	}
+	for _, test := range tests {
+		result := map[string]interface{}{"error": []string{}}
+		if verifyJWT(nil, test.publicKey, test.token, result) {
+			t.Errorf("%s: verifyJWT accepted the token", test.name)
+		} else if firstAPIError(result) == nil {
+			t.Errorf("%s: verifyJWT recorded no error", test.name)
+		}
+	}
+}
+
+func TestValidateJWTClaims(t *testing.T) {
+	useTestConfig()
+	now := time.Now().Unix()
+	at := func(offset int64) json.Number {
+		return json.Number(strconv.FormatInt(now+offset, 10))
+	}
+	tests := []struct {
+		name       string
+		payload    map[string]interface{}
+		requireExp bool
+		valid      bool
+	}{
+		{"valid", map[string]interface{}{"exp": at(300), "nbf": at(0), "iat": at(0)}, true, true},
+		{"expired within leeway", map[string]interface{}{"exp": at(-30)}, true, true},
+		{"expired beyond leeway", map[string]interface{}{"exp": at(-120)}, true, false},
+		{"not valid yet within leeway", map[string]interface{}{"exp": at(300), "nbf": at(30)}, true, true},
+		{"not valid yet beyond leeway", map[string]interface{}{"exp": at(300), "nbf": at(120)}, true, false},
+		{"issued in the future", map[string]interface{}{"exp": at(300), "iat": at(120)}, true, false},
+		{"float exp", map[string]interface{}{"exp": float64(now + 300)}, true, true},
+		{"string exp", map[string]interface{}{"exp": "tomorrow"}, true, false},
+		{"missing exp required", map[string]interface{}{}, true, false},
+		{"missing exp optional", map[string]interface{}{}, false, true},
+	}
+	for _, test := range tests {
+		err := validateJWTClaims(test.payload, test.requireExp)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: accepted %v", test.name, test.payload)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// sealedPrefix marks a value encrypted by the keystore. The remainder is the
+// data key wrapped with the master key and the value sealed with the data
+// key, both base64 encoded and separated by a colon.
+const sealedPrefix = "enc:v1:"
+
+var errNoKeystore = errors.New("keystore.masterKeyFile not configured")
+
+// keystore envelope-encrypts values: every value gets a fresh AES-256 data
+// key, and only the data key is encrypted with the master key.
+type keystore struct {
+	master cipher.AEAD
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKeystore reads a 32 byte master key from path, either raw or hex
+// encoded.
+func loadKeystore(path string) (*keystore, error) {
+	if len(path) == 0 {
+		return nil, errNoKeystore
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := content
+	if trimmed := strings.TrimSpace(string(content)); len(trimmed) == 64 {
+		if decoded, err := hex.DecodeString(trimmed); err == nil {
+			key = decoded
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key in %s must be 32 bytes", path)
+	}
+	master, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &keystore{master: master}, nil
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// Seal encrypts value under a new data key.
+func (k *keystore) Seal(value string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.master, dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(data, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal.
+func (k *keystore) Open(value string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(value, sealedPrefix), ":")
+	if !isSealed(value) || len(parts) != 2 {
+		return "", errors.New("value is not sealed by the keystore")
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := open(k.master, wrapped)
+	if err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(data, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// runKeys encrypts or purges the private keys stored by earlier releases.
+func runKeys(args []string) {
+	if len(args) != 1 || (args[0] != "encrypt" && args[0] != "purge") {
+		log.Fatalln("usage: winter keys encrypt|purge")
+	}
+	var ks *keystore
+	if args[0] == "encrypt" {
+		path := ""
+		if Config().Keystore != nil {
+			path = Config().Keystore.MasterKeyFile
+		}
+		var err error
+		ks, err = loadKeystore(path)
+		if err != nil {
+			log.Fatalln("keystore error:", err.Error())
+		}
+	}
+
+	users := Storage().Users()
+	rows, err := users.ListPrivateKeys()
+	if err != nil {
+		log.Fatalln("keys error:", err.Error())
+	}
+	count := 0
+	for _, row := range rows {
+		value := ""
+		if ks != nil {
+			if isSealed(row.PrivateKey) {
+				continue
+			}
+			value, err = ks.Seal(row.PrivateKey)
+			if err != nil {
+				log.Fatalln("keys error:", err.Error())
+			}
+		}
+		if err := users.UpdatePrivateKey(row.ID, value, getNow()); err != nil {
+			log.Fatalln("keys error:", err.Error())
+		}
+		count++
+	}
+	if ks != nil {
+		log.Println("encrypted", count, "private keys")
+	} else {
+		log.Println("purged", count, "private keys")
+	}
+}
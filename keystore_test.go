@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKeystore writes master to a temporary file and loads it.
+func testKeystore(t *testing.T, master string) (*keystore, error) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master.key")
+	if err := ioutil.WriteFile(path, []byte(master), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return loadKeystore(path)
+}
+
+func TestLoadKeystore(t *testing.T) {
+	tests := []struct {
+		name   string
+		master string
+		valid  bool
+	}{
+		{"hex", hex.EncodeToString(bytes.Repeat([]byte{1}, 32)) + "\n", true},
+		{"raw", strings.Repeat("k", 32), true},
+		{"short", strings.Repeat("k", 16), false},
+		{"bad hex", strings.Repeat("z", 64), false},
+	}
+	for _, test := range tests {
+		if _, err := testKeystore(t, test.master); (err == nil) != test.valid {
+			t.Errorf("%s: err = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+	if _, err := loadKeystore(""); err != errNoKeystore {
+		t.Errorf("empty path: err = %v, want errNoKeystore", err)
+	}
+}
+
+func TestKeystoreSealOpen(t *testing.T) {
+	ks, err := testKeystore(t, strings.Repeat("a", 32))
+	if err != nil {
+		t.Fatalf("loadKeystore: %v", err)
+	}
+	first, err := ks.Seal(testPrivateKey)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	second, _ := ks.Seal(testPrivateKey)
+	if !isSealed(first) || first == second || strings.Contains(first, testPrivateKey) {
+		t.Errorf("Seal = %q and %q, want distinct sealed values", first, second)
+	}
+	if value, err := ks.Open(first); err != nil || value != testPrivateKey {
+		t.Errorf("Open = %q, %v", value, err)
+	}
+	parts := strings.Split(first, ":")
+	tampered := strings.Join(parts[:len(parts)-1], ":") + ":" + second[strings.LastIndex(second, ":")+1:]
+	if _, err := ks.Open(tampered); err == nil {
+		t.Errorf("Open accepted a value sealed under another data key")
+	}
+	if _, err := ks.Open(testPrivateKey); err == nil {
+		t.Errorf("Open accepted a plaintext value")
+	}
+	other, _ := testKeystore(t, strings.Repeat("b", 32))
+	if _, err := other.Open(first); err == nil {
+		t.Errorf("Open succeeded under another master key")
+	}
+}
+
+func TestCreateUserRejectsPrivateKey(t *testing.T) {
+	useTestConfig()
+	bs, _ := json.Marshal(map[string]string{
+		"name":       "name",
+		"phone":      "+886912345678",
+		"publicKey":  testPublicKey(t, algES256K),
+		"address":    testAttestantProxy,
+		"privateKey": testPrivateKey,
+	})
+	rw := httptest.NewRecorder()
+	createUser(rw, httptest.NewRequest("POST", "/api/v1/users/add", bytes.NewReader(bs)))
+	if rw.Code != 400 || strings.Contains(rw.Body.String(), testPrivateKey) {
+		t.Errorf("status = %d, body = %s, want 400 without the key", rw.Code, rw.Body.String())
+	}
+	if users, _ := Storage().Users().ListPrivateKeys(); len(users) != 0 {
+		t.Errorf("stored %d private keys", len(users))
+	}
+}
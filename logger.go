@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels accepted in LogConfig.Level.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// fields are the structured attributes of a log entry.
+type fields map[string]interface{}
+
+// redacted replaces the values of sensitive fields.
+const redacted = "[REDACTED]"
+
+// sensitiveKeys name fields, compared in lower case without separators,
+// whose values never reach the log: keys, tokens and signed requests, and
+// personal data.
+var sensitiveKeys = map[string]bool{
+	"authorization":    true,
+	"code":             true,
+	"codeverifier":     true,
+	"idnumber":         true,
+	"password":         true,
+	"phone":            true,
+	"prikey":           true,
+	"privatekey":       true,
+	"rawtxsigned":      true,
+	"secret":           true,
+	"serverprivatekey": true,
+	"token":            true,
+}
+
+var embeddedJWTPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// redactPrivateKeys masks private keys inside s: runs of exactly 64 hex
+// digits, with their 0x prefix when they have one. Longer runs such as
+// public keys are kept.
+func redactPrivateKeys(s string) string {
+	buf := bytes.Buffer{}
+	last := 0
+	for i := 0; i < len(s); {
+		if !isHexDigit(s[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && isHexDigit(s[j]) {
+			j++
+		}
+		if j-i == 64 {
+			start := i
+			if i >= 2 && s[i-2:i] == "0x" {
+				start = i - 2
+			}
+			buf.WriteString(s[last:start])
+			buf.WriteString(redacted)
+			last = j
+		}
+		i = j
+	}
+	if last == 0 {
+		return s
+	}
+	buf.WriteString(s[last:])
+	return buf.String()
+}
+
+// isSensitive reports whether the value of key must be redacted. "ID" is
+// the user's ID number in scopes and user records.
+func isSensitive(key string) bool {
+	if key == "ID" {
+		return true
+	}
+	name := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	return sensitiveKeys[name] || strings.HasSuffix(name, "jwt") || strings.HasSuffix(name, "token")
+}
+
+// redact returns value with sensitive fields replaced, and JWTs and
+// private keys masked inside strings.
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, int, int64, float64:
+		return v
+	case string:
+		return redactPrivateKeys(embeddedJWTPattern.ReplaceAllString(v, redacted))
+	case error:
+		return redact(v.Error())
+	case map[string]interface{}:
+		clean := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if isSensitive(key) {
+				clean[key] = redacted
+			} else {
+				clean[key] = redact(item)
+			}
+		}
+		return clean
+	case []interface{}:
+		clean := make([]interface{}, len(v))
+		for i, item := range v {
+			clean[i] = redact(item)
+		}
+		return clean
+	}
+	// Structs, typed maps and slices are redacted through their JSON form.
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	var generic interface{}
+	json.Unmarshal(encoded, &generic)
+	return redact(generic)
+}
+
+type logger struct {
+	lock  sync.Mutex
+	out   io.Writer
+	level int
+}
+
+var logs = &logger{out: os.Stderr, level: levelInfo}
+
+// configureLogger applies cfg, which may be nil for info logs to stderr,
+// and sends the output of the standard log package through the logger.
+func configureLogger(cfg *LogConfig) error {
+	level, out := levelInfo, io.Writer(os.Stderr)
+	if cfg != nil {
+		if len(cfg.Level) > 0 {
+			level = -1
+			for i, name := range levelNames {
+				if strings.EqualFold(cfg.Level, name) {
+					level = i
+				}
+			}
+			if level < 0 {
+				return fmt.Errorf("unknown log level: %s", cfg.Level)
+			}
+		}
+		switch cfg.Output {
+		case "", "stderr":
+		case "stdout":
+			out = os.Stdout
+		default:
+			f, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			out = f
+		}
+	}
+	logs.lock.Lock()
+	logs.out, logs.level = out, level
+	logs.lock.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdlogWriter{})
+	return nil
+}
+
+// stdlogWriter logs lines written through the standard log package at info
+// level.
+type stdlogWriter struct{}
+
+func (stdlogWriter) Write(p []byte) (int, error) {
+	logs.write(levelInfo, nil, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+func (l *logger) write(level int, r *http.Request, msg string, f fields) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if level < l.level {
+		return
+	}
+	entry := map[string]interface{}{}
+	for key, value := range f {
+		if isSensitive(key) {
+			entry[key] = redacted
+		} else {
+			entry[key] = redact(value)
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = levelNames[level]
+	entry["msg"] = redact(msg)
+	if id := requestID(r); len(id) > 0 {
+		entry["requestId"] = id
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"level": levelNames[level], "msg": msg, "logError": err.Error()})
+	}
+	l.out.Write(append(line, '\n'))
+}
+
+func logDebug(r *http.Request, msg string, f fields) { logs.write(levelDebug, r, msg, f) }
+func logInfo(r *http.Request, msg string, f fields)  { logs.write(levelInfo, r, msg, f) }
+func logWarn(r *http.Request, msg string, f fields)  { logs.write(levelWarn, r, msg, f) }
+func logError(r *http.Request, msg string, f fields) { logs.write(levelError, r, msg, f) }
+
+// logFatal logs msg at error level and exits.
+func logFatal(r *http.Request, msg string, f fields) {
+	logs.write(levelError, r, msg, f)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the ID assigned to r by withRequestID, if any.
+func requestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return contextRequestID(r.Context())
+}
+
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID assigns every request an ID, the X-Request-ID it was sent
+// with or a new one, which is returned in the X-Request-ID response header
+// and carried by its log entries and upstream calls. The request is logged
+// once it has been served.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = randomID(8)
+		}
+		rw.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		logInfo(r, "request", fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   recorder.status,
+			"duration": time.Since(start).Seconds(),
+		})
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestRedactPrivateKeys(t *testing.T) {
+	key := "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+	publicKey := "04" + key + key
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"bare", key, redacted},
+		{"prefixed", "0x" + key, redacted},
+		{"upper case", "0x" + "4C0883A69102937D6231471B5DBB6204FE5129617082792AE468D01A3F362318", redacted},
+		{"embedded", "privateKey=" + key + ";", "privateKey=" + redacted + ";"},
+		{"prefixed embedded", "key:0x" + key + " done", "key:" + redacted + " done"},
+		{"adjacent", key + "," + "0x" + key, redacted + "," + redacted},
+		{"longer run", publicKey, publicKey},
+		{"shorter run", key[:63], key[:63]},
+		{"address", "0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5", "0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5"},
+		{"no hex", "nothing to hide", "nothing to hide"},
+	}
+	for _, test := range tests {
+		if got := redact(test.in); got != test.want {
+			t.Errorf("%s: redact(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestRedactSensitiveFields(t *testing.T) {
+	got := redact(map[string]interface{}{
+		"privateKey": "secret",
+		"userJWT":    "eyJhbGciOiJFUzI1NksifQ.eyJzdWIiOiJ4In0.c2ln",
+		"proxy":      "0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5",
+	}).(map[string]interface{})
+	if got["privateKey"] != redacted || got["userJWT"] != redacted {
+		t.Errorf("sensitive fields were logged: %v", got)
+	}
+	if got["proxy"] != "0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5" {
+		t.Errorf("proxy = %v, want it unchanged", got["proxy"])
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in process and served at /metrics in the Prometheus text
+// exposition format. Label values must come from bounded sets: route
+// patterns, service names, known methods and configured claim types, never
+// user input.
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// metricVec is a counter or histogram family partitioned by label values.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*series
+}
+
+// series is one labelled counter or histogram.
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newCounterVec(name string, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, series: map[string]*series{}}
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: map[string]*series{}}
+}
+
+func (m *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &series{values: values, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// inc adds one to the counter labelled values.
+func (m *metricVec) inc(values ...string) {
+	m.lock.Lock()
+	m.get(values).value++
+	m.lock.Unlock()
+}
+
+// observe records v in the histogram labelled values.
+func (m *metricVec) observe(v float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.get(values)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func (m *metricVec) since(start time.Time, values ...string) {
+	m.observe(time.Since(start).Seconds(), values...)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	writeHeader(w, m.name, m.help, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind == "counter" {
+			writeSample(w, m.name, m.labels, s.values, s.value)
+			continue
+		}
+		labels := append(append([]string{}, m.labels...), "le")
+		for i, bound := range m.buckets {
+			writeSample(w, m.name+"_bucket", labels, append(append([]string{}, s.values...), formatFloat(bound)), float64(s.counts[i]))
+		}
+		writeSample(w, m.name+"_bucket", labels, append(append([]string{}, s.values...), "+Inf"), float64(s.count))
+		writeSample(w, m.name+"_sum", m.labels, s.values, s.value)
+		writeSample(w, m.name+"_count", m.labels, s.values, float64(s.count))
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelEscaper escapes label values as the text exposition format
+// expects; unlike Go quoting it leaves every other byte as it is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, labels []string, values []string, value float64) {
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	httpRequests = newCounterVec("winter_http_requests_total",
+		"HTTP requests by route pattern, method and status.", "route", "method", "status")
+	httpDuration = newHistogramVec("winter_http_request_duration_seconds",
+		"HTTP request latency by route pattern and status.", latencyBuckets, "route", "status")
+	upstreamRequests = newCounterVec("winter_upstream_requests_total",
+		"Upstream calls by APIConfig service and outcome.", "service", "outcome")
+	upstreamDuration = newHistogramVec("winter_upstream_request_duration_seconds",
+		"Upstream call latency, retries included, by APIConfig service.", latencyBuckets, "service")
+	dbDuration = newHistogramVec("winter_db_query_duration_seconds",
+		"Database statement latency by operation.", latencyBuckets, "operation")
+	dbErrors = newCounterVec("winter_db_query_errors_total",
+		"Failed database statements by operation.", "operation")
+)
+
+var metricFamilies = []*metricVec{httpRequests, httpDuration, upstreamRequests, upstreamDuration, dbDuration, dbErrors}
+
+// observeQuery records the latency and outcome of a database statement.
+func observeQuery(operation string, start time.Time, err error) {
+	dbDuration.since(start, operation)
+	if err != nil && err != errNotFound {
+		dbErrors.inc(operation)
+	}
+}
+
+// statusRecorder captures the status written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking is not supported")
+	}
+	return h.Hijack()
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentRoutes counts the requests served by mux under the pattern
+// they matched. The socket.io endpoint hijacks its connections and is
+// passed through.
+func instrumentRoutes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		nameSpan(r, route)
+		if route == "/api/v1/socket/" {
+			mux.ServeHTTP(rw, r)
+			return
+		} else if len(route) == 0 {
+			route = "unmatched"
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		mux.ServeHTTP(recorder, r)
+		status := strconv.Itoa(recorder.status)
+		httpRequests.inc(route, methodLabel(r.Method), status)
+		httpDuration.since(start, route, status)
+	})
+}
+
+// methodLabel returns method when it is a standard HTTP method and OTHER
+// otherwise.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "OTHER"
+}
+
+// claimTypeLabel returns claimType when a configured attestant may attest
+// it and OTHER otherwise, since users submit claims of any type.
+func claimTypeLabel(claimType string) string {
+	for _, attestant := range Config().Attestants {
+		if attestant != nil && attestant.attests(claimType) {
+			return claimType
+		}
+	}
+	return "OTHER"
+}
+
+// serveMetrics answers GET /metrics. When metrics.token is set scrapers
+// must send it as a bearer token.
+func serveMetrics(rw http.ResponseWriter, r *http.Request) {
+	if cfg := Config().Metrics; cfg != nil && len(cfg.Token) > 0 {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			http.Error(rw, "Invalid metrics token.", http.StatusUnauthorized)
+			return
+		}
+	}
+	buf := &bytes.Buffer{}
+	for _, family := range metricFamilies {
+		family.write(buf)
+	}
+	writeHeader(buf, "winter_websocket_pending_waits", "Websocket clients and long polls waiting on a token.", "gauge")
+	writeSample(buf, "winter_websocket_pending_waits", nil, nil, float64(hub.pending()))
+	counts, err := Storage().Claims().Counts()
+	if err != nil {
+		logError(r, "metrics: count claims error", fields{"error": err})
+	} else {
+		writeHeader(buf, "winter_claims", "Claims by status and type.", "gauge")
+		keys := [][2]string{}
+		totals := map[[2]string]int{}
+		for _, count := range counts {
+			key := [2]string{count.Status, claimTypeLabel(count.Type)}
+			if _, ok := totals[key]; !ok {
+				keys = append(keys, key)
+			}
+			totals[key] += count.Total
+		}
+		for _, key := range keys {
+			writeSample(buf, "winter_claims", []string{"status", "type"}, key[:], float64(totals[key]))
+		}
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.Write(buf.Bytes())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricLabelsAreBounded(t *testing.T) {
+	useTestConfig()
+	Config().Attestants = []*AttestantConfig{{Name: "idhub", Types: []string{"EMAIL"}}}
+	for _, claimType := range []string{"EMAIL", "MY_TYPE_1", "MY_TYPE_2"} {
+		Storage().Claims().Create(&Claim{Proxy: testUserProxy, Type: claimType, Status: string(ClaimPending)}, nil)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(rw http.ResponseWriter, r *http.Request) {})
+	instrumentRoutes(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/ping", nil))
+
+	rw := httptest.NewRecorder()
+	serveMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	body := rw.Body.String()
+	for _, want := range []string{
+		`winter_http_requests_total{route="/ping",method="OTHER",status="200"} 1`,
+		`winter_claims{status="PENDING",type="EMAIL"} 1`,
+		`winter_claims{status="PENDING",type="OTHER"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	for _, unwanted := range []string{"BREW", "MY_TYPE"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("metrics contain the label value %s", unwanted)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego/orm"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// dialectSQL holds the statements of a migration for each database driver.
+type dialectSQL map[string][]string
+
+type migration struct {
+	version int
+	name    string
+	up      dialectSQL
+	down    dialectSQL
+}
+
+func (m migration) checksum(driver string) string {
+	sum := sha256.Sum256([]byte(strings.Join(m.up[driver], ";\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+type migrationStatus struct {
+	Version  int
+	Name     string
+	Applied  string
+	Checksum string
+	Mismatch bool
+}
+
+type migrator struct {
+	s *sqlStore
+}
+
+func newMigrator(store Store) (*migrator, error) {
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return nil, errors.New("migrations require a mysql or sqlite3 database")
+	}
+	return &migrator{s: s}, nil
+}
+
+func (m *migrator) prepare() error {
+	statements := []string{}
+	if m.s.driver == driverMySQL {
+		statements = append(statements, "CREATE DATABASE IF NOT EXISTS vchain"+
+			" DEFAULT CHARACTER SET utf8 DEFAULT COLLATE utf8_general_ci")
+	}
+	statements = append(statements, "CREATE TABLE IF NOT EXISTS "+
+		m.s.table("schema_migrations")+" (version INTEGER NOT NULL PRIMARY KEY,"+
+		" name VARCHAR(100) NOT NULL, checksum CHAR(64) NOT NULL,"+
+		" applied VARCHAR(20) NOT NULL)")
+	for _, statement := range statements {
+		if _, err := m.s.exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *migrator) applied() (map[int]migrationStatus, error) {
+	if err := m.prepare(); err != nil {
+		return nil, err
+	}
+	sql := "SELECT version, name, checksum, applied FROM " + m.s.table("schema_migrations")
+	rows, err := m.s.query(sql)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]migrationStatus{}
+	for _, row := range rows {
+		version, _ := strconv.Atoi(rowString(row, "version"))
+		applied[version] = migrationStatus{
+			Version:  version,
+			Name:     rowString(row, "name"),
+			Applied:  rowString(row, "applied"),
+			Checksum: rowString(row, "checksum"),
+		}
+	}
+	return applied, nil
+}
+
+// Status reports every known migration and whether, and how, it was applied.
+func (m *migrator) Status() ([]migrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []migrationStatus{}
+	for _, item := range migrations {
+		status := migrationStatus{
+			Version: item.version,
+			Name:    item.name,
+		}
+		if record, ok := applied[item.version]; ok {
+			status.Applied = record.Applied
+			status.Checksum = record.Checksum
+			status.Mismatch = record.Checksum != item.checksum(m.s.driver)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// run executes the statements of migration version, then record, which
+// updates schema_migrations. SQLite runs them in one transaction, so a
+// failed migration leaves neither schema changes nor a version row behind;
+// MySQL commits every DDL statement implicitly and runs them one by one.
+func (m *migrator) run(version int, statements []string, record string, args ...interface{}) error {
+	apply := func(o orm.Ormer) error {
+		for _, statement := range statements {
+			if _, err := updateWith(o, statement); err != nil {
+				return fmt.Errorf("migration %04d: %v", version, err)
+			}
+		}
+		_, err := updateWith(o, record, args...)
+		return err
+	}
+	if m.s.driver == driverMySQL {
+		return apply(m.s.orm())
+	}
+	return m.s.transaction(apply)
+}
+
+// Up applies every pending migration in order and returns how many ran. It
+// refuses to run when an applied migration no longer matches its checksum.
+func (m *migrator) Up() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, item := range migrations {
+		if record, ok := applied[item.version]; ok {
+			if record.Checksum != item.checksum(m.s.driver) {
+				return count, fmt.Errorf("migration %04d checksum mismatch", item.version)
+			}
+			continue
+		}
+		sql := "INSERT INTO " + m.s.table("schema_migrations")
+		sql += "(version, name, checksum, applied) VALUES(?, ?, ?, ?)"
+		err := m.run(item.version, item.up[m.s.driver], sql, item.version, item.name,
+			item.checksum(m.s.driver), getNow())
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Down rolls back the latest steps applied migrations and returns how many
+// were reverted.
+func (m *migrator) Down(steps int) (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		item := migrations[i]
+		if _, ok := applied[item.version]; !ok {
+			continue
+		}
+		sql := "DELETE FROM " + m.s.table("schema_migrations") + " WHERE version = ?"
+		if err := m.run(item.version, item.down[m.s.driver], sql, item.version); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		log.Fatalln("usage: winter migrate up|down [steps]|status")
+	}
+	m, err := newMigrator(Storage())
+	if err != nil {
+		log.Fatalln("migrate error:", err.Error())
+	}
+	switch args[0] {
+	case "up":
+		count, err := m.Up()
+		if err != nil {
+			log.Fatalln("migrate up error:", err.Error())
+		}
+		log.Println("applied", count, "migrations")
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalln("invalid number of steps:", args[1])
+			}
+		}
+		count, err := m.Down(steps)
+		if err != nil {
+			log.Fatalln("migrate down error:", err.Error())
+		}
+		log.Println("reverted", count, "migrations")
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			log.Fatalln("migrate status error:", err.Error())
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if len(status.Applied) > 0 {
+				state = "applied " + status.Applied
+			}
+			if status.Mismatch {
+				state += " (checksum mismatch)"
+			}
+			fmt.Fprintf(os.Stdout, "%04d  %-50s  %s\n", status.Version, status.Name, state)
+		}
+	default:
+		log.Fatalln("unknown migrate command:", args[0])
+	}
+}
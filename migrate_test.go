@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var (
+	sqliteOnce  sync.Once
+	sqliteDir   string
+	sqliteStore Store
+	sqliteErr   error
+)
+
+// testSQLiteStore returns a SQLite store in a temporary file without any
+// migration applied. The ORM registers its database once per process, so
+// every test shares the same file.
+func testSQLiteStore(t *testing.T) *migrator {
+	sqliteOnce.Do(func() {
+		sqliteDir, sqliteErr = ioutil.TempDir("", "winter")
+		if sqliteErr != nil {
+			return
+		}
+		path := filepath.Join(sqliteDir, "winter.sqlite")
+		sqliteStore, sqliteErr = openStore(&DBConfig{Driver: driverSQLite, Address: path, Idle: 1, Max: 1})
+	})
+	if sqliteErr != nil {
+		t.Fatalf("openStore: %v", sqliteErr)
+	}
+	m, err := newMigrator(sqliteStore)
+	if err != nil {
+		t.Fatalf("newMigrator: %v", err)
+	}
+	if _, err := m.Down(len(migrations)); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	return m
+}
+
+// tableExists reports whether the SQLite table name exists.
+func tableExists(t *testing.T, m *migrator, name string) bool {
+	rows, err := m.s.query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", name)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	return len(rows) > 0
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	m := testSQLiteStore(t)
+	if count, err := m.Up(); err != nil || count != len(migrations) {
+		t.Fatalf("Up = %d, %v, want %d", count, err, len(migrations))
+	}
+	if count, err := m.Up(); err != nil || count != 0 {
+		t.Errorf("second Up = %d, %v, want 0", count, err)
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	for _, status := range statuses {
+		if len(status.Applied) == 0 || status.Mismatch {
+			t.Errorf("migration %04d: applied %q, mismatch %v", status.Version, status.Applied, status.Mismatch)
+		}
+	}
+	if !tableExists(t, m, "claim_events") {
+		t.Errorf("claim_events missing after Up")
+	}
+	if count, err := m.Down(len(migrations)); err != nil || count != len(migrations) {
+		t.Fatalf("Down = %d, %v, want %d", count, err, len(migrations))
+	}
+	for _, name := range []string{"users", "claims", "claim_events", "attestations"} {
+		if tableExists(t, m, name) {
+			t.Errorf("%s left after Down", name)
+		}
+	}
+	if count, err := m.Up(); err != nil || count != len(migrations) {
+		t.Errorf("Up after Down = %d, %v, want %d", count, err, len(migrations))
+	}
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	m := testSQLiteStore(t)
+	defer func(saved []migration) { migrations = saved }(migrations)
+	broken := migration{
+		version: len(migrations) + 1,
+		name:    "broken",
+		up: dialectSQL{driverSQLite: {
+			"CREATE TABLE half_applied (id INTEGER)",
+			"CREATE TABLE missing_paren (id INTEGER",
+		}},
+	}
+	migrations = append(append([]migration{}, migrations...), broken)
+	if count, err := m.Up(); err == nil || count != len(migrations)-1 {
+		t.Fatalf("Up = %d, %v, want %d and an error", count, err, len(migrations)-1)
+	}
+	if tableExists(t, m, "half_applied") {
+		t.Errorf("statements of the failed migration were kept")
+	}
+	applied, err := m.applied()
+	if err != nil {
+		t.Fatalf("applied: %v", err)
+	}
+	if _, ok := applied[broken.version]; ok {
+		t.Errorf("failed migration recorded as applied")
+	}
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if sqliteStore != nil {
+		sqliteStore.Close()
+		os.RemoveAll(sqliteDir)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,461 @@
+package main
+
+// migrations lists every schema change in the order it is applied. Applied
+// migrations are checksummed, so never edit one that has shipped: add a new
+// migration instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users, tokens, claims and attestations",
+		up: dialectSQL{
+			driverMySQL: {
+				`CREATE TABLE IF NOT EXISTS vchain.users (
+  id int(10) NOT NULL AUTO_INCREMENT,
+  name varchar(128) CHARACTER SET utf8 NOT NULL,
+  idnumber varchar(20) DEFAULT NULL,
+  phone varchar(16) NOT NULL,
+  email varchar(255) DEFAULT NULL,
+  privatekey varchar(120) DEFAULT NULL,
+  publickey varchar(150) NOT NULL,
+  address varchar(70) NOT NULL,
+  proxy varchar(50) NOT NULL,
+  controller varchar(50) DEFAULT NULL,
+  recovery varchar(50) DEFAULT NULL,
+  ipfs varchar(60) DEFAULT NULL,
+  description varchar(300) DEFAULT NULL,
+  created datetime NOT NULL,
+  updated datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+				`CREATE TABLE IF NOT EXISTS vchain.tokens (
+  token varchar(40) NOT NULL,
+  valid tinyint(1) UNSIGNED DEFAULT NULL,
+  proxy varchar(50) NOT NULL,
+  scope varchar(100) DEFAULT NULL,
+  created datetime NOT NULL,
+  PRIMARY KEY (token)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+				`CREATE TABLE IF NOT EXISTS vchain.claims (
+  id int(10) NOT NULL AUTO_INCREMENT,
+  proxy varchar(50) NOT NULL,
+  type varchar(30) DEFAULT NULL,
+  status varchar(15) NOT NULL,
+  claim text DEFAULT NULL,
+  created datetime NOT NULL,
+  updated datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+				`CREATE TABLE IF NOT EXISTS vchain.attestations (
+  id int(10) NOT NULL AUTO_INCREMENT,
+  claimid int(10) NOT NULL,
+  attestant varchar(30) DEFAULT NULL,
+  attestation text NOT NULL,
+  status varchar(15) NOT NULL,
+  created datetime NOT NULL,
+  updated datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+			},
+			driverSQLite: {
+				`CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  idnumber TEXT DEFAULT NULL,
+  phone TEXT NOT NULL,
+  email TEXT DEFAULT NULL,
+  privatekey TEXT DEFAULT NULL,
+  publickey TEXT NOT NULL,
+  address TEXT NOT NULL,
+  proxy TEXT NOT NULL,
+  controller TEXT DEFAULT NULL,
+  recovery TEXT DEFAULT NULL,
+  ipfs TEXT DEFAULT NULL,
+  description TEXT DEFAULT NULL,
+  created TEXT NOT NULL,
+  updated TEXT DEFAULT NULL
+)`,
+				`CREATE TABLE IF NOT EXISTS tokens (
+  token TEXT NOT NULL PRIMARY KEY,
+  valid INTEGER DEFAULT NULL,
+  proxy TEXT NOT NULL,
+  scope TEXT DEFAULT NULL,
+  created TEXT NOT NULL
+)`,
+				`CREATE TABLE IF NOT EXISTS claims (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  proxy TEXT NOT NULL,
+  type TEXT DEFAULT NULL,
+  status TEXT NOT NULL,
+  claim TEXT DEFAULT NULL,
+  created TEXT NOT NULL,
+  updated TEXT DEFAULT NULL
+)`,
+				`CREATE TABLE IF NOT EXISTS attestations (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  claimid INTEGER NOT NULL,
+  attestant TEXT DEFAULT NULL,
+  attestation TEXT NOT NULL,
+  status TEXT NOT NULL,
+  created TEXT NOT NULL,
+  updated TEXT DEFAULT NULL
+)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP TABLE IF EXISTS vchain.attestations`,
+				`DROP TABLE IF EXISTS vchain.claims`,
+				`DROP TABLE IF EXISTS vchain.tokens`,
+				`DROP TABLE IF EXISTS vchain.users`,
+			},
+			driverSQLite: {
+				`DROP TABLE IF EXISTS attestations`,
+				`DROP TABLE IF EXISTS claims`,
+				`DROP TABLE IF EXISTS tokens`,
+				`DROP TABLE IF EXISTS users`,
+			},
+		},
+	},
+	{
+		version: 2,
+		name:    "index tokens, claims and attestations lookups",
+		up: dialectSQL{
+			driverMySQL: {
+				`CREATE INDEX idx_tokens_proxy ON vchain.tokens (proxy)`,
+				`CREATE INDEX idx_claims_proxy_type_status ON vchain.claims (proxy, type, status)`,
+				`CREATE INDEX idx_attestations_claimid ON vchain.attestations (claimid)`,
+			},
+			driverSQLite: {
+				`CREATE INDEX IF NOT EXISTS idx_tokens_proxy ON tokens (proxy)`,
+				`CREATE INDEX IF NOT EXISTS idx_claims_proxy_type_status ON claims (proxy, type, status)`,
+				`CREATE INDEX IF NOT EXISTS idx_attestations_claimid ON attestations (claimid)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP INDEX idx_attestations_claimid ON vchain.attestations`,
+				`DROP INDEX idx_claims_proxy_type_status ON vchain.claims`,
+				`DROP INDEX idx_tokens_proxy ON vchain.tokens`,
+			},
+			driverSQLite: {
+				`DROP INDEX IF EXISTS idx_attestations_claimid`,
+				`DROP INDEX IF EXISTS idx_claims_proxy_type_status`,
+				`DROP INDEX IF EXISTS idx_tokens_proxy`,
+			},
+		},
+	},
+	{
+		version: 3,
+		name:    "create claim_events",
+		up: dialectSQL{
+			driverMySQL: {
+				`CREATE TABLE vchain.claim_events (
+  id int(10) NOT NULL AUTO_INCREMENT,
+  claimid int(10) NOT NULL,
+  fromstatus varchar(15) DEFAULT NULL,
+  tostatus varchar(15) NOT NULL,
+  actor varchar(70) DEFAULT NULL,
+  created datetime NOT NULL,
+  PRIMARY KEY (id),
+  KEY idx_claim_events_claimid (claimid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+			},
+			driverSQLite: {
+				`CREATE TABLE claim_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  claimid INTEGER NOT NULL,
+  fromstatus TEXT DEFAULT NULL,
+  tostatus TEXT NOT NULL,
+  actor TEXT DEFAULT NULL,
+  created TEXT NOT NULL
+)`,
+				`CREATE INDEX idx_claim_events_claimid ON claim_events (claimid)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP TABLE IF EXISTS vchain.claim_events`,
+			},
+			driverSQLite: {
+				`DROP TABLE IF EXISTS claim_events`,
+			},
+		},
+	},
+	{
+		version: 4,
+		name:    "track attestation revocation",
+		up: dialectSQL{
+			driverMySQL: {
+				`ALTER TABLE vchain.attestations
+  ADD COLUMN reason varchar(255) DEFAULT NULL AFTER status,
+  ADD COLUMN revoked datetime DEFAULT NULL AFTER reason`,
+				`UPDATE vchain.attestations SET status = 'ACTIVE' WHERE status = 'APPROVED'`,
+				`CREATE INDEX idx_attestations_status ON vchain.attestations (status)`,
+			},
+			driverSQLite: {
+				`ALTER TABLE attestations ADD COLUMN reason TEXT DEFAULT NULL`,
+				`ALTER TABLE attestations ADD COLUMN revoked TEXT DEFAULT NULL`,
+				`UPDATE attestations SET status = 'ACTIVE' WHERE status = 'APPROVED'`,
+				`CREATE INDEX idx_attestations_status ON attestations (status)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP INDEX idx_attestations_status ON vchain.attestations`,
+				`UPDATE vchain.attestations SET status = 'APPROVED' WHERE status = 'ACTIVE'`,
+				`ALTER TABLE vchain.attestations DROP COLUMN revoked, DROP COLUMN reason`,
+			},
+			driverSQLite: {
+				`DROP INDEX IF EXISTS idx_attestations_status`,
+				`UPDATE attestations SET status = 'APPROVED' WHERE status = 'ACTIVE'`,
+				`ALTER TABLE attestations DROP COLUMN revoked`,
+				`ALTER TABLE attestations DROP COLUMN reason`,
+			},
+		},
+	},
+	{
+		version: 5,
+		name:    "widen users.privatekey for sealed keys",
+		up: dialectSQL{
+			driverMySQL: {
+				`ALTER TABLE vchain.users MODIFY privatekey varchar(512) DEFAULT NULL`,
+			},
+			// SQLite TEXT columns are unbounded.
+			driverSQLite: {},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`ALTER TABLE vchain.users MODIFY privatekey varchar(120) DEFAULT NULL`,
+			},
+			driverSQLite: {},
+		},
+	},
+	{
+		version: 6,
+		name:    "track token issuance and accepted JWTs",
+		up: dialectSQL{
+			driverMySQL: {
+				`ALTER TABLE vchain.tokens
+  ADD COLUMN type varchar(20) DEFAULT NULL AFTER token,
+  ADD COLUMN client varchar(128) DEFAULT NULL AFTER scope,
+  ADD COLUMN expires datetime DEFAULT NULL AFTER client,
+  ADD COLUMN consumed datetime DEFAULT NULL AFTER expires`,
+				`UPDATE vchain.tokens SET consumed = created`,
+				`CREATE TABLE vchain.jwt_replays (
+  jti varchar(64) NOT NULL,
+  expires datetime NOT NULL,
+  PRIMARY KEY (jti),
+  KEY idx_jwt_replays_expires (expires)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+			},
+			driverSQLite: {
+				`ALTER TABLE tokens ADD COLUMN type TEXT DEFAULT NULL`,
+				`ALTER TABLE tokens ADD COLUMN client TEXT DEFAULT NULL`,
+				`ALTER TABLE tokens ADD COLUMN expires TEXT DEFAULT NULL`,
+				`ALTER TABLE tokens ADD COLUMN consumed TEXT DEFAULT NULL`,
+				`UPDATE tokens SET consumed = created`,
+				`CREATE TABLE jwt_replays (
+  jti TEXT NOT NULL PRIMARY KEY,
+  expires TEXT NOT NULL
+)`,
+				`CREATE INDEX idx_jwt_replays_expires ON jwt_replays (expires)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP TABLE IF EXISTS vchain.jwt_replays`,
+				`ALTER TABLE vchain.tokens DROP COLUMN consumed, DROP COLUMN expires,
+  DROP COLUMN client, DROP COLUMN type`,
+			},
+			driverSQLite: {
+				`DROP TABLE IF EXISTS jwt_replays`,
+				`ALTER TABLE tokens DROP COLUMN consumed`,
+				`ALTER TABLE tokens DROP COLUMN expires`,
+				`ALTER TABLE tokens DROP COLUMN client`,
+				`ALTER TABLE tokens DROP COLUMN type`,
+			},
+		},
+	},
+	{
+		version: 7,
+		name:    "create clients",
+		up: dialectSQL{
+			driverMySQL: {
+				`CREATE TABLE vchain.clients (
+  id int(10) NOT NULL AUTO_INCREMENT,
+  name varchar(128) NOT NULL,
+  publickeys text NOT NULL,
+  scopes text NOT NULL,
+  redirecturls text NOT NULL,
+  status varchar(15) NOT NULL,
+  created datetime NOT NULL,
+  updated datetime DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY idx_clients_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+			},
+			driverSQLite: {
+				`CREATE TABLE clients (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  publickeys TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  redirecturls TEXT NOT NULL,
+  status TEXT NOT NULL,
+  created TEXT NOT NULL,
+  updated TEXT DEFAULT NULL
+)`,
+				`CREATE UNIQUE INDEX idx_clients_name ON clients (name)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP TABLE IF EXISTS vchain.clients`,
+			},
+			driverSQLite: {
+				`DROP TABLE IF EXISTS clients`,
+			},
+		},
+	},
+	{
+		version: 8,
+		name:    "create consents",
+		up: dialectSQL{
+			driverMySQL: {
+				`CREATE TABLE vchain.consents (
+  id int(10) NOT NULL AUTO_INCREMENT,
+  proxy varchar(50) NOT NULL,
+  requester varchar(128) NOT NULL,
+  scope varchar(100) NOT NULL,
+  evidence text NOT NULL,
+  status varchar(15) NOT NULL,
+  created datetime NOT NULL,
+  revoked datetime DEFAULT NULL,
+  PRIMARY KEY (id),
+  KEY idx_consents_proxy (proxy, requester)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+			},
+			driverSQLite: {
+				`CREATE TABLE consents (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  proxy TEXT NOT NULL,
+  requester TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  evidence TEXT NOT NULL,
+  status TEXT NOT NULL,
+  created TEXT NOT NULL,
+  revoked TEXT DEFAULT NULL
+)`,
+				`CREATE INDEX idx_consents_proxy ON consents (proxy, requester)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP TABLE IF EXISTS vchain.consents`,
+			},
+			driverSQLite: {
+				`DROP TABLE IF EXISTS consents`,
+			},
+		},
+	},
+	{
+		version: 9,
+		name:    "create oidc_requests",
+		up: dialectSQL{
+			driverMySQL: {
+				`CREATE TABLE vchain.oidc_requests (
+  token varchar(40) NOT NULL,
+  client varchar(128) NOT NULL,
+  redirecturi varchar(512) NOT NULL,
+  scope varchar(100) NOT NULL,
+  state varchar(255) NOT NULL,
+  nonce varchar(255) NOT NULL,
+  challenge varchar(128) NOT NULL,
+  code varchar(64) DEFAULT NULL,
+  proxy varchar(50) DEFAULT NULL,
+  expires datetime NOT NULL,
+  created datetime NOT NULL,
+  redeemed datetime DEFAULT NULL,
+  PRIMARY KEY (token),
+  UNIQUE KEY idx_oidc_requests_code (code)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+			},
+			driverSQLite: {
+				`CREATE TABLE oidc_requests (
+  token TEXT NOT NULL PRIMARY KEY,
+  client TEXT NOT NULL,
+  redirecturi TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  state TEXT NOT NULL,
+  nonce TEXT NOT NULL,
+  challenge TEXT NOT NULL,
+  code TEXT DEFAULT NULL,
+  proxy TEXT DEFAULT NULL,
+  expires TEXT NOT NULL,
+  created TEXT NOT NULL,
+  redeemed TEXT DEFAULT NULL
+)`,
+				`CREATE UNIQUE INDEX idx_oidc_requests_code ON oidc_requests (code)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP TABLE IF EXISTS vchain.oidc_requests`,
+			},
+			driverSQLite: {
+				`DROP TABLE IF EXISTS oidc_requests`,
+			},
+		},
+	},
+	{
+		version: 10,
+		name:    "track key rotation and account recovery",
+		up: dialectSQL{
+			driverMySQL: {
+				`ALTER TABLE vchain.users
+  ADD COLUMN guardians text DEFAULT NULL AFTER description,
+  ADD COLUMN rotated datetime DEFAULT NULL AFTER guardians`,
+				`CREATE TABLE vchain.recoveries (
+  id int(10) NOT NULL AUTO_INCREMENT,
+  proxy varchar(50) NOT NULL,
+  publickey varchar(150) NOT NULL,
+  address varchar(70) NOT NULL,
+  approvals text NOT NULL,
+  status varchar(15) NOT NULL,
+  executable datetime DEFAULT NULL,
+  created datetime NOT NULL,
+  updated datetime DEFAULT NULL,
+  PRIMARY KEY (id),
+  KEY idx_recoveries_proxy_status (proxy, status)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci`,
+			},
+			driverSQLite: {
+				`ALTER TABLE users ADD COLUMN guardians TEXT DEFAULT NULL`,
+				`ALTER TABLE users ADD COLUMN rotated TEXT DEFAULT NULL`,
+				`CREATE TABLE recoveries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  proxy TEXT NOT NULL,
+  publickey TEXT NOT NULL,
+  address TEXT NOT NULL,
+  approvals TEXT NOT NULL,
+  status TEXT NOT NULL,
+  executable TEXT DEFAULT NULL,
+  created TEXT NOT NULL,
+  updated TEXT DEFAULT NULL
+)`,
+				`CREATE INDEX idx_recoveries_proxy_status ON recoveries (proxy, status)`,
+			},
+		},
+		down: dialectSQL{
+			driverMySQL: {
+				`DROP TABLE IF EXISTS vchain.recoveries`,
+				`ALTER TABLE vchain.users DROP COLUMN rotated, DROP COLUMN guardians`,
+			},
+			driverSQLite: {
+				`DROP TABLE IF EXISTS recoveries`,
+				`ALTER TABLE users DROP COLUMN rotated`,
+				`ALTER TABLE users DROP COLUMN guardians`,
+			},
+		},
+	},
+}
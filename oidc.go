@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpenID Connect facade over the login flow. /oauth/authorize issues a
+// login token whose server JWT the mobile app signs as usual; once it has
+// been validated at /api/v1/login/jwt, /oauth/authorize/wait redirects back
+// with a code that /oauth/token exchanges for an ID token and an access
+// token accepted by /oauth/userinfo.
+
+const (
+	oidcScope      = "openid"
+	oidcCodeTTL    = 60
+	oidcAccessType = "access"
+)
+
+var challengePattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="1;url={{.Wait}}">
+<title>Sign in to {{.Client}}</title>
+</head>
+<body>
+<p>Sign this login request with the mobile app to continue to {{.Client}}.</p>
+<pre id="jwt">{{.JWT}}</pre>
+</body>
+</html>
+`))
+
+// oauthError is the error response of RFC 6749.
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// checkOIDCConfig refuses to enable OpenID Connect unless the server signs
+// with ES256: relying parties do not support ES256K.
+func checkOIDCConfig() error {
+	if Config().OIDC != nil && jwtAlgorithm() != algES256 {
+		return fmt.Errorf("oidc requires jwt.algorithm %s, not %s", algES256, jwtAlgorithm())
+	}
+	return nil
+}
+
+func oidcIssuer() string {
+	return strings.TrimRight(Config().OIDC.Issuer, "/")
+}
+
+func accessTokenTTL() int64 {
+	if ttl := Config().OIDC.AccessTokenTTL; ttl > 0 {
+		return int64(ttl)
+	}
+	return 3600
+}
+
+func randomCode() string {
+	bs := make([]byte, 32)
+	rand.Read(bs)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// pkceChallenge is the S256 code challenge of verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func oauthFailure(rw http.ResponseWriter, status int, code string, description string) {
+	rw.Header().Set("Cache-Control", "no-store")
+	renderJSON(rw, status, oauthError{Error: code, Description: description})
+}
+
+// redirectWith sends the user agent back to the client with params.
+func redirectWith(rw http.ResponseWriter, req *http.Request, redirect string, params url.Values) {
+	u, _ := url.Parse(redirect)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(rw, req, u.String(), http.StatusFound)
+}
+
+// oidcFailure logs err, which may reveal internals, and returns the fixed
+// description sent to the client instead.
+func oidcFailure(req *http.Request, msg string, err error) string {
+	logError(req, msg, fields{"error": err})
+	return "The server is temporarily unable to handle the request."
+}
+
+func redirectError(rw http.ResponseWriter, req *http.Request, redirect string, state string, code string, description string) {
+	params := url.Values{"error": {code}, "error_description": {description}}
+	if len(state) > 0 {
+		params.Set("state", state)
+	}
+	redirectWith(rw, req, redirect, params)
+}
+
+// oidcDiscovery serves /.well-known/openid-configuration.
+func oidcDiscovery(rw http.ResponseWriter, req *http.Request) {
+	issuer := oidcIssuer()
+	scopes := []string{oidcScope}
+	for name := range userScopes {
+		scopes = append(scopes, name)
+	}
+	sort.Strings(scopes[1:])
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	renderJSON(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"jwks_uri":                              issuer + "/oauth/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{algES256},
+		"scopes_supported":                      scopes,
+		"claims_supported":                      append([]string{"sub"}, scopes[1:]...),
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"none"},
+	})
+}
+
+// serverJWK returns JWTConfig.ServerPublicKey, a P-256 key once
+// checkOIDCConfig has passed, as a JSON Web Key.
+func serverJWK() (map[string]string, error) {
+	pub, err := parsePublicKey(algES256, Config().JWT.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	crv := "P-256"
+	x := coordinate(pub.X)
+	y := coordinate(pub.Y)
+	// The key ID is the RFC 7638 thumbprint of the key.
+	thumbprint := `{"crv":"` + crv + `","kty":"EC","x":"` + x + `","y":"` + y + `"}`
+	sum := sha256.Sum256([]byte(thumbprint))
+	return map[string]string{
+		"kty": "EC",
+		"crv": crv,
+		"x":   x,
+		"y":   y,
+		"use": "sig",
+		"alg": algES256,
+		"kid": base64.RawURLEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+func coordinate(n *big.Int) string {
+	bs := make([]byte, 32)
+	b := n.Bytes()
+	copy(bs[32-len(b):], b)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// oidcJWKS serves the server signing key at /oauth/jwks.
+func oidcJWKS(rw http.ResponseWriter, req *http.Request) {
+	key, err := serverJWK()
+	if err != nil {
+		logError(req, "server signing key unavailable", fields{"error": err})
+		oauthFailure(rw, http.StatusInternalServerError, "server_error", "The signing key is unavailable.")
+		return
+	}
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	renderJSON(rw, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{key},
+	})
+}
+
+// oidcScopes parses the space separated OIDC scope parameter, which must
+// include openid, into the scope of the login token.
+func oidcScopes(value string) (Scope, string) {
+	hasOpenID := false
+	items := []string{}
+	for _, item := range strings.Fields(value) {
+		if item == oidcScope {
+			hasOpenID = true
+		} else {
+			items = append(items, item)
+		}
+	}
+	if !hasOpenID {
+		return nil, "scope must include openid."
+	}
+	scope, err := parseScope(strings.Join(items, " "))
+	if err != nil {
+		return nil, "scope contains an unknown or malformed item."
+	}
+	return scope, ""
+}
+
+// oidcAuthorize starts an authorization code flow at /oauth/authorize. The
+// login request is rendered as a page that waits for the mobile app, or as
+// JSON when the client asks for it.
+func oidcAuthorize(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	client, err := Storage().Clients().Find(query.Get("client_id"))
+	if err == errNotFound {
+		http.Error(rw, "Unknown client_id.", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(rw, oidcFailure(req, "client lookup failed", err), http.StatusServiceUnavailable)
+		return
+	}
+	redirect := query.Get("redirect_uri")
+	registered := false
+	for _, item := range client.RedirectURLs {
+		registered = registered || item == redirect
+	}
+	if !registered {
+		http.Error(rw, "redirect_uri is not registered for this client.", http.StatusBadRequest)
+		return
+	}
+
+	state := query.Get("state")
+	scope, problem := oidcScopes(query.Get("scope"))
+	if client.Status != clientActive {
+		redirectError(rw, req, redirect, state, "unauthorized_client", "Client "+client.Name+" is suspended.")
+	} else if query.Get("response_type") != "code" {
+		redirectError(rw, req, redirect, state, "unsupported_response_type", "Only the code response type is supported.")
+	} else if query.Get("code_challenge_method") != "S256" || !challengePattern.MatchString(query.Get("code_challenge")) {
+		redirectError(rw, req, redirect, state, "invalid_request", "A S256 code_challenge is required.")
+	} else if len(state) > 255 || len(query.Get("nonce")) > 255 {
+		redirectError(rw, req, redirect, state, "invalid_request", "state and nonce must be at most 255 characters.")
+	} else if len(problem) > 0 {
+		redirectError(rw, req, redirect, state, "invalid_scope", problem)
+	} else if denied := scope.exceeds(client.Scopes); len(denied) > 0 {
+		redirectError(rw, req, redirect, state, "invalid_scope", "Client "+client.Name+" may not request scope "+denied+".")
+	} else {
+		startAuthorization(rw, req, client, scope, redirect)
+	}
+}
+
+func startAuthorization(rw http.ResponseWriter, req *http.Request, client *Client, scope Scope, redirect string) {
+	query := req.URL.Query()
+	result := map[string]interface{}{}
+	result["error"] = []string{}
+	iat := time.Now().UTC().Unix()
+	exp := iat + tokenTTL
+	item, err := issueToken(tokenLogin, scope.String(), client.Name, exp)
+	if err == nil {
+		err = Storage().AuthRequests().Create(&AuthRequest{
+			Token:       item.Token,
+			Client:      client.Name,
+			RedirectURI: redirect,
+			Scope:       item.Scope,
+			State:       query.Get("state"),
+			Nonce:       query.Get("nonce"),
+			Challenge:   query.Get("code_challenge"),
+			Expires:     item.Expires,
+			Created:     item.Created,
+		})
+	}
+	if err != nil {
+		redirectError(rw, req, redirect, query.Get("state"), "temporarily_unavailable",
+			oidcFailure(req, "authorization request not stored", err))
+		return
+	}
+	serverJWT := loginJWT(req, item, iat, exp, result)
+	if e := firstAPIError(result); e != nil {
+		redirectError(rw, req, redirect, query.Get("state"), "server_error",
+			oidcFailure(req, "login JWT not signed", e))
+		return
+	}
+	wait := oidcIssuer() + "/oauth/authorize/wait?token=" + url.QueryEscape(item.Token)
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		renderJSON(rw, http.StatusOK, map[string]string{
+			"JWT":   serverJWT,
+			"token": item.Token,
+			"wait":  wait,
+		})
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	authorizePage.Execute(rw, map[string]string{
+		"Client": client.Name,
+		"JWT":    serverJWT,
+		"Wait":   wait,
+	})
+}
+
+// oidcAuthorizeWait waits at /oauth/authorize/wait until the login token
+// has been validated and redirects back to the client with a code.
+func oidcAuthorizeWait(rw http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get("token")
+	request, err := Storage().AuthRequests().Find(token)
+	if err == errNotFound {
+		http.Error(rw, "Unknown authorization request.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, oidcFailure(req, "authorization request lookup failed", err), http.StatusServiceUnavailable)
+		return
+	}
+	row, err := waitForToken(token)
+	if err == errTokenTimeout {
+		redirectError(rw, req, request.RedirectURI, request.State, "access_denied", "Login was not completed in time.")
+		return
+	} else if err != nil {
+		redirectError(rw, req, request.RedirectURI, request.State, "temporarily_unavailable",
+			oidcFailure(req, "login token wait failed", err))
+		return
+	} else if !row.Valid {
+		redirectError(rw, req, request.RedirectURI, request.State, "access_denied", "Login was rejected.")
+		return
+	}
+	// The login token is only validated by a login JWT that authenticateUser
+	// verified against the key registered for row.Proxy; the proxy must
+	// still be registered.
+	if _, err := Storage().Users().FindByProxy(row.Proxy); err == errNotFound {
+		redirectError(rw, req, request.RedirectURI, request.State, "access_denied", "Login was not made by a registered user.")
+		return
+	} else if err != nil {
+		redirectError(rw, req, request.RedirectURI, request.State, "temporarily_unavailable",
+			oidcFailure(req, "user lookup failed", err))
+		return
+	}
+	code := randomCode()
+	err = Storage().AuthRequests().Complete(token, code, row.Proxy, row.Scope, formatUnix(time.Now().Unix()+oidcCodeTTL))
+	if err == errConflict {
+		http.Error(rw, "Authorization has already been completed.", http.StatusConflict)
+		return
+	} else if err != nil {
+		redirectError(rw, req, request.RedirectURI, request.State, "temporarily_unavailable",
+			oidcFailure(req, "authorization code not stored", err))
+		return
+	}
+	params := url.Values{"code": {code}}
+	if len(request.State) > 0 {
+		params.Set("state", request.State)
+	}
+	redirectWith(rw, req, request.RedirectURI, params)
+}
+
+// oidcToken exchanges an authorization code at /oauth/token.
+func oidcToken(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	if req.Method != "POST" {
+		oauthFailure(rw, http.StatusMethodNotAllowed, "invalid_request", "Token requests must be posted.")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		logDebug(req, "token request form", fields{"error": err})
+		oauthFailure(rw, http.StatusBadRequest, "invalid_request", "Request body is not a valid form.")
+		return
+	}
+	form := req.PostForm
+	if form.Get("grant_type") != "authorization_code" {
+		oauthFailure(rw, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported.")
+		return
+	}
+	for _, name := range []string{"code", "redirect_uri", "client_id", "code_verifier"} {
+		if len(form.Get(name)) == 0 {
+			oauthFailure(rw, http.StatusBadRequest, "invalid_request", name+" is required.")
+			return
+		}
+	}
+	// The code is only redeemed once the request proves it was issued to
+	// this client, redirect_uri and code_verifier, so a wrong guess cannot
+	// burn the code of the legitimate client.
+	now := time.Now().Unix()
+	request, err := Storage().AuthRequests().FindByCode(form.Get("code"))
+	if err == errNotFound {
+		oauthFailure(rw, http.StatusBadRequest, "invalid_grant", "Code is invalid, expired or already used.")
+		return
+	} else if err != nil {
+		oauthFailure(rw, http.StatusServiceUnavailable, "temporarily_unavailable",
+			oidcFailure(req, "authorization code lookup failed", err))
+		return
+	}
+	challenge := pkceChallenge(form.Get("code_verifier"))
+	if request.Client != form.Get("client_id") || request.RedirectURI != form.Get("redirect_uri") {
+		oauthFailure(rw, http.StatusBadRequest, "invalid_grant", "Code was not issued to this client and redirect_uri.")
+		return
+	} else if subtle.ConstantTimeCompare([]byte(challenge), []byte(request.Challenge)) != 1 {
+		oauthFailure(rw, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge.")
+		return
+	}
+	request, err = Storage().AuthRequests().Redeem(form.Get("code"), formatUnix(now))
+	if err == errNotFound || err == errConflict {
+		oauthFailure(rw, http.StatusBadRequest, "invalid_grant", "Code is invalid, expired or already used.")
+		return
+	} else if err != nil {
+		oauthFailure(rw, http.StatusServiceUnavailable, "temporarily_unavailable",
+			oidcFailure(req, "authorization code not redeemed", err))
+		return
+	}
+	client, err := Storage().Clients().Find(request.Client)
+	if err != nil || client.Status != clientActive {
+		oauthFailure(rw, http.StatusUnauthorized, "invalid_client", "Client "+request.Client+" is not active.")
+		return
+	}
+
+	result := map[string]interface{}{}
+	result["error"] = []string{}
+	issuer := oidcIssuer()
+	exp := now + accessTokenTTL()
+	idToken := map[string]interface{}{
+		"iss": issuer,
+		"sub": request.Proxy,
+		"aud": request.Client,
+		"iat": now,
+		"exp": exp,
+	}
+	if len(request.Nonce) > 0 {
+		idToken["nonce"] = request.Nonce
+	}
+	accessToken := map[string]interface{}{
+		"iss":       issuer,
+		"sub":       request.Proxy,
+		"aud":       request.Client,
+		"iat":       now,
+		"exp":       exp,
+		"scope":     request.Scope,
+		"token_use": oidcAccessType,
+	}
+	response := map[string]interface{}{
+		"access_token": encodeJWT(req, accessToken, result),
+		"id_token":     encodeJWT(req, idToken, result),
+		"token_type":   "Bearer",
+		"expires_in":   exp - now,
+		"scope":        strings.TrimSpace(oidcScope + " " + strings.Replace(request.Scope, ",", " ", -1)),
+	}
+	if e := firstAPIError(result); e != nil {
+		logError(req, "ID and access tokens not signed", fields{"error": e})
+		oauthFailure(rw, http.StatusInternalServerError, "server_error", "Tokens could not be issued.")
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	renderJSON(rw, http.StatusOK, response)
+}
+
+// oidcUserInfo returns the claims released to an access token at
+// /oauth/userinfo.
+func oidcUserInfo(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	result := map[string]interface{}{}
+	result["error"] = []string{}
+	payload := map[string]interface{}{}
+	if len(token) > 0 && jwtPattern.MatchString(token) {
+		payload = decodeJWT(req, token, result)
+		if firstAPIError(result) == nil {
+			verifyJWT(req, Config().JWT.ServerPublicKey, token, result)
+		}
+	}
+	exp, _, _ := claimInt64(payload, "exp")
+	iss, _ := payload["iss"].(string)
+	use, _ := payload["token_use"].(string)
+	proxy, _ := payload["sub"].(string)
+	value, _ := payload["scope"].(string)
+	scope, err := parseScope(value)
+	if len(token) == 0 || firstAPIError(result) != nil || iss != oidcIssuer() || use != oidcAccessType ||
+		exp < time.Now().Unix() || len(proxy) == 0 || err != nil {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthFailure(rw, http.StatusUnauthorized, "invalid_token", "Access token is invalid or expired.")
+		return
+	}
+	iat, _, _ := claimInt64(payload, "iat")
+	user, err := Storage().Users().FindByProxy(proxy)
+	if err == errNotFound {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthFailure(rw, http.StatusUnauthorized, "invalid_token", "Access token is not for a registered user.")
+		return
+	} else if err != nil {
+		oauthFailure(rw, http.StatusServiceUnavailable, "temporarily_unavailable",
+			oidcFailure(req, "user lookup failed", err))
+		return
+	} else if len(user.Rotated) > 0 && formatUnix(iat) < user.Rotated {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthFailure(rw, http.StatusUnauthorized, "invalid_token", "Access token was issued before a key change.")
+		return
+	}
+	claims := map[string]interface{}{}
+	for key, value := range getUserData(req, proxy, scope, result) {
+		claims[key] = value
+	}
+	if e := firstAPIError(result); e != nil {
+		oauthFailure(rw, e.Status, "temporarily_unavailable", oidcFailure(req, "user claims unavailable", e))
+		return
+	}
+	claims["sub"] = proxy
+	rw.Header().Set("Cache-Control", "no-store")
+	renderJSON(rw, http.StatusOK, claims)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exchangeCode posts an authorization code exchange and returns the status
+// and the OAuth error code, if any.
+func exchangeCode(form url.Values) (int, string) {
+	req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	oidcToken(rw, req)
+	response := map[string]interface{}{}
+	json.Unmarshal(rw.Body.Bytes(), &response)
+	code, _ := response["error"].(string)
+	return rw.Code, code
+}
+
+func TestOIDCTokenPKCE(t *testing.T) {
+	useTestConfig()
+	Config().JWT.ServerPrivateKey = testPrivateKey
+	Config().OIDC = &OIDCConfig{Issuer: "https://id.example.com"}
+	redirect := "https://shop.example.com/callback"
+	verifier := strings.Repeat("v", 43)
+	Storage().Clients().Create(&Client{Name: "shop", RedirectURLs: []string{redirect}, Status: clientActive})
+	Storage().AuthRequests().Create(&AuthRequest{
+		Token:       "token",
+		Client:      "shop",
+		RedirectURI: redirect,
+		Challenge:   pkceChallenge(verifier),
+	})
+	expires := formatUnix(time.Now().Unix() + oidcCodeTTL)
+	if err := Storage().AuthRequests().Complete("token", "code", testUserProxy, "name", expires); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	exchange := func(name string, value string) url.Values {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {"code"},
+			"client_id":     {"shop"},
+			"redirect_uri":  {redirect},
+			"code_verifier": {verifier},
+		}
+		if len(name) > 0 {
+			form.Set(name, value)
+		}
+		return form
+	}
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+		code   string
+	}{
+		{"wrong verifier", exchange("code_verifier", strings.Repeat("w", 43)), 400, "invalid_grant"},
+		{"other client", exchange("client_id", "other"), 400, "invalid_grant"},
+		{"other redirect_uri", exchange("redirect_uri", "https://evil.example.com/"), 400, "invalid_grant"},
+		{"unknown code", exchange("code", "guess"), 400, "invalid_grant"},
+		{"missing verifier", exchange("code_verifier", ""), 400, "invalid_request"},
+		{"valid exchange", exchange("", ""), 200, ""},
+		{"code reused", exchange("", ""), 400, "invalid_grant"},
+	}
+	for _, test := range tests {
+		if status, code := exchangeCode(test.form); status != test.status || code != test.code {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, status, code, test.status, test.code)
+		}
+	}
+}
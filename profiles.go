@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/donh/winter/did"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Public profiles. A user publishes the name, description, avatar and
+// chosen attestations of their profile as a JSON document in the content
+// store, whose CID is kept in users.ipfs. The document carries the user's
+// signed publication JWT as proof, and is checked against its CID, that
+// proof and the current attestations whenever it is read.
+
+const (
+	profilePublicationSubject = "profile publication"
+	profileType               = "WinterProfile"
+)
+
+type profileRequest struct {
+	ProfileJWT string `json:"profileJWT" validate:"required,jwt"`
+}
+
+type profileContext struct {
+	UserProxy     string `json:"userProxy" validate:"required,max=50,address"`
+	UserPublicKey string `json:"userPublicKey" validate:"required,max=150,hex"`
+	Description   string `json:"description" validate:"max=300"`
+	Avatar        string `json:"avatar" validate:"max=2048"`
+	Attestations  string `json:"attestations" validate:"max=255"`
+}
+
+// profileAttestation is an attestation published in a profile.
+type profileAttestation struct {
+	Type        string `json:"type"`
+	Attestant   string `json:"attestant"`
+	Attestation string `json:"attestation"`
+	Created     string `json:"created"`
+}
+
+// Profile is the document published for a user.
+type Profile struct {
+	Type         string               `json:"type"`
+	ID           string               `json:"id"`
+	Name         string               `json:"name"`
+	Description  string               `json:"description,omitempty"`
+	Avatar       string               `json:"avatar,omitempty"`
+	Attestations []profileAttestation `json:"attestations"`
+	Published    string               `json:"published"`
+	Proof        map[string]string    `json:"proof"`
+}
+
+// approvedAttestation returns the approved claim of proxy of type
+// claimType and its active attestation, or errNotFound.
+func approvedAttestation(proxy string, claimType string) (*Claim, *Attestation, error) {
+	claim, err := Storage().Claims().FindLatest(proxy, claimType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ClaimStatus(claim.Status) != ClaimApproved {
+		return nil, nil, errNotFound
+	}
+	attestation, err := Storage().Attestations().FindLatest(claim.ID, attestationActive)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claim, attestation, nil
+}
+
+func profileTypes(value string) []string {
+	types := []string{}
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !containsString(types, strings.ToUpper(field)) {
+			types = append(types, strings.ToUpper(field))
+		}
+	}
+	return types
+}
+
+// buildProfile returns the profile of user described by context and signed
+// in token.
+func buildProfile(r *http.Request, user *User, context profileContext, token string, result map[string]interface{}) *Profile {
+	if len(context.Avatar) > 0 && !strings.HasPrefix(context.Avatar, "https://") &&
+		!strings.HasPrefix(context.Avatar, "ipfs://") {
+		setAPIError(badRequest("avatar", "avatar must be an https:// or ipfs:// URL."), result)
+		return nil
+	}
+	profile := &Profile{
+		Type:         profileType,
+		ID:           did.FromAddress(user.Proxy),
+		Name:         user.Name,
+		Description:  context.Description,
+		Avatar:       context.Avatar,
+		Attestations: []profileAttestation{},
+		Published:    time.Now().UTC().Format(time.RFC3339),
+		Proof:        map[string]string{"type": attestationProofType, "jwt": token},
+	}
+	for _, claimType := range profileTypes(context.Attestations) {
+		if !claimTypePattern.MatchString(claimType) {
+			setAPIError(badRequest("attestations", "Invalid claim type "+claimType+"."), result)
+			return nil
+		}
+		_, attestation, err := approvedAttestation(user.Proxy, claimType)
+		if err == errNotFound {
+			setAPIError(notFound("No approved "+claimType+" claim."), result)
+			return nil
+		} else if err != nil {
+			setFailure(r, err, result)
+			return nil
+		}
+		profile.Attestations = append(profile.Attestations, profileAttestation{
+			Type:        claimType,
+			Attestant:   attestation.Attestant,
+			Attestation: attestation.Attestation,
+			Created:     attestation.Created,
+		})
+	}
+	return profile
+}
+
+// verifyProfile checks a profile read from the content store against user:
+// the proof must be the user's signature of its fields, and every
+// attestation must still be active.
+func verifyProfile(r *http.Request, user *User, profile *Profile) map[string]interface{} {
+	result := map[string]interface{}{"error": []string{}}
+	signed := profile.ID == did.FromAddress(user.Proxy) && profile.Type == profileType
+	if signed {
+		token := profile.Proof["jwt"]
+		var context profileContext
+		body := decodeJWT(r, token, result)
+		signed = firstAPIError(result) == nil && body["sub"] == profilePublicationSubject &&
+			decodeContext(body, &context, result) && context.UserProxy == user.Proxy &&
+			context.Description == profile.Description && context.Avatar == profile.Avatar &&
+			verifyJWT(r, user.PublicKey, token, result)
+		types := profileTypes(context.Attestations)
+		signed = signed && len(types) == len(profile.Attestations)
+		for i, each := range profile.Attestations {
+			signed = signed && each.Type == types[i]
+		}
+	}
+	valid := signed
+	attestations := []map[string]interface{}{}
+	for _, each := range profile.Attestations {
+		_, attestation, err := approvedAttestation(user.Proxy, each.Type)
+		active := err == nil && attestation.Attestation == each.Attestation
+		valid = valid && active
+		attestations = append(attestations, map[string]interface{}{"type": each.Type, "active": active})
+	}
+	return map[string]interface{}{
+		"signed":       signed,
+		"attestations": attestations,
+		"valid":        valid,
+	}
+}
+
+// publishProfile publishes the profile of the user who signed the request
+// and records its CID.
+func publishProfile(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req profileRequest
+	var context profileContext
+	item := map[string]interface{}{}
+	if r.Method != "POST" {
+		setAPIError(badRequest("", "Profiles must be posted."), result)
+	} else if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ProfileJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) &&
+			checkSubject(body, profilePublicationSubject, result) &&
+			authenticateUser(r, req.ProfileJWT, body, context.UserProxy, context.UserPublicKey, result) {
+			user, err := Storage().Users().FindByProxy(context.UserProxy)
+			if err != nil {
+				setFailure(r, err, result)
+			} else if profile := buildProfile(r, user, context, req.ProfileJWT, result); profile != nil {
+				content, _ := json.Marshal(profile)
+				cid, err := contentStore.Put(r, content)
+				if err == nil {
+					err = Storage().Users().SetIPFS(user.Proxy, cid, getNow())
+				}
+				if err != nil {
+					setFailure(r, err, result)
+				} else {
+					if resolver != nil {
+						resolver.Invalidate(did.FromAddress(user.Proxy))
+					}
+					item["cid"] = cid
+					item["profile"] = profile
+				}
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	result["items"] = item
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+// getProfile answers GET /api/v1/profiles/<proxy> with the published
+// profile of the user and the outcome of its verification.
+func getProfile(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	proxy := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/profiles/"), "/")
+	item := map[string]interface{}{}
+	user, err := Storage().Users().FindByProxy(proxy)
+	if err == errNotFound {
+		setAPIError(notFound("Unknown user "+proxy+"."), result)
+	} else if err != nil {
+		setFailure(r, err, result)
+	} else if len(user.IPFS) == 0 {
+		setAPIError(notFound(proxy+" has not published a profile."), result)
+	} else if !cidPattern.MatchString(user.IPFS) {
+		setAPIError(conflict("Profile "+user.IPFS+" is not a CIDv1 document and cannot be verified."), result)
+	} else if content, err := contentStore.Get(r, user.IPFS); err == errNotFound {
+		setAPIError(notFound("Profile "+user.IPFS+" is not in the content store."), result)
+	} else if err != nil {
+		setFailure(r, err, result)
+	} else {
+		profile := &Profile{}
+		if err := json.Unmarshal(content, profile); err != nil {
+			setAPIError(upstreamFailure("Profile "+user.IPFS+" is not a profile document."), result)
+		} else {
+			item["cid"] = user.IPFS
+			item["profile"] = profile
+			item["verification"] = verifyProfile(r, user, profile)
+		}
+	}
+	nodes := map[string]interface{}{}
+	result["items"] = item
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
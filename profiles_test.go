@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPublishProfile(t *testing.T) {
+	holderPrivate, _, attestation := testCredentialSetup(t)
+	_, holderPublic := testKeyPair(t, "02")
+	store, _, cleanup := testFSContentStore(t)
+	defer cleanup()
+	contentStore = store
+	defer func() { contentStore = nil }()
+
+	publish := func(avatar string) int {
+		token, err := signJWT(map[string]interface{}{
+			"sub": profilePublicationSubject,
+			"jti": fmt.Sprint(time.Now().UnixNano()),
+			"exp": float64(time.Now().Unix() + 300),
+			"context": map[string]interface{}{
+				"userProxy":     testUserProxy,
+				"userPublicKey": holderPublic,
+				"description":   "Hello.",
+				"avatar":        avatar,
+				"attestations":  "email",
+			},
+		}, algES256K, holderPrivate)
+		if err != nil {
+			t.Fatalf("signJWT: %v", err)
+		}
+		bs, _ := json.Marshal(map[string]string{"profileJWT": token})
+		rw := httptest.NewRecorder()
+		publishProfile(rw, httptest.NewRequest("POST", "/api/v1/profiles", bytes.NewReader(bs)))
+		return rw.Code
+	}
+	verification := func() (int, map[string]interface{}) {
+		rw := httptest.NewRecorder()
+		getProfile(rw, httptest.NewRequest("GET", "/api/v1/profiles/"+testUserProxy, nil))
+		response := map[string]map[string]interface{}{}
+		json.Unmarshal(rw.Body.Bytes(), &response)
+		checks, _ := response["result"]["verification"].(map[string]interface{})
+		return rw.Code, checks
+	}
+
+	if code, _ := verification(); code != 404 {
+		t.Errorf("before publication: status = %d, want 404", code)
+	}
+	if code := publish("http://example.com/avatar.png"); code != 400 {
+		t.Errorf("plain http avatar: status = %d, want 400", code)
+	}
+	if code := publish("https://example.com/avatar.png"); code != 200 {
+		t.Fatalf("publication: status = %d, want 200", code)
+	}
+	if user, _ := Storage().Users().FindByProxy(testUserProxy); !cidPattern.MatchString(user.IPFS) {
+		t.Errorf("recorded CID = %q", user.IPFS)
+	}
+	if code, checks := verification(); code != 200 || checks["signed"] != true || checks["valid"] != true {
+		t.Errorf("published profile = %d, %v, want a valid signed profile", code, checks)
+	}
+	Storage().Attestations().Revoke(attestation.ID, "reason", getNow(), nil)
+	if code, checks := verification(); code != 200 || checks["signed"] != true || checks["valid"] != false {
+		t.Errorf("after revocation = %d, %v, want a signed but invalid profile", code, checks)
+	}
+}
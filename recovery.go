@@ -0,0 +1,440 @@
+package main
+
+import (
+	"github.com/donh/winter/did"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key rotation and account recovery. A user rotates their key through the
+// controller contract of their proxy by signing with the current key. A
+// user who lost their key is recovered through the recovery contract once
+// enough of the guardians they named approved the new key and the recovery
+// delay has passed; until then the user, or any guardian, may cancel it.
+// Both take two calls like createUser: the first returns the unsigned
+// rawTx, the second sends it back as rawTxSigned.
+
+// Recovery states.
+const (
+	recoveryPending   = "PENDING"
+	recoveryExecuted  = "EXECUTED"
+	recoveryCancelled = "CANCELLED"
+)
+
+// Subjects of the JWTs signed to rotate keys and recover accounts.
+const (
+	keyRotationSubject          = "key rotation"
+	guardiansSubject            = "recovery guardians"
+	recoveryApprovalSubject     = "recovery approval"
+	recoveryCancellationSubject = "recovery cancellation"
+	recoveryExecutionSubject    = "recovery execution"
+)
+
+type keyChangeRequest struct {
+	ChangeJWT   string `json:"changeJWT" validate:"required,jwt"`
+	RawTxSigned string `json:"rawTxSigned" validate:"hex"`
+}
+
+type rotationContext struct {
+	UserProxy     string `json:"userProxy" validate:"required,max=50,address"`
+	UserPublicKey string `json:"userPublicKey" validate:"required,max=150,hex"`
+	NewPublicKey  string `json:"newPublicKey" validate:"required,max=150,hex"`
+	NewAddress    string `json:"newAddress" validate:"required,max=70,address"`
+}
+
+type guardiansContext struct {
+	UserProxy     string `json:"userProxy" validate:"required,max=50,address"`
+	UserPublicKey string `json:"userPublicKey" validate:"required,max=150,hex"`
+	Guardians     string `json:"guardians" validate:"max=512"`
+}
+
+// recoveryContext is signed by SignerProxy, the user or one of their
+// guardians, except for execution, which is signed with NewPublicKey.
+type recoveryContext struct {
+	UserProxy       string `json:"userProxy" validate:"required,max=50,address"`
+	SignerProxy     string `json:"signerProxy" validate:"max=50,address"`
+	SignerPublicKey string `json:"signerPublicKey" validate:"max=150,hex"`
+	NewPublicKey    string `json:"newPublicKey" validate:"max=150,hex"`
+	NewAddress      string `json:"newAddress" validate:"max=70,address"`
+}
+
+func recoveryApprovals() int {
+	if cfg := Config().Recovery; cfg != nil && cfg.Approvals > 0 {
+		return cfg.Approvals
+	}
+	return 2
+}
+
+func recoveryDelay() time.Duration {
+	if cfg := Config().Recovery; cfg != nil && cfg.Delay > 0 {
+		return time.Duration(cfg.Delay) * time.Second
+	}
+	return 48 * time.Hour
+}
+
+func recoveryView(recovery *Recovery) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         recovery.ID,
+		"proxy":      recovery.Proxy,
+		"publicKey":  recovery.PublicKey,
+		"address":    recovery.Address,
+		"approvals":  recovery.Approvals,
+		"required":   recoveryApprovals(),
+		"status":     recovery.Status,
+		"executable": recovery.Executable,
+		"created":    recovery.Created,
+		"updated":    recovery.Updated,
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNewKey records a conflict when publicKey is already registered.
+func checkNewKey(r *http.Request, publicKey string, result map[string]interface{}) bool {
+	_, err := Storage().Users().FindByPublicKey(publicKey)
+	if err == nil {
+		setAPIError(conflict("Public key is already registered."), result)
+		return false
+	} else if err != errNotFound {
+		setFailure(r, err, result)
+		return false
+	}
+	return true
+}
+
+// transferProxy makes newAddress the owner of proxy through contract.
+// Without signedTx it returns the unsigned transaction in result["rawTx"];
+// with it, it submits the transaction and stores the new key with commit.
+// It reports whether the key was stored.
+func transferProxy(r *http.Request, contract string, proxy string, newAddress string, signedTx string, commit func() error, result map[string]interface{}) bool {
+	if len(signedTx) == 0 {
+		rawTx, err := gateway.PrepareOwnerChange(r, contract, proxy, newAddress)
+		if err != nil {
+			setFailure(r, err, result)
+		} else {
+			result["rawTx"] = rawTx
+		}
+		return false
+	}
+	if err := gateway.ChangeOwner(r, contract, proxy, newAddress, signedTx); err != nil {
+		setFailure(r, err, result)
+		return false
+	}
+	err := commit()
+	if err == errConflict {
+		setAPIError(conflict("The key of "+proxy+" changed concurrently."), result)
+		return false
+	} else if err != nil {
+		setFailure(r, err, result)
+		return false
+	}
+	if resolver != nil {
+		resolver.Invalidate(did.FromAddress(proxy))
+	}
+	return true
+}
+
+// rotateUserKey moves the proxy of the user who signed the request with
+// their current key to a new key through its controller contract.
+func rotateUserKey(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req keyChangeRequest
+	var context rotationContext
+	rotated := false
+	if r.Method != "POST" {
+		setAPIError(badRequest("", "Key rotation must be posted."), result)
+	} else if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ChangeJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) &&
+			checkSubject(body, keyRotationSubject, result) &&
+			authenticateUser(r, req.ChangeJWT, body, context.UserProxy, context.UserPublicKey, result) &&
+			checkNewKey(r, context.NewPublicKey, result) {
+			user, err := Storage().Users().FindByProxy(context.UserProxy)
+			if err != nil {
+				setFailure(r, err, result)
+			} else {
+				rotated = transferProxy(r, user.Controller, user.Proxy, context.NewAddress, req.RawTxSigned, func() error {
+					return Storage().Users().RotateKey(user.Proxy, user.PublicKey,
+						context.NewPublicKey, context.NewAddress, getNow())
+				}, result)
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	result["rotated"] = rotated
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+// parseGuardians returns the distinct proxies listed in value, which must
+// be registered users other than proxy.
+func parseGuardians(r *http.Request, proxy string, value string, result map[string]interface{}) ([]string, bool) {
+	guardians := []string{}
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	for _, field := range fields {
+		if msg := validateString("guardians", field, "address"); len(msg) > 0 {
+			setAPIError(badRequest("guardians", msg), result)
+			return nil, false
+		}
+		if strings.EqualFold(field, proxy) {
+			setAPIError(badRequest("guardians", "Users cannot be their own guardian."), result)
+			return nil, false
+		}
+		if containsString(guardians, field) {
+			continue
+		}
+		_, err := Storage().Users().FindByProxy(field)
+		if err == errNotFound {
+			setAPIError(badRequest("guardians", "Guardian "+field+" is not a registered user."), result)
+			return nil, false
+		} else if err != nil {
+			setFailure(r, err, result)
+			return nil, false
+		}
+		guardians = append(guardians, field)
+	}
+	if len(guardians) > 0 && len(guardians) < recoveryApprovals() {
+		setAPIError(badRequest("guardians", "Recovery needs at least "+
+			strconv.Itoa(recoveryApprovals())+" guardians."), result)
+		return nil, false
+	}
+	return guardians, true
+}
+
+// setGuardians replaces the recovery guardians of the user who signed the
+// request; an empty list disables recovery.
+func setGuardians(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req keyChangeRequest
+	var context guardiansContext
+	if r.Method != "POST" {
+		setAPIError(badRequest("", "Guardians must be posted."), result)
+	} else if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ChangeJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) &&
+			checkSubject(body, guardiansSubject, result) &&
+			authenticateUser(r, req.ChangeJWT, body, context.UserProxy, context.UserPublicKey, result) {
+			if guardians, ok := parseGuardians(r, context.UserProxy, context.Guardians, result); ok {
+				if err := Storage().Users().SetGuardians(context.UserProxy, guardians, getNow()); err != nil {
+					setFailure(r, err, result)
+				}
+				result["guardians"] = guardians
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+// recoveryRoutes dispatches /api/v1/recoveries/{approve,cancel,execute}.
+func recoveryRoutes(rw http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/recoveries/"), "/")
+	if action != "approve" && action != "cancel" && action != "execute" {
+		routeNotFound(rw, r)
+		return
+	}
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	var req keyChangeRequest
+	var context recoveryContext
+	if r.Method != "POST" {
+		setAPIError(badRequest("", "Recoveries must be posted."), result)
+	} else if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ChangeJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) {
+			switch action {
+			case "approve":
+				approveRecovery(r, req, body, context, result)
+			case "cancel":
+				cancelRecovery(r, req, body, context, result)
+			case "execute":
+				executeRecovery(r, req, body, context, result)
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+// recoverySigner authenticates the signer of a recovery request, who must
+// be the user or, when guardians is set, one of their guardians. It returns
+// the recovered user.
+func recoverySigner(r *http.Request, req keyChangeRequest, body map[string]interface{}, context recoveryContext, guardianOnly bool, result map[string]interface{}) *User {
+	if len(context.SignerProxy) == 0 || len(context.SignerPublicKey) == 0 {
+		setAPIError(badRequest("signerProxy", "signerProxy and signerPublicKey are required."), result)
+		return nil
+	}
+	user, err := Storage().Users().FindByProxy(context.UserProxy)
+	if err == errNotFound {
+		setAPIError(notFound("Unknown user "+context.UserProxy+"."), result)
+		return nil
+	} else if err != nil {
+		setFailure(r, err, result)
+		return nil
+	}
+	guardian := containsString(user.Guardians, context.SignerProxy)
+	if !guardian && (guardianOnly || context.SignerProxy != user.Proxy) {
+		setAPIError(forbidden(context.SignerProxy+" is not a recovery guardian of "+user.Proxy+"."), result)
+		return nil
+	}
+	if !authenticateUser(r, req.ChangeJWT, body, context.SignerProxy, context.SignerPublicKey, result) {
+		return nil
+	}
+	return user
+}
+
+// approveRecovery records the approval of a guardian for moving the user to
+// a new key, starting the recovery on the first approval. The recovery
+// delay starts once enough guardians approved.
+func approveRecovery(r *http.Request, req keyChangeRequest, body map[string]interface{}, context recoveryContext, result map[string]interface{}) {
+	if len(context.NewPublicKey) == 0 || len(context.NewAddress) == 0 {
+		setAPIError(badRequest("newPublicKey", "newPublicKey and newAddress are required."), result)
+		return
+	}
+	if !checkSubject(body, recoveryApprovalSubject, result) {
+		return
+	}
+	user := recoverySigner(r, req, body, context, true, result)
+	if user == nil || !checkNewKey(r, context.NewPublicKey, result) {
+		return
+	}
+	now := getNow()
+	recoveries := Storage().Recoveries()
+	recovery, err := recoveries.FindPending(user.Proxy)
+	if err == errNotFound {
+		recovery = &Recovery{
+			Proxy:     user.Proxy,
+			PublicKey: context.NewPublicKey,
+			Address:   context.NewAddress,
+			Approvals: []string{},
+			Status:    recoveryPending,
+			Created:   now,
+			Updated:   now,
+		}
+		err = recoveries.Create(recovery)
+	}
+	if err == errConflict {
+		setAPIError(conflict("Another recovery of "+user.Proxy+" started concurrently."), result)
+		return
+	} else if err != nil {
+		setFailure(r, err, result)
+		return
+	}
+	if recovery.PublicKey != context.NewPublicKey || recovery.Address != context.NewAddress {
+		setAPIError(conflict("Recovery "+strconv.FormatInt(recovery.ID, 10)+
+			" to another key is pending; cancel it first."), result)
+		return
+	}
+	approvals := recovery.Approvals
+	if !containsString(approvals, context.SignerProxy) {
+		approvals = append(approvals, context.SignerProxy)
+	}
+	executable := recovery.Executable
+	if len(executable) == 0 && len(approvals) >= recoveryApprovals() {
+		executable = formatUnix(time.Now().Add(recoveryDelay()).Unix())
+	}
+	err = recoveries.Approve(recovery, approvals, executable, now)
+	if err == errConflict {
+		setAPIError(conflict("Recovery "+strconv.FormatInt(recovery.ID, 10)+" changed concurrently."), result)
+		return
+	} else if err != nil {
+		setFailure(r, err, result)
+		return
+	}
+	recovery.Approvals = approvals
+	recovery.Executable = executable
+	recovery.Updated = now
+	result["recovery"] = recoveryView(recovery)
+}
+
+// cancelRecovery cancels the pending recovery of the user, on request of
+// the user or of one of their guardians.
+func cancelRecovery(r *http.Request, req keyChangeRequest, body map[string]interface{}, context recoveryContext, result map[string]interface{}) {
+	if !checkSubject(body, recoveryCancellationSubject, result) {
+		return
+	}
+	user := recoverySigner(r, req, body, context, false, result)
+	if user == nil {
+		return
+	}
+	recovery, err := Storage().Recoveries().FindPending(user.Proxy)
+	if err == nil {
+		err = Storage().Recoveries().Cancel(recovery.ID, getNow())
+	}
+	if err == errNotFound || err == errConflict {
+		setAPIError(notFound("No pending recovery of "+user.Proxy+"."), result)
+	} else if err != nil {
+		setFailure(r, err, result)
+	} else {
+		recovery.Status = recoveryCancelled
+		result["recovery"] = recoveryView(recovery)
+	}
+}
+
+// executeRecovery moves the user to the key of their approved recovery once
+// its delay has passed. The request is signed with the new key.
+func executeRecovery(r *http.Request, req keyChangeRequest, body map[string]interface{}, context recoveryContext, result map[string]interface{}) {
+	if !checkSubject(body, recoveryExecutionSubject, result) {
+		return
+	}
+	recovery, err := Storage().Recoveries().FindPending(context.UserProxy)
+	if err == errNotFound {
+		setAPIError(notFound("No pending recovery of "+context.UserProxy+"."), result)
+		return
+	} else if err != nil {
+		setFailure(r, err, result)
+		return
+	}
+	if !strings.EqualFold(recovery.PublicKey, context.NewPublicKey) {
+		setAPIError(unauthorized("Recovery is not for this public key."), result)
+		return
+	}
+	if !verifyJWT(r, recovery.PublicKey, req.ChangeJWT, result) ||
+		!checkJWTClaims(body, true, result) || !checkReplay(r, req.ChangeJWT, body, result) {
+		return
+	}
+	if len(recovery.Executable) == 0 {
+		setAPIError(forbidden("Recovery has "+strconv.Itoa(len(recovery.Approvals))+" of "+
+			strconv.Itoa(recoveryApprovals())+" guardian approvals."), result)
+		return
+	}
+	if getNow() < recovery.Executable {
+		setAPIError(forbidden("Recovery delay ends at "+recovery.Executable+"."), result)
+		return
+	}
+	user, err := Storage().Users().FindByProxy(recovery.Proxy)
+	if err != nil {
+		setFailure(r, err, result)
+		return
+	}
+	if transferProxy(r, user.Recovery, user.Proxy, recovery.Address, req.RawTxSigned, func() error {
+		return Storage().Recoveries().Execute(recovery.ID, user.PublicKey, getNow())
+	}, result) {
+		recovery.Status = recoveryExecuted
+	}
+	result["recovery"] = recoveryView(recovery)
+}
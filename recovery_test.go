@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeyPair returns a private key made of seed repeated and its
+// uncompressed hex ES256K public key.
+func testKeyPair(t *testing.T, seed string) (string, string) {
+	private := strings.Repeat(seed, 32)
+	priv, err := parsePrivateKey(algES256K, private)
+	if err != nil {
+		t.Fatalf("parsePrivateKey: %v", err)
+	}
+	return private, hex.EncodeToString(elliptic.Marshal(priv.Curve, priv.X, priv.Y))
+}
+
+// testProxy returns the proxy address numbered n.
+func testProxy(n int) string {
+	return fmt.Sprintf("0x%040d", n)
+}
+
+// recoveryStep posts a recovery action signed with private and returns the
+// status code and the recovery in the response, if any.
+func recoveryStep(t *testing.T, action string, subject string, private string, context map[string]interface{}, rawTxSigned string) (int, map[string]interface{}) {
+	token, err := signJWT(map[string]interface{}{
+		"sub":     subject,
+		"jti":     fmt.Sprint(time.Now().UnixNano()),
+		"exp":     float64(time.Now().Unix() + 300),
+		"context": context,
+	}, algES256K, private)
+	if err != nil {
+		t.Fatalf("signJWT: %v", err)
+	}
+	bs, _ := json.Marshal(map[string]string{"changeJWT": token, "rawTxSigned": rawTxSigned})
+	rw := httptest.NewRecorder()
+	recoveryRoutes(rw, httptest.NewRequest("POST", "/api/v1/recoveries/"+action, bytes.NewReader(bs)))
+	response := map[string]map[string]interface{}{}
+	json.Unmarshal(rw.Body.Bytes(), &response)
+	recovery, _ := response["result"]["recovery"].(map[string]interface{})
+	return rw.Code, recovery
+}
+
+func TestAccountRecovery(t *testing.T) {
+	useTestConfig()
+	Config().Recovery = &RecoveryConfig{Approvals: 2, Delay: 3600}
+	gateway = newSimulatorGateway()
+	defer func() { gateway = nil }()
+
+	users := []string{"user", "first", "second", "outsider"}
+	privates := map[string]string{}
+	publics := map[string]string{}
+	proxies := map[string]string{}
+	for i, name := range users {
+		privates[name], publics[name] = testKeyPair(t, fmt.Sprintf("%02x", i+1))
+		proxies[name] = testProxy(i + 1)
+		Storage().Users().Create(&User{
+			Name:      name,
+			PublicKey: publics[name],
+			Proxy:     proxies[name],
+			Recovery:  testProxy(100 + i),
+		})
+	}
+	Storage().Users().SetGuardians(proxies["user"], []string{proxies["first"], proxies["second"]}, getNow())
+	newPrivate, newPublic := testKeyPair(t, "0a")
+	newAddress := testProxy(200)
+
+	signed := func(signer string) map[string]interface{} {
+		return map[string]interface{}{
+			"userProxy":       proxies["user"],
+			"signerProxy":     proxies[signer],
+			"signerPublicKey": publics[signer],
+			"newPublicKey":    newPublic,
+			"newAddress":      newAddress,
+		}
+	}
+	approve := func(signer string) (int, map[string]interface{}) {
+		return recoveryStep(t, "approve", recoveryApprovalSubject, privates[signer], signed(signer), "")
+	}
+	execute := func(private string, rawTxSigned string) (int, map[string]interface{}) {
+		context := map[string]interface{}{"userProxy": proxies["user"], "newPublicKey": newPublic}
+		return recoveryStep(t, "execute", recoveryExecutionSubject, private, context, rawTxSigned)
+	}
+
+	if code, _ := approve("outsider"); code != 403 {
+		t.Errorf("approval by a non-guardian: status = %d, want 403", code)
+	}
+	if code, _ := approve("user"); code != 403 {
+		t.Errorf("approval by the user: status = %d, want 403", code)
+	}
+	if code, recovery := approve("first"); code != 200 || recovery["executable"] != "" {
+		t.Errorf("first approval = %d, %v, want 200 and no end of delay", code, recovery)
+	}
+	if code, _ := execute(newPrivate, ""); code != 403 {
+		t.Errorf("execution with one approval: status = %d, want 403", code)
+	}
+	code, recovery := approve("second")
+	if code != 200 || recovery["executable"] == "" {
+		t.Fatalf("second approval = %d, %v, want 200 and an end of delay", code, recovery)
+	}
+	if code, _ := execute(newPrivate, ""); code != 403 {
+		t.Errorf("execution during the delay: status = %d, want 403", code)
+	}
+
+	pending, _ := Storage().Recoveries().FindPending(proxies["user"])
+	if err := Storage().Recoveries().Approve(pending, pending.Approvals, formatUnix(time.Now().Unix()-1), getNow()); err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	if code, _ := execute(privates["user"], ""); code != 401 {
+		t.Errorf("execution signed with the old key: status = %d, want 401", code)
+	}
+	if code, recovery := execute(newPrivate, ""); code != 200 || recovery["status"] != recoveryPending {
+		t.Errorf("unsigned execution = %d, %v, want 200 and a pending recovery", code, recovery)
+	}
+	if code, recovery := execute(newPrivate, "0x01"); code != 200 || recovery["status"] != recoveryExecuted {
+		t.Errorf("signed execution = %d, %v, want 200 and an executed recovery", code, recovery)
+	}
+	if user, err := Storage().Users().FindByProxy(proxies["user"]); err != nil || user.PublicKey != newPublic || user.Address != newAddress {
+		t.Errorf("recovered user = %+v, %v, want the new key", user, err)
+	}
+}
+
+func TestCancelRecovery(t *testing.T) {
+	useTestConfig()
+	Config().Recovery = &RecoveryConfig{Approvals: 2}
+	private, public := testKeyPair(t, "01")
+	guardianPrivate, guardianPublic := testKeyPair(t, "02")
+	_, newPublic := testKeyPair(t, "0a")
+	Storage().Users().Create(&User{PublicKey: public, Proxy: testProxy(1)})
+	Storage().Users().Create(&User{PublicKey: guardianPublic, Proxy: testProxy(2)})
+	Storage().Users().SetGuardians(testProxy(1), []string{testProxy(2)}, getNow())
+	context := map[string]interface{}{
+		"userProxy":       testProxy(1),
+		"signerProxy":     testProxy(2),
+		"signerPublicKey": guardianPublic,
+		"newPublicKey":    newPublic,
+		"newAddress":      testProxy(200),
+	}
+	if code, _ := recoveryStep(t, "approve", recoveryApprovalSubject, guardianPrivate, context, ""); code != 200 {
+		t.Fatalf("approval: status = %d, want 200", code)
+	}
+	context["signerProxy"], context["signerPublicKey"] = testProxy(1), public
+	if code, _ := recoveryStep(t, "cancel", recoveryApprovalSubject, private, context, ""); code != 400 {
+		t.Errorf("cancellation with the approval subject: status = %d, want 400", code)
+	}
+	if code, recovery := recoveryStep(t, "cancel", recoveryCancellationSubject, private, context, ""); code != 200 || recovery["status"] != recoveryCancelled {
+		t.Errorf("cancellation = %d, %v, want 200 and a cancelled recovery", code, recovery)
+	}
+	if code, _ := recoveryStep(t, "cancel", recoveryCancellationSubject, private, context, ""); code != 404 {
+		t.Errorf("second cancellation: status = %d, want 404", code)
+	}
+}
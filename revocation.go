@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attestation states. An attestation is ACTIVE while its claim is approved
+// and becomes REVOKED when the attestant withdraws it.
+const (
+	attestationActive  = "ACTIVE"
+	attestationRevoked = "REVOKED"
+)
+
+// revocationListTTL is how long, in seconds, relying parties may cache the
+// signed revocation list.
+const revocationListTTL = 300
+
+// revocationReason is the reason recorded when an attestation is revoked
+// because its claim moved to status.
+func revocationReason(status ClaimStatus, reason string) string {
+	if len(reason) > 0 {
+		return reason
+	}
+	return "Claim " + strings.ToLower(string(status)) + "."
+}
+
+// attestantPublicKey returns the key that signed a stored attestation JWT.
+func attestantPublicKey(attestation string) string {
+	t, err := parseJWT(attestation)
+	if err != nil {
+		return ""
+	}
+	context, _ := t.payload["context"].(map[string]interface{})
+	publicKey, _ := context["attestantPublicKey"].(string)
+	return publicKey
+}
+
+// attestationRoutes dispatches /api/v1/attestations/{id}/revoke and
+// /api/v1/attestations/{id}/status.
+func attestationRoutes(rw http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/api/v1/attestations/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 {
+		routeNotFound(rw, req)
+		return
+	}
+	switch parts[1] {
+	case "revoke":
+		revokeAttestation(rw, req, parts[0])
+	case "status":
+		getAttestationStatus(rw, req, parts[0])
+	default:
+		routeNotFound(rw, req)
+	}
+}
+
+func revokeAttestation(rw http.ResponseWriter, r *http.Request, id string) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+	revoked := false
+
+	var req revokeAttestationRequest
+	var context attestantContext
+	item := map[string]string{}
+	attestationID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		setAPIError(badRequest("id", "Invalid attestation ID."), result)
+	} else if r.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		setAPIError(methodNotAllowed("Revocation must be posted."), result)
+	} else if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.RevocationJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) {
+			attestation, err := Storage().Attestations().Find(attestationID)
+			if err == errNotFound {
+				setAPIError(notFound("Attestation not found."), result)
+			} else if err != nil {
+				setFailure(r, err, result)
+			} else if context.AttestationID != id {
+				setAPIError(badRequest("attestationID", "Revocation is not for this attestation."), result)
+			} else if context.AttestantPublicKey != attestantPublicKey(attestation.Attestation) {
+				setAPIError(forbidden("Only the attestant may revoke this attestation."), result)
+			} else if verifyJWT(r, context.AttestantPublicKey, req.RevocationJWT, result) &&
+				checkJWTClaims(body, true, result) && checkReplay(r, req.RevocationJWT, body, result) {
+				// An approved claim is revoked with the last of its active
+				// attestations.
+				now := getNow()
+				event := &ClaimEvent{
+					ClaimID: attestation.ClaimID,
+					From:    string(ClaimApproved),
+					To:      string(ClaimRevoked),
+					Actor:   attestation.Attestant,
+					Created: now,
+				}
+				err = Storage().Attestations().Revoke(attestation.ID, context.Reason, now, event)
+				if err == errConflict {
+					setAPIError(conflict("Attestation is not active."), result)
+				} else if err != nil {
+					setFailure(r, err, result)
+				} else {
+					revoked = true
+					item["status"] = attestationRevoked
+					item["revoked"] = now
+				}
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	nodes["revoked"] = revoked
+	result["items"] = item
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+func getAttestationStatus(rw http.ResponseWriter, req *http.Request, id string) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	item := map[string]string{}
+	attestationID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		setAPIError(badRequest("id", "Invalid attestation ID."), result)
+	} else {
+		attestation, err := Storage().Attestations().Find(attestationID)
+		if err == errNotFound {
+			setAPIError(notFound("Attestation not found."), result)
+		} else if err != nil {
+			setFailure(req, err, result)
+		} else {
+			item["attestationID"] = id
+			item["claimID"] = strconv.FormatInt(attestation.ClaimID, 10)
+			item["status"] = attestation.Status
+			if attestation.Status == attestationRevoked {
+				item["reason"] = attestation.Reason
+				item["revoked"] = attestation.Revoked
+			}
+		}
+	}
+	nodes := map[string]interface{}{}
+	result["items"] = item
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	setResponse(rw, nodes)
+}
+
+// getRevocationList serves every revoked attestation as a JWT signed with
+// the server key, so relying parties can cache and verify it offline.
+func getRevocationList(rw http.ResponseWriter, r *http.Request) {
+	errors := []string{}
+	result := map[string]interface{}{}
+	result["error"] = errors
+
+	revocations := []map[string]string{}
+	rows, err := Storage().Attestations().ListRevoked()
+	if err != nil {
+		setFailure(r, err, result)
+	}
+	for _, row := range rows {
+		revocations = append(revocations, map[string]string{
+			"attestationID": strconv.FormatInt(row.ID, 10),
+			"claimID":       strconv.FormatInt(row.ClaimID, 10),
+			"reason":        row.Reason,
+			"revoked":       row.Revoked,
+		})
+	}
+
+	serverJWT := ""
+	if err == nil {
+		iat := time.Now().UTC().Unix()
+		serverJSON := map[string]interface{}{
+			"iss":         serverIssuer,
+			"iat":         iat,
+			"exp":         iat + revocationListTTL,
+			"sub":         "attestation revocation list",
+			"revocations": revocations,
+		}
+		serverJWT = encodeJWT(r, serverJSON, result)
+	}
+
+	nodes := map[string]interface{}{}
+	nodes["count"] = len(revocations)
+	result["JWT"] = serverJWT
+	result["revocations"] = revocations
+	nodes["result"] = result
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(revocationListTTL))
+	setResponse(rw, nodes)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// postRevocation sends token to the revocation route of attestation id and
+// returns the status code.
+func postRevocation(t *testing.T, method string, token string, id int64) int {
+	bs, _ := json.Marshal(map[string]string{"revocationJWT": token})
+	path := "/api/v1/attestations/" + strconv.FormatInt(id, 10) + "/revoke"
+	rw := httptest.NewRecorder()
+	attestationRoutes(rw, httptest.NewRequest(method, path, bytes.NewReader(bs)))
+	return rw.Code
+}
+
+// revocationJWT signs a revocation of attestation id identified by jti.
+func revocationJWT(t *testing.T, id int64, jti string) string {
+	return testJWT(t, algES256K, map[string]interface{}{
+		"jti": jti,
+		"exp": float64(time.Now().Unix() + 300),
+		"context": map[string]interface{}{
+			"attestantPublicKey": testPublicKey(t, algES256K),
+			"attestationID":      strconv.FormatInt(id, 10),
+			"reason":             "Document withdrawn.",
+		},
+	})
+}
+
+func TestRevokeAttestation(t *testing.T) {
+	useTestConfig()
+	claim := &Claim{Proxy: testUserProxy, Type: "EMAIL", Status: string(ClaimApproved)}
+	Storage().Claims().Create(claim, nil)
+	signed := testJWT(t, algES256K, map[string]interface{}{
+		"context": map[string]interface{}{"attestantPublicKey": testPublicKey(t, algES256K)},
+	})
+	attestations := []*Attestation{}
+	for _, attestant := range []string{"idhub", "bank"} {
+		attestation := &Attestation{ClaimID: claim.ID, Attestant: attestant, Attestation: signed, Status: attestationActive}
+		Storage().Attestations().Create(attestation)
+		attestations = append(attestations, attestation)
+	}
+	first := revocationJWT(t, attestations[0].ID, "1")
+	steps := []struct {
+		name   string
+		method string
+		token  string
+		id     int64
+		want   int
+		claim  ClaimStatus
+	}{
+		{"wrong method", "GET", first, attestations[0].ID, 405, ClaimApproved},
+		{"first attestation", "POST", first, attestations[0].ID, 200, ClaimApproved},
+		{"replay", "POST", first, attestations[0].ID, 401, ClaimApproved},
+		{"already revoked", "POST", revocationJWT(t, attestations[0].ID, "2"), attestations[0].ID, 409, ClaimApproved},
+		{"last attestation", "POST", revocationJWT(t, attestations[1].ID, "3"), attestations[1].ID, 200, ClaimRevoked},
+	}
+	for _, step := range steps {
+		if code := postRevocation(t, step.method, step.token, step.id); code != step.want {
+			t.Errorf("%s: status = %d, want %d", step.name, code, step.want)
+		}
+		if stored, _ := Storage().Claims().Find(claim.ID); stored.Status != string(step.claim) {
+			t.Errorf("%s: claim status = %s, want %s", step.name, stored.Status, step.claim)
+		}
+	}
+	events, _ := Storage().ClaimEvents().List(claim.ID)
+	if len(events) != 1 || events[0].To != string(ClaimRevoked) || events[0].Actor != "bank" {
+		t.Errorf("claim events = %v, want one revocation by bank", events)
+	}
+}
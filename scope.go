@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// scopeAttestationPrefix introduces an attestation scope such as
+// attestation:ID, which releases the user's approved attestation of that
+// claim type.
+const scopeAttestationPrefix = "attestation:"
+
+// userScopes maps each user field that can be requested to the value it
+// releases.
+var userScopes = map[string]func(*User) string{
+	"address":     func(u *User) string { return u.Address },
+	"controller":  func(u *User) string { return u.Controller },
+	"created":     func(u *User) string { return u.Created },
+	"description": func(u *User) string { return u.Description },
+	"email":       func(u *User) string { return u.Email },
+	"ID":          func(u *User) string { return u.IDNumber },
+	"ipfs":        func(u *User) string { return u.IPFS },
+	"name":        func(u *User) string { return u.Name },
+	"phone":       func(u *User) string { return u.Phone },
+	"proxy":       func(u *User) string { return u.Proxy },
+	"publicKey":   func(u *User) string { return u.PublicKey },
+	"recovery":    func(u *User) string { return u.Recovery },
+	"updated":     func(u *User) string { return u.Updated },
+}
+
+var claimTypePattern = regexp.MustCompile(`^[A-Z0-9_]{1,30}$`)
+
+// ScopeItem is one requested user field or attestation. Optional items may
+// be declined by the user; the others must be approved.
+type ScopeItem struct {
+	Name        string
+	Attestation string
+	Optional    bool
+}
+
+func (i ScopeItem) key() string {
+	if len(i.Attestation) > 0 {
+		return scopeAttestationPrefix + i.Attestation
+	}
+	return i.Name
+}
+
+func (i ScopeItem) String() string {
+	if i.Optional {
+		return i.key() + "?"
+	}
+	return i.key()
+}
+
+// Scope is a parsed scope string. Items are space or comma separated; a
+// trailing "?" marks an item optional and a trailing "!" required, which is
+// also the default.
+type Scope []ScopeItem
+
+func parseScope(value string) (Scope, error) {
+	scope := Scope{}
+	seen := map[string]int{}
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	for _, field := range fields {
+		item := ScopeItem{}
+		if strings.HasSuffix(field, "?") {
+			item.Optional = true
+			field = strings.TrimSuffix(field, "?")
+		} else {
+			field = strings.TrimSuffix(field, "!")
+		}
+		if strings.HasPrefix(field, scopeAttestationPrefix) {
+			item.Attestation = strings.TrimPrefix(field, scopeAttestationPrefix)
+			if !claimTypePattern.MatchString(item.Attestation) {
+				return nil, fmt.Errorf("invalid attestation scope %s", field)
+			}
+		} else if _, ok := userScopes[field]; ok {
+			item.Name = field
+		} else {
+			return nil, fmt.Errorf("unknown scope %s", field)
+		}
+		if i, ok := seen[item.key()]; ok {
+			scope[i].Optional = scope[i].Optional && item.Optional
+			continue
+		}
+		seen[item.key()] = len(scope)
+		scope = append(scope, item)
+	}
+	return scope, nil
+}
+
+// String returns the canonical form of the scope.
+func (s Scope) String() string {
+	items := []string{}
+	for _, item := range s {
+		items = append(items, item.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (s Scope) find(key string) (ScopeItem, bool) {
+	for _, item := range s {
+		if item.key() == key {
+			return item, true
+		}
+	}
+	return ScopeItem{}, false
+}
+
+// userFields lists the requested user fields in request order.
+func (s Scope) userFields() []string {
+	names := []string{}
+	for _, item := range s {
+		if len(item.Name) > 0 {
+			names = append(names, item.Name)
+		}
+	}
+	return names
+}
+
+// attestations lists the requested attestation types in request order.
+func (s Scope) attestations() []string {
+	types := []string{}
+	for _, item := range s {
+		if len(item.Attestation) > 0 {
+			types = append(types, item.Attestation)
+		}
+	}
+	return types
+}
+
+// accepts reports whether approved is a valid answer to the issued scope s:
+// it may drop optional items but must keep every required one and add
+// nothing.
+func (s Scope) accepts(approved Scope) bool {
+	for _, item := range approved {
+		if _, ok := s.find(item.key()); !ok {
+			return false
+		}
+	}
+	for _, item := range s {
+		if _, ok := approved.find(item.key()); !ok && !item.Optional {
+			return false
+		}
+	}
+	return true
+}
+
+// exceeds returns the first item of s outside allowed, which lists scope
+// items without markers, if any.
+func (s Scope) exceeds(allowed []string) string {
+	set := map[string]bool{}
+	for _, item := range allowed {
+		set[item] = true
+	}
+	for _, item := range s {
+		if !set[item.key()] {
+			return item.key()
+		}
+	}
+	return ""
+}
+
+// within returns the items of s covered by granted, or false when granted
+// lacks a required item of s.
+func (s Scope) within(granted Scope) (Scope, bool) {
+	covered := Scope{}
+	for _, item := range s {
+		if _, ok := granted.find(item.key()); ok {
+			covered = append(covered, item)
+		} else if !item.Optional {
+			return nil, false
+		}
+	}
+	return covered, true
+}
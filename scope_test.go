@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"name", "name"},
+		{"name,email", "name,email"},
+		{"name email\tphone\nID", "name,email,phone,ID"},
+		{"name?,email!", "name?,email"},
+		{"attestation:ID_CARD?", "attestation:ID_CARD?"},
+		{"name,,email", "name,email"},
+		{"name?,name", "name"},
+		{"name?,name?", "name?"},
+		{"attestation:EMAIL attestation:EMAIL?", "attestation:EMAIL"},
+	}
+	for _, test := range tests {
+		scope, err := parseScope(test.value)
+		if err != nil {
+			t.Errorf("parseScope(%q): %v", test.value, err)
+		} else if scope.String() != test.want {
+			t.Errorf("parseScope(%q) = %q, want %q", test.value, scope.String(), test.want)
+		}
+	}
+}
+
+func TestParseScopeRejects(t *testing.T) {
+	for _, value := range []string{
+		"password",
+		"Name",
+		"name,privateKey",
+		"attestation:",
+		"attestation:email",
+		"attestation:ID-CARD",
+		"attestation:ABCDEFGHIJKLMNOPQRSTUVWXYZ01234",
+		"name??",
+		"?",
+	} {
+		if scope, err := parseScope(value); err == nil {
+			t.Errorf("parseScope(%q) = %q, want an error", value, scope.String())
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// seconds returns value seconds, or fallback when value is not set.
+func seconds(value int, fallback time.Duration) time.Duration {
+	if value > 0 {
+		return time.Duration(value) * time.Second
+	}
+	return fallback
+}
+
+// serverConfig returns the configured server limits; unset values keep
+// their defaults.
+func serverConfig() ServerConfig {
+	cfg := ServerConfig{}
+	if Config().Server != nil {
+		cfg = *Config().Server
+	}
+	if cfg.MaxHeaderBytes <= 0 {
+		cfg.MaxHeaderBytes = 64 << 10
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 1 << 20
+	}
+	return cfg
+}
+
+// limitBody caps the size of every request body at limit bytes.
+func limitBody(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			result := map[string]interface{}{}
+			result["error"] = []string{}
+			setAPIError(tooLarge("Request body exceeds "+strconv.FormatInt(limit, 10)+" bytes."), result)
+			nodes := map[string]interface{}{}
+			nodes["result"] = result
+			rw.Header().Set("Access-Control-Allow-Origin", "*")
+			setResponse(rw, nodes)
+			return
+		}
+		r.Body = http.MaxBytesReader(rw, r.Body, limit)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// newServer returns the HTTP server for addr. Read and write deadlines
+// are off unless configured: they also apply to hijacked socket.io
+// connections, which never reset them, and to /oauth/authorize/wait. Slow
+// clients are bounded by the header timeout and body limit, upstream calls
+// and token waits by their own timeouts.
+func newServer(addr string, handler http.Handler) *http.Server {
+	cfg := serverConfig()
+	return &http.Server{
+		Addr:              addr,
+		Handler:           limitBody(handler, cfg.MaxBodyBytes),
+		ReadHeaderTimeout: seconds(cfg.ReadHeaderTimeout, 10*time.Second),
+		ReadTimeout:       seconds(cfg.ReadTimeout, 0),
+		WriteTimeout:      seconds(cfg.WriteTimeout, 0),
+		IdleTimeout:       seconds(cfg.IdleTimeout, 120*time.Second),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// serve runs s until SIGINT or SIGTERM. It then stops accepting
+// connections, wakes the websocket clients and long polls waiting on
+// tokens, drains in-flight requests and websocket handlers within the
+// shutdown timeout and closes the database.
+func serve(s *http.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- s.ListenAndServe()
+	}()
+	logInfo(nil, "http.Start ok", fields{"addr": s.Addr})
+
+	select {
+	case err := <-failed:
+		logFatal(nil, "http server error", fields{"error": err})
+	case sig := <-stop:
+		logInfo(nil, "shutting down", fields{"signal": sig.String()})
+	}
+	timeout := seconds(serverConfig().ShutdownTimeout, 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	hub.shutdown()
+	if err := s.Shutdown(ctx); err != nil {
+		logError(nil, "shutdown error", fields{"error": err})
+	}
+	// Websockets are hijacked and not drained by Shutdown. Their handlers
+	// read the store, so it stays open unless they all return in time.
+	drained := hub.drain(ctx)
+	spans.flush(ctx)
+	if !drained {
+		logError(nil, "websocket handlers still running, database left open", nil)
+	} else if err := Storage().Close(); err != nil {
+		logError(nil, "close database error", fields{"error": err})
+	}
+	logInfo(nil, "shutdown complete", nil)
+}
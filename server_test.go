@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	useTestConfig()
+	handler := limitBody(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}), 4)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("POST", "/api/v1/claims/add", strings.NewReader("too large")))
+	response := struct {
+		Error *APIError `json:"error"`
+	}{}
+	json.Unmarshal(rw.Body.Bytes(), &response)
+	if rw.Code != http.StatusRequestEntityTooLarge || response.Error == nil || response.Error.Code != codeTooLarge {
+		t.Errorf("got %d %s, want 413 %s", rw.Code, rw.Body.String(), codeTooLarge)
+	}
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("POST", "/api/v1/claims/add", strings.NewReader("ok")))
+	if rw.Code != http.StatusOK {
+		t.Errorf("small body answered %d", rw.Code)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Database drivers accepted in DBConfig.Driver.
+const (
+	driverMemory = "memory"
+	driverMySQL  = "mysql"
+	driverSQLite = "sqlite3"
+)
+
+var (
+	errConflict = errors.New("record was modified concurrently")
+	errNotFound = errors.New("record not found")
+)
+
+// User ...
+type User struct {
+	ID          int64
+	Name        string
+	IDNumber    string
+	Phone       string
+	Email       string
+	PrivateKey  string
+	PublicKey   string
+	Address     string
+	Proxy       string
+	Controller  string
+	Recovery    string
+	IPFS        string
+	Description string
+	Guardians   []string
+	Rotated     string
+	Created     string
+	Updated     string
+}
+
+// Token ...
+type Token struct {
+	Token    string
+	Type     string
+	Valid    bool
+	Proxy    string
+	Scope    string
+	Client   string
+	Expires  string
+	Consumed string
+	Created  string
+}
+
+// Claim ...
+type Claim struct {
+	ID      int64
+	Proxy   string
+	Type    string
+	Status  string
+	Claim   string
+	Created string
+	Updated string
+}
+
+// ClaimCount is the number of claims of one type in one status.
+type ClaimCount struct {
+	Status string
+	Type   string
+	Total  int
+}
+
+// Attestation ...
+type Attestation struct {
+	ID          int64
+	ClaimID     int64
+	Attestant   string
+	Attestation string
+	Status      string
+	Reason      string
+	Revoked     string
+	Created     string
+	Updated     string
+}
+
+// Client is a registered relying party.
+type Client struct {
+	ID           int64
+	Name         string
+	PublicKeys   []string
+	Scopes       []string
+	RedirectURLs []string
+	Status       string
+	Created      string
+	Updated      string
+}
+
+// Consent records the fields a user disclosed to a requester. Evidence is
+// the signed JWT in which the user approved the disclosure. An active
+// consent stands for later requests of the same requester until revoked.
+type Consent struct {
+	ID        int64
+	Proxy     string
+	Requester string
+	Scope     string
+	Evidence  string
+	Status    string
+	Created   string
+	Revoked   string
+}
+
+// AuthRequest is a pending OpenID Connect authorization. It is keyed by the
+// login token the user validates; Code is set once the user has logged in
+// and Redeemed once the code has been exchanged.
+type AuthRequest struct {
+	Token       string
+	Client      string
+	RedirectURI string
+	Scope       string
+	State       string
+	Nonce       string
+	Challenge   string
+	Code        string
+	Proxy       string
+	Expires     string
+	Created     string
+	Redeemed    string
+}
+
+// Recovery is a request of a user's guardians to move the user's proxy to
+// a new key. It may be executed once enough guardians approved it and the
+// recovery delay, which ends at Executable, has passed.
+type Recovery struct {
+	ID         int64
+	Proxy      string
+	PublicKey  string
+	Address    string
+	Approvals  []string
+	Status     string
+	Executable string
+	Created    string
+	Updated    string
+}
+
+// UserStore persists registered users.
+type UserStore interface {
+	Create(user *User) error
+	FindByProxy(proxy string) (*User, error)
+	FindByPublicKey(publicKey string) (*User, error)
+	// ListPrivateKeys returns the users that still have a private key stored.
+	ListPrivateKeys() ([]*User, error)
+	// UpdatePrivateKey replaces a stored private key; an empty value clears it.
+	UpdatePrivateKey(id int64, privateKey string, updated string) error
+	// RotateKey replaces the key and address of the user at proxy, which
+	// must still hold oldPublicKey, and in the same transaction invalidates
+	// the tokens and authorization codes still outstanding for proxy. It
+	// returns errConflict when the key has changed or publicKey belongs to
+	// another user.
+	RotateKey(proxy string, oldPublicKey string, publicKey string, address string, rotated string) error
+	SetGuardians(proxy string, guardians []string, updated string) error
+	// SetIPFS records the CID of the profile proxy published last.
+	SetIPFS(proxy string, cid string, updated string) error
+}
+
+// TokenStore persists login, claim and authorization tokens.
+type TokenStore interface {
+	Find(token string) (*Token, error)
+	// Issue stores a newly minted token. It returns errConflict when the
+	// token already exists.
+	Issue(token *Token) error
+	// Consume records the outcome of validating a token of type kind and
+	// narrows its scope to the one the user approved. It returns
+	// errConflict unless the token is unconsumed and expires no earlier
+	// than consumed.
+	Consume(token string, kind string, proxy string, scope string, valid bool, consumed string) error
+}
+
+// ClientStore persists the registered relying parties.
+type ClientStore interface {
+	// Create stores a new client. It returns errConflict when the name is
+	// already registered.
+	Create(client *Client) error
+	Find(name string) (*Client, error)
+	List() ([]*Client, error)
+	Update(client *Client) error
+}
+
+// ConsentStore persists the consent history of users.
+type ConsentStore interface {
+	Create(consent *Consent) error
+	// FindActive returns the latest active consent of proxy for requester.
+	FindActive(proxy string, requester string) (*Consent, error)
+	// List returns the consents of proxy, newest first, optionally only
+	// those for requester.
+	List(proxy string, requester string) ([]*Consent, error)
+	// Revoke revokes the active consents of proxy for requester and returns
+	// how many were revoked.
+	Revoke(proxy string, requester string, revoked string) (int64, error)
+}
+
+// AuthRequestStore persists pending OpenID Connect authorizations.
+type AuthRequestStore interface {
+	Create(request *AuthRequest) error
+	Find(token string) (*AuthRequest, error)
+	FindByCode(code string) (*AuthRequest, error)
+	// Complete attaches code to the request for token once proxy has logged
+	// in with scope. It returns errConflict when a code was already set.
+	Complete(token string, code string, proxy string, scope string, expires string) error
+	// Redeem marks code as exchanged and returns its request. It returns
+	// errConflict unless the code is unredeemed and expires no earlier than
+	// redeemed.
+	Redeem(code string, redeemed string) (*AuthRequest, error)
+}
+
+// RecoveryStore persists account recoveries. A user has at most one
+// pending recovery.
+type RecoveryStore interface {
+	// Create stores a pending recovery. It returns errConflict when the
+	// user already has one.
+	Create(recovery *Recovery) error
+	Find(id int64) (*Recovery, error)
+	FindPending(proxy string) (*Recovery, error)
+	// Approve replaces the approvals of a pending recovery, which must still
+	// be those of recovery, and sets its end of delay. It returns
+	// errConflict otherwise.
+	Approve(recovery *Recovery, approvals []string, executable string, updated string) error
+	// Cancel marks a pending recovery cancelled. It returns errConflict
+	// unless the recovery is pending.
+	Cancel(id int64, updated string) error
+	// Execute rotates the key of the recovered user like
+	// UserStore.RotateKey and marks the recovery executed, in one
+	// transaction. It returns errConflict unless the recovery is pending.
+	Execute(id int64, oldPublicKey string, updated string) error
+}
+
+// ReplayStore remembers the JWTs that have been accepted until they expire.
+type ReplayStore interface {
+	// Record stores jti until expires and forgets entries expired by now. It
+	// returns errConflict when jti has already been recorded.
+	Record(jti string, expires string, now string) error
+}
+
+// ClaimStore persists claims submitted by users.
+type ClaimStore interface {
+	Count(status string, claimType string) (int, error)
+	// Counts returns the number of claims of every status and type.
+	Counts() ([]*ClaimCount, error)
+	// Create stores claim and, unless event is nil, records event for it
+	// in the same transaction.
+	Create(claim *Claim, event *ClaimEvent) error
+	Find(id int64) (*Claim, error)
+	FindByContent(proxy string, claimType string, content string) (*Claim, error)
+	FindByStatus(proxy string, claimType string, status string) (*Claim, error)
+	FindLatest(proxy string, claimType string) (*Claim, error)
+	List(status string, claimType string, limit int, offset int) ([]*Claim, error)
+	// Transition moves a claim from status from to status to, replacing its
+	// content when content is not empty, and records event in the same
+	// transaction. It returns errConflict when the claim is no longer in
+	// status from.
+	Transition(id int64, from string, to string, content string, event *ClaimEvent) error
+	// Attest applies the decision of an attestant in one transaction: it
+	// moves claim id from status from to status to, records event and,
+	// unless attestation is nil, creates attestation when its ID is 0,
+	// revokes it when its status is REVOKED and otherwise replaces its JWT
+	// and status. It returns errConflict when the claim is no longer in
+	// status from.
+	Attest(id int64, from string, to string, event *ClaimEvent, attestation *Attestation) error
+}
+
+// ClaimEventStore persists the transition history of claims.
+type ClaimEventStore interface {
+	Create(event *ClaimEvent) error
+	List(claimID int64) ([]*ClaimEvent, error)
+}
+
+// AttestationStore persists attestations issued for claims.
+type AttestationStore interface {
+	Create(attestation *Attestation) error
+	Find(id int64) (*Attestation, error)
+	FindByAttestant(claimID int64, attestant string) (*Attestation, error)
+	FindByClaim(claimID int64) (*Attestation, error)
+	FindLatest(claimID int64, status string) (*Attestation, error)
+	ListRevoked() ([]*Attestation, error)
+	// Revoke marks an ACTIVE attestation as REVOKED. Unless event is nil,
+	// the same transaction moves claim event.ClaimID from event.From to
+	// event.To and records event, provided the claim is in event.From and
+	// no other attestation of it is still active; event.ID stays 0
+	// otherwise. It returns errConflict when the attestation is not active.
+	Revoke(id int64, reason string, revoked string, event *ClaimEvent) error
+}
+
+// Store groups the repositories of every persisted entity. Find methods
+// return errNotFound when no record matches.
+type Store interface {
+	Users() UserStore
+	Tokens() TokenStore
+	Claims() ClaimStore
+	ClaimEvents() ClaimEventStore
+	Attestations() AttestationStore
+	Replays() ReplayStore
+	Clients() ClientStore
+	Consents() ConsentStore
+	AuthRequests() AuthRequestStore
+	Recoveries() RecoveryStore
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var (
+	storage     Store
+	storageLock = new(sync.RWMutex)
+)
+
+// Storage ...
+func Storage() Store {
+	storageLock.RLock()
+	defer storageLock.RUnlock()
+	return storage
+}
+
+func setStorage(newStorage Store) {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	storage = newStorage
+}
+
+func openStore(db *DBConfig) (Store, error) {
+	if db == nil {
+		return nil, errors.New("database not configured")
+	}
+	switch db.Driver {
+	case "", driverMySQL:
+		return openSQLStore(driverMySQL, db)
+	case driverSQLite:
+		return openSQLStore(driverSQLite, db)
+	case driverMemory:
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unsupported database driver: %s", db.Driver)
+}
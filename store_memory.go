@@ -0,0 +1,802 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// memoryStore implements Store in process memory. Data does not survive a
+// restart; it is meant for local development and tests.
+type memoryStore struct {
+	lock         sync.RWMutex
+	users        []*User
+	tokens       map[string]*Token
+	claims       []*Claim
+	claimEvents  []*ClaimEvent
+	attestations []*Attestation
+	replays      map[string]string
+	clients      []*Client
+	consents     []*Consent
+	authRequests map[string]*AuthRequest
+	recoveries   []*Recovery
+}
+
+type memoryUsers struct{ m *memoryStore }
+type memoryTokens struct{ m *memoryStore }
+type memoryClaims struct{ m *memoryStore }
+type memoryClaimEvents struct{ m *memoryStore }
+type memoryAttestations struct{ m *memoryStore }
+type memoryReplays struct{ m *memoryStore }
+type memoryClients struct{ m *memoryStore }
+type memoryConsents struct{ m *memoryStore }
+type memoryAuthRequests struct{ m *memoryStore }
+type memoryRecoveries struct{ m *memoryStore }
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tokens:       map[string]*Token{},
+		replays:      map[string]string{},
+		authRequests: map[string]*AuthRequest{},
+	}
+}
+
+func (m *memoryStore) Users() UserStore               { return &memoryUsers{m} }
+func (m *memoryStore) Tokens() TokenStore             { return &memoryTokens{m} }
+func (m *memoryStore) Claims() ClaimStore             { return &memoryClaims{m} }
+func (m *memoryStore) ClaimEvents() ClaimEventStore   { return &memoryClaimEvents{m} }
+func (m *memoryStore) Attestations() AttestationStore { return &memoryAttestations{m} }
+func (m *memoryStore) Replays() ReplayStore           { return &memoryReplays{m} }
+func (m *memoryStore) Clients() ClientStore           { return &memoryClients{m} }
+func (m *memoryStore) Consents() ConsentStore         { return &memoryConsents{m} }
+func (m *memoryStore) AuthRequests() AuthRequestStore { return &memoryAuthRequests{m} }
+func (m *memoryStore) Recoveries() RecoveryStore      { return &memoryRecoveries{m} }
+func (m *memoryStore) Ping(ctx context.Context) error { return nil }
+func (m *memoryStore) Close() error                   { return nil }
+
+func (u *memoryUsers) Create(user *User) error {
+	u.m.lock.Lock()
+	defer u.m.lock.Unlock()
+	item := *user
+	item.ID = int64(len(u.m.users) + 1)
+	u.m.users = append(u.m.users, &item)
+	user.ID = item.ID
+	return nil
+}
+
+func (u *memoryUsers) find(match func(*User) bool) (*User, error) {
+	u.m.lock.RLock()
+	defer u.m.lock.RUnlock()
+	for _, user := range u.m.users {
+		if match(user) {
+			item := *user
+			return &item, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (u *memoryUsers) FindByProxy(proxy string) (*User, error) {
+	return u.find(func(user *User) bool { return user.Proxy == proxy })
+}
+
+func (u *memoryUsers) FindByPublicKey(publicKey string) (*User, error) {
+	return u.find(func(user *User) bool { return user.PublicKey == publicKey })
+}
+
+func (u *memoryUsers) ListPrivateKeys() ([]*User, error) {
+	u.m.lock.RLock()
+	defer u.m.lock.RUnlock()
+	users := []*User{}
+	for _, user := range u.m.users {
+		if len(user.PrivateKey) > 0 {
+			item := *user
+			users = append(users, &item)
+		}
+	}
+	return users, nil
+}
+
+func (u *memoryUsers) UpdatePrivateKey(id int64, privateKey string, updated string) error {
+	u.m.lock.Lock()
+	defer u.m.lock.Unlock()
+	for _, user := range u.m.users {
+		if user.ID == id {
+			user.PrivateKey = privateKey
+			user.Updated = updated
+		}
+	}
+	return nil
+}
+
+func (u *memoryUsers) RotateKey(proxy string, oldPublicKey string, publicKey string, address string, rotated string) error {
+	u.m.lock.Lock()
+	defer u.m.lock.Unlock()
+	return u.m.rotateKey(proxy, oldPublicKey, publicKey, address, rotated)
+}
+
+// rotateKey implements UserStore.RotateKey with the lock held.
+func (m *memoryStore) rotateKey(proxy string, oldPublicKey string, publicKey string, address string, rotated string) error {
+	var target *User
+	for _, user := range m.users {
+		if user.Proxy == proxy {
+			target = user
+		} else if user.PublicKey == publicKey {
+			return errConflict
+		}
+	}
+	if target == nil {
+		return errNotFound
+	}
+	if target.PublicKey != oldPublicKey {
+		return errConflict
+	}
+	target.PublicKey = publicKey
+	target.Address = address
+	target.Rotated = rotated
+	target.Updated = rotated
+	for _, token := range m.tokens {
+		if token.Proxy == proxy {
+			token.Valid = false
+		}
+	}
+	for _, request := range m.authRequests {
+		if request.Proxy == proxy && len(request.Redeemed) == 0 {
+			request.Redeemed = rotated
+		}
+	}
+	return nil
+}
+
+func (u *memoryUsers) SetGuardians(proxy string, guardians []string, updated string) error {
+	u.m.lock.Lock()
+	defer u.m.lock.Unlock()
+	for _, user := range u.m.users {
+		if user.Proxy == proxy {
+			user.Guardians = append([]string{}, guardians...)
+			user.Updated = updated
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (u *memoryUsers) SetIPFS(proxy string, cid string, updated string) error {
+	u.m.lock.Lock()
+	defer u.m.lock.Unlock()
+	for _, user := range u.m.users {
+		if user.Proxy == proxy {
+			user.IPFS = cid
+			user.Updated = updated
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (t *memoryTokens) Find(token string) (*Token, error) {
+	t.m.lock.RLock()
+	defer t.m.lock.RUnlock()
+	if item, ok := t.m.tokens[token]; ok {
+		copied := *item
+		return &copied, nil
+	}
+	return nil, errNotFound
+}
+
+func (t *memoryTokens) Issue(token *Token) error {
+	t.m.lock.Lock()
+	defer t.m.lock.Unlock()
+	if _, ok := t.m.tokens[token.Token]; ok {
+		return errConflict
+	}
+	item := *token
+	t.m.tokens[token.Token] = &item
+	return nil
+}
+
+func (t *memoryTokens) Consume(token string, kind string, proxy string, scope string, valid bool, consumed string) error {
+	t.m.lock.Lock()
+	defer t.m.lock.Unlock()
+	item, ok := t.m.tokens[token]
+	if !ok || item.Type != kind || len(item.Consumed) > 0 || item.Expires < consumed {
+		return errConflict
+	}
+	item.Valid = valid
+	item.Proxy = proxy
+	item.Scope = scope
+	item.Consumed = consumed
+	return nil
+}
+
+// filter returns copies of the claims matching match, oldest first.
+func (c *memoryClaims) filter(match func(*Claim) bool) []*Claim {
+	c.m.lock.RLock()
+	defer c.m.lock.RUnlock()
+	claims := []*Claim{}
+	for _, claim := range c.m.claims {
+		if match(claim) {
+			item := *claim
+			claims = append(claims, &item)
+		}
+	}
+	sort.SliceStable(claims, func(i, j int) bool {
+		return claims[i].Created < claims[j].Created
+	})
+	return claims
+}
+
+func (c *memoryClaims) first(match func(*Claim) bool) (*Claim, error) {
+	claims := c.filter(match)
+	if len(claims) == 0 {
+		return nil, errNotFound
+	}
+	return claims[0], nil
+}
+
+func (c *memoryClaims) Count(status string, claimType string) (int, error) {
+	claims := c.filter(func(claim *Claim) bool {
+		return claim.Status == status && claim.Type == claimType
+	})
+	return len(claims), nil
+}
+
+func (c *memoryClaims) Counts() ([]*ClaimCount, error) {
+	c.m.lock.RLock()
+	defer c.m.lock.RUnlock()
+	totals := map[[2]string]*ClaimCount{}
+	counts := []*ClaimCount{}
+	for _, claim := range c.m.claims {
+		key := [2]string{claim.Status, claim.Type}
+		if totals[key] == nil {
+			totals[key] = &ClaimCount{Status: claim.Status, Type: claim.Type}
+			counts = append(counts, totals[key])
+		}
+		totals[key].Total++
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Status != counts[j].Status {
+			return counts[i].Status < counts[j].Status
+		}
+		return counts[i].Type < counts[j].Type
+	})
+	return counts, nil
+}
+
+func (c *memoryClaims) Create(claim *Claim, event *ClaimEvent) error {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	item := *claim
+	item.ID = int64(len(c.m.claims) + 1)
+	c.m.claims = append(c.m.claims, &item)
+	claim.ID = item.ID
+	if event != nil {
+		event.ClaimID = claim.ID
+		c.m.addClaimEvent(event)
+	}
+	return nil
+}
+
+func (c *memoryClaims) Find(id int64) (*Claim, error) {
+	return c.first(func(claim *Claim) bool { return claim.ID == id })
+}
+
+func (c *memoryClaims) FindByContent(proxy string, claimType string, content string) (*Claim, error) {
+	return c.first(func(claim *Claim) bool {
+		return claim.Proxy == proxy && claim.Type == claimType && claim.Claim == content
+	})
+}
+
+func (c *memoryClaims) FindByStatus(proxy string, claimType string, status string) (*Claim, error) {
+	return c.first(func(claim *Claim) bool {
+		return claim.Proxy == proxy && claim.Type == claimType && claim.Status == status
+	})
+}
+
+func (c *memoryClaims) FindLatest(proxy string, claimType string) (*Claim, error) {
+	claims := c.filter(func(claim *Claim) bool {
+		return claim.Proxy == proxy && claim.Type == claimType
+	})
+	if len(claims) == 0 {
+		return nil, errNotFound
+	}
+	return claims[len(claims)-1], nil
+}
+
+func (c *memoryClaims) List(status string, claimType string, limit int, offset int) ([]*Claim, error) {
+	claims := c.filter(func(claim *Claim) bool {
+		return claim.Status == status && claim.Type == claimType
+	})
+	if offset < 0 || offset >= len(claims) {
+		return []*Claim{}, nil
+	}
+	claims = claims[offset:]
+	if limit >= 0 && limit < len(claims) {
+		claims = claims[:limit]
+	}
+	return claims, nil
+}
+
+func (c *memoryClaims) Transition(id int64, from string, to string, content string, event *ClaimEvent) error {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	for _, claim := range c.m.claims {
+		if claim.ID == id && claim.Status == from {
+			claim.Status = to
+			if len(content) > 0 {
+				claim.Claim = content
+			}
+			claim.Updated = event.Created
+			c.m.addClaimEvent(event)
+			return nil
+		}
+	}
+	return errConflict
+}
+
+func (c *memoryClaims) Attest(id int64, from string, to string, event *ClaimEvent, attestation *Attestation) error {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	var claim *Claim
+	for _, item := range c.m.claims {
+		if item.ID == id && item.Status == from {
+			claim = item
+		}
+	}
+	if claim == nil {
+		return errConflict
+	}
+	claim.Status = to
+	claim.Updated = event.Created
+	c.m.addClaimEvent(event)
+	if attestation == nil {
+		return nil
+	}
+	if attestation.ID == 0 {
+		item := *attestation
+		item.ID = int64(len(c.m.attestations) + 1)
+		c.m.attestations = append(c.m.attestations, &item)
+		attestation.ID = item.ID
+		return nil
+	}
+	for _, item := range c.m.attestations {
+		if item.ID != attestation.ID {
+			continue
+		}
+		if attestation.Status != attestationRevoked {
+			item.Attestation = attestation.Attestation
+			item.Status = attestation.Status
+			item.Updated = attestation.Updated
+		} else if item.Status == attestationActive {
+			item.Status = attestationRevoked
+			item.Reason = attestation.Reason
+			item.Revoked = attestation.Revoked
+			item.Updated = attestation.Updated
+		}
+	}
+	return nil
+}
+
+func (e *memoryClaimEvents) Create(event *ClaimEvent) error {
+	e.m.lock.Lock()
+	defer e.m.lock.Unlock()
+	e.m.addClaimEvent(event)
+	return nil
+}
+
+// addClaimEvent stores a copy of event. The caller holds the write lock.
+func (m *memoryStore) addClaimEvent(event *ClaimEvent) {
+	item := *event
+	item.ID = int64(len(m.claimEvents) + 1)
+	m.claimEvents = append(m.claimEvents, &item)
+	event.ID = item.ID
+}
+
+func (e *memoryClaimEvents) List(claimID int64) ([]*ClaimEvent, error) {
+	e.m.lock.RLock()
+	defer e.m.lock.RUnlock()
+	events := []*ClaimEvent{}
+	for _, event := range e.m.claimEvents {
+		if event.ClaimID == claimID {
+			item := *event
+			events = append(events, &item)
+		}
+	}
+	return events, nil
+}
+
+func (a *memoryAttestations) filter(match func(*Attestation) bool) []*Attestation {
+	a.m.lock.RLock()
+	defer a.m.lock.RUnlock()
+	attestations := []*Attestation{}
+	for _, attestation := range a.m.attestations {
+		if match(attestation) {
+			item := *attestation
+			attestations = append(attestations, &item)
+		}
+	}
+	sort.SliceStable(attestations, func(i, j int) bool {
+		return attestations[i].Created < attestations[j].Created
+	})
+	return attestations
+}
+
+func (a *memoryAttestations) Create(attestation *Attestation) error {
+	a.m.lock.Lock()
+	defer a.m.lock.Unlock()
+	item := *attestation
+	item.ID = int64(len(a.m.attestations) + 1)
+	a.m.attestations = append(a.m.attestations, &item)
+	attestation.ID = item.ID
+	return nil
+}
+
+func (a *memoryAttestations) Find(id int64) (*Attestation, error) {
+	attestations := a.filter(func(item *Attestation) bool {
+		return item.ID == id
+	})
+	if len(attestations) == 0 {
+		return nil, errNotFound
+	}
+	return attestations[0], nil
+}
+
+func (a *memoryAttestations) FindByAttestant(claimID int64, attestant string) (*Attestation, error) {
+	attestations := a.filter(func(item *Attestation) bool {
+		return item.ClaimID == claimID && item.Attestant == attestant
+	})
+	if len(attestations) == 0 {
+		return nil, errNotFound
+	}
+	return attestations[0], nil
+}
+
+func (a *memoryAttestations) FindByClaim(claimID int64) (*Attestation, error) {
+	attestations := a.filter(func(item *Attestation) bool {
+		return item.ClaimID == claimID
+	})
+	if len(attestations) == 0 {
+		return nil, errNotFound
+	}
+	return attestations[0], nil
+}
+
+func (a *memoryAttestations) FindLatest(claimID int64, status string) (*Attestation, error) {
+	attestations := a.filter(func(item *Attestation) bool {
+		return item.ClaimID == claimID && item.Status == status
+	})
+	if len(attestations) == 0 {
+		return nil, errNotFound
+	}
+	return attestations[len(attestations)-1], nil
+}
+
+func (a *memoryAttestations) ListRevoked() ([]*Attestation, error) {
+	attestations := a.filter(func(item *Attestation) bool {
+		return item.Status == attestationRevoked
+	})
+	sort.SliceStable(attestations, func(i, j int) bool {
+		return attestations[i].ID < attestations[j].ID
+	})
+	return attestations, nil
+}
+
+func (a *memoryAttestations) Revoke(id int64, reason string, revoked string, event *ClaimEvent) error {
+	a.m.lock.Lock()
+	defer a.m.lock.Unlock()
+	var attestation *Attestation
+	for _, item := range a.m.attestations {
+		if item.ID == id && item.Status == attestationActive {
+			attestation = item
+		}
+	}
+	if attestation == nil {
+		return errConflict
+	}
+	attestation.Status = attestationRevoked
+	attestation.Reason = reason
+	attestation.Revoked = revoked
+	attestation.Updated = revoked
+	if event == nil {
+		return nil
+	}
+	for _, item := range a.m.attestations {
+		if item.ClaimID == event.ClaimID && item.Status == attestationActive {
+			return nil
+		}
+	}
+	for _, claim := range a.m.claims {
+		if claim.ID == event.ClaimID && claim.Status == event.From {
+			claim.Status = event.To
+			claim.Updated = event.Created
+			a.m.addClaimEvent(event)
+		}
+	}
+	return nil
+}
+
+func (p *memoryReplays) Record(jti string, expires string, now string) error {
+	p.m.lock.Lock()
+	defer p.m.lock.Unlock()
+	for key, value := range p.m.replays {
+		if value < now {
+			delete(p.m.replays, key)
+		}
+	}
+	if _, ok := p.m.replays[jti]; ok {
+		return errConflict
+	}
+	p.m.replays[jti] = expires
+	return nil
+}
+
+func copyClient(client *Client) *Client {
+	item := *client
+	item.PublicKeys = append([]string{}, client.PublicKeys...)
+	item.Scopes = append([]string{}, client.Scopes...)
+	item.RedirectURLs = append([]string{}, client.RedirectURLs...)
+	return &item
+}
+
+func (c *memoryClients) Create(client *Client) error {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	for _, item := range c.m.clients {
+		if item.Name == client.Name {
+			return errConflict
+		}
+	}
+	item := copyClient(client)
+	item.ID = int64(len(c.m.clients) + 1)
+	c.m.clients = append(c.m.clients, item)
+	client.ID = item.ID
+	return nil
+}
+
+func (c *memoryClients) Find(name string) (*Client, error) {
+	c.m.lock.RLock()
+	defer c.m.lock.RUnlock()
+	for _, item := range c.m.clients {
+		if item.Name == name {
+			return copyClient(item), nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (c *memoryClients) List() ([]*Client, error) {
+	c.m.lock.RLock()
+	defer c.m.lock.RUnlock()
+	clients := []*Client{}
+	for _, item := range c.m.clients {
+		clients = append(clients, copyClient(item))
+	}
+	sort.SliceStable(clients, func(i, j int) bool {
+		return clients[i].Name < clients[j].Name
+	})
+	return clients, nil
+}
+
+func (c *memoryClients) Update(client *Client) error {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	for i, item := range c.m.clients {
+		if item.Name == client.Name {
+			updated := copyClient(client)
+			updated.ID = item.ID
+			updated.Created = item.Created
+			c.m.clients[i] = updated
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (c *memoryConsents) Create(consent *Consent) error {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	item := *consent
+	item.ID = int64(len(c.m.consents) + 1)
+	c.m.consents = append(c.m.consents, &item)
+	consent.ID = item.ID
+	return nil
+}
+
+func (c *memoryConsents) FindActive(proxy string, requester string) (*Consent, error) {
+	consents, _ := c.List(proxy, requester)
+	for _, item := range consents {
+		if item.Status == consentActive {
+			return item, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (c *memoryConsents) List(proxy string, requester string) ([]*Consent, error) {
+	c.m.lock.RLock()
+	defer c.m.lock.RUnlock()
+	consents := []*Consent{}
+	for i := len(c.m.consents) - 1; i >= 0; i-- {
+		item := *c.m.consents[i]
+		if item.Proxy == proxy && (len(requester) == 0 || item.Requester == requester) {
+			consents = append(consents, &item)
+		}
+	}
+	return consents, nil
+}
+
+func (c *memoryConsents) Revoke(proxy string, requester string, revoked string) (int64, error) {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	count := int64(0)
+	for _, item := range c.m.consents {
+		if item.Proxy == proxy && item.Requester == requester && item.Status == consentActive {
+			item.Status = consentRevoked
+			item.Revoked = revoked
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (a *memoryAuthRequests) Create(request *AuthRequest) error {
+	a.m.lock.Lock()
+	defer a.m.lock.Unlock()
+	if _, ok := a.m.authRequests[request.Token]; ok {
+		return errConflict
+	}
+	item := *request
+	a.m.authRequests[request.Token] = &item
+	return nil
+}
+
+func (a *memoryAuthRequests) Find(token string) (*AuthRequest, error) {
+	a.m.lock.RLock()
+	defer a.m.lock.RUnlock()
+	item, ok := a.m.authRequests[token]
+	if !ok {
+		return nil, errNotFound
+	}
+	request := *item
+	return &request, nil
+}
+
+func (a *memoryAuthRequests) FindByCode(code string) (*AuthRequest, error) {
+	a.m.lock.RLock()
+	defer a.m.lock.RUnlock()
+	for _, item := range a.m.authRequests {
+		if item.Code == code && len(code) > 0 {
+			request := *item
+			return &request, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (a *memoryAuthRequests) Complete(token string, code string, proxy string, scope string, expires string) error {
+	a.m.lock.Lock()
+	defer a.m.lock.Unlock()
+	item, ok := a.m.authRequests[token]
+	if !ok {
+		return errNotFound
+	}
+	if len(item.Code) > 0 {
+		return errConflict
+	}
+	item.Code = code
+	item.Proxy = proxy
+	item.Scope = scope
+	item.Expires = expires
+	return nil
+}
+
+func (a *memoryAuthRequests) Redeem(code string, redeemed string) (*AuthRequest, error) {
+	a.m.lock.Lock()
+	defer a.m.lock.Unlock()
+	for _, item := range a.m.authRequests {
+		if item.Code == code && len(code) > 0 {
+			if len(item.Redeemed) > 0 || item.Expires < redeemed {
+				return nil, errConflict
+			}
+			item.Redeemed = redeemed
+			request := *item
+			return &request, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryRecoveries) Create(recovery *Recovery) error {
+	r.m.lock.Lock()
+	defer r.m.lock.Unlock()
+	for _, item := range r.m.recoveries {
+		if item.Proxy == recovery.Proxy && item.Status == recoveryPending {
+			return errConflict
+		}
+	}
+	item := *recovery
+	item.ID = int64(len(r.m.recoveries) + 1)
+	item.Approvals = append([]string{}, recovery.Approvals...)
+	r.m.recoveries = append(r.m.recoveries, &item)
+	recovery.ID = item.ID
+	return nil
+}
+
+func (r *memoryRecoveries) find(match func(*Recovery) bool) (*Recovery, error) {
+	r.m.lock.RLock()
+	defer r.m.lock.RUnlock()
+	for _, item := range r.m.recoveries {
+		if match(item) {
+			recovery := *item
+			recovery.Approvals = append([]string{}, item.Approvals...)
+			return &recovery, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryRecoveries) Find(id int64) (*Recovery, error) {
+	return r.find(func(item *Recovery) bool { return item.ID == id })
+}
+
+func (r *memoryRecoveries) FindPending(proxy string) (*Recovery, error) {
+	return r.find(func(item *Recovery) bool {
+		return item.Proxy == proxy && item.Status == recoveryPending
+	})
+}
+
+// pending returns the pending recovery id with the lock held.
+func (r *memoryRecoveries) pending(id int64) (*Recovery, error) {
+	for _, item := range r.m.recoveries {
+		if item.ID == id {
+			if item.Status != recoveryPending {
+				return nil, errConflict
+			}
+			return item, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryRecoveries) Approve(recovery *Recovery, approvals []string, executable string, updated string) error {
+	r.m.lock.Lock()
+	defer r.m.lock.Unlock()
+	item, err := r.pending(recovery.ID)
+	if err != nil {
+		return err
+	}
+	if encodeList(item.Approvals) != encodeList(recovery.Approvals) {
+		return errConflict
+	}
+	item.Approvals = append([]string{}, approvals...)
+	item.Executable = executable
+	item.Updated = updated
+	return nil
+}
+
+func (r *memoryRecoveries) Cancel(id int64, updated string) error {
+	r.m.lock.Lock()
+	defer r.m.lock.Unlock()
+	item, err := r.pending(id)
+	if err != nil {
+		return err
+	}
+	item.Status = recoveryCancelled
+	item.Updated = updated
+	return nil
+}
+
+func (r *memoryRecoveries) Execute(id int64, oldPublicKey string, updated string) error {
+	r.m.lock.Lock()
+	defer r.m.lock.Unlock()
+	item, err := r.pending(id)
+	if err != nil {
+		return err
+	}
+	if err := r.m.rotateKey(item.Proxy, oldPublicKey, item.PublicKey, item.Address, updated); err != nil {
+		return err
+	}
+	item.Status = recoveryExecuted
+	item.Updated = updated
+	return nil
+}
@@ -0,0 +1,1054 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/astaxie/beego/orm"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"time"
+)
+
+// sqlStore implements Store on top of the beego ORM. MySQL tables live in
+// the `vchain` schema; SQLite keeps them in the main database file.
+type sqlStore struct {
+	driver string
+}
+
+type sqlUsers struct{ s *sqlStore }
+type sqlTokens struct{ s *sqlStore }
+type sqlClaims struct{ s *sqlStore }
+type sqlClaimEvents struct{ s *sqlStore }
+type sqlAttestations struct{ s *sqlStore }
+type sqlReplays struct{ s *sqlStore }
+type sqlClients struct{ s *sqlStore }
+type sqlConsents struct{ s *sqlStore }
+type sqlAuthRequests struct{ s *sqlStore }
+type sqlRecoveries struct{ s *sqlStore }
+
+func openSQLStore(driver string, db *DBConfig) (Store, error) {
+	err := orm.RegisterDataBase("default", driver, db.Address, db.Idle, db.Max)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{driver: driver}
+	if db.Migrate {
+		m := &migrator{s: s}
+		if _, err := m.Up(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *sqlStore) orm() orm.Ormer {
+	return orm.NewOrm()
+}
+
+func (s *sqlStore) table(name string) string {
+	if s.driver == driverMySQL {
+		return "`vchain`.`" + name + "`"
+	}
+	return "`" + name + "`"
+}
+
+// insertIgnore starts an INSERT that skips rows violating a unique key.
+func (s *sqlStore) insertIgnore(name string) string {
+	if s.driver == driverMySQL {
+		return "INSERT IGNORE INTO " + s.table(name)
+	}
+	return "INSERT OR IGNORE INTO " + s.table(name)
+}
+
+func (s *sqlStore) Users() UserStore               { return &sqlUsers{s} }
+func (s *sqlStore) Tokens() TokenStore             { return &sqlTokens{s} }
+func (s *sqlStore) Claims() ClaimStore             { return &sqlClaims{s} }
+func (s *sqlStore) ClaimEvents() ClaimEventStore   { return &sqlClaimEvents{s} }
+func (s *sqlStore) Attestations() AttestationStore { return &sqlAttestations{s} }
+func (s *sqlStore) Replays() ReplayStore           { return &sqlReplays{s} }
+func (s *sqlStore) Clients() ClientStore           { return &sqlClients{s} }
+func (s *sqlStore) Consents() ConsentStore         { return &sqlConsents{s} }
+func (s *sqlStore) AuthRequests() AuthRequestStore { return &sqlAuthRequests{s} }
+func (s *sqlStore) Recoveries() RecoveryStore      { return &sqlRecoveries{s} }
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	db, err := orm.GetDB("default")
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	db, err := orm.GetDB("default")
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func rowString(row orm.Params, key string) string {
+	value, _ := row[key].(string)
+	return value
+}
+
+func rowInt64(row orm.Params, key string) int64 {
+	value, _ := strconv.ParseInt(rowString(row, key), 10, 64)
+	return value
+}
+
+func (s *sqlStore) queryRow(sql string, args ...interface{}) (orm.Params, error) {
+	rows := []orm.Params{}
+	start := time.Now()
+	num, err := s.orm().Raw(sql, args...).Values(&rows)
+	observeQuery("query", start, err)
+	if err != nil {
+		return nil, err
+	} else if num == 0 {
+		return nil, errNotFound
+	}
+	return rows[0], nil
+}
+
+func (s *sqlStore) query(sql string, args ...interface{}) ([]orm.Params, error) {
+	rows := []orm.Params{}
+	start := time.Now()
+	_, err := s.orm().Raw(sql, args...).Values(&rows)
+	observeQuery("query", start, err)
+	return rows, err
+}
+
+func (s *sqlStore) exec(sql string, args ...interface{}) (int64, error) {
+	start := time.Now()
+	res, err := s.orm().Raw(sql, args...).Exec()
+	observeQuery("exec", start, err)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *sqlStore) update(sql string, args ...interface{}) (int64, error) {
+	return updateWith(s.orm(), sql, args...)
+}
+
+func updateWith(o orm.Ormer, sql string, args ...interface{}) (int64, error) {
+	start := time.Now()
+	res, err := o.Raw(sql, args...).Exec()
+	observeQuery("update", start, err)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// transaction runs fn in a transaction, which is committed unless fn fails.
+func (s *sqlStore) transaction(fn func(o orm.Ormer) error) error {
+	o := s.orm()
+	start := time.Now()
+	if err := o.Begin(); err != nil {
+		observeQuery("transaction", start, err)
+		return err
+	}
+	if err := fn(o); err != nil {
+		o.Rollback()
+		observeQuery("transaction", start, err)
+		return err
+	}
+	err := o.Commit()
+	observeQuery("transaction", start, err)
+	return err
+}
+
+const userColumns = "id, name, idnumber, phone, email, privatekey, publickey, address" +
+	", proxy, controller, recovery, ipfs, description, guardians, rotated, created, updated"
+
+func userFromRow(row orm.Params) *User {
+	return &User{
+		ID:          rowInt64(row, "id"),
+		Name:        rowString(row, "name"),
+		IDNumber:    rowString(row, "idnumber"),
+		Phone:       rowString(row, "phone"),
+		Email:       rowString(row, "email"),
+		PrivateKey:  rowString(row, "privatekey"),
+		PublicKey:   rowString(row, "publickey"),
+		Address:     rowString(row, "address"),
+		Proxy:       rowString(row, "proxy"),
+		Controller:  rowString(row, "controller"),
+		Recovery:    rowString(row, "recovery"),
+		IPFS:        rowString(row, "ipfs"),
+		Description: rowString(row, "description"),
+		Guardians:   decodeList(rowString(row, "guardians")),
+		Rotated:     rowString(row, "rotated"),
+		Created:     rowString(row, "created"),
+		Updated:     rowString(row, "updated"),
+	}
+}
+
+func (u *sqlUsers) Create(user *User) error {
+	sql := "INSERT INTO " + u.s.table("users") + "(`name`, `phone`,"
+	sql += "`privatekey`, `publickey`, `address`, `proxy`,"
+	sql += "`controller`, `recovery`, `created`, `updated`) VALUES("
+	sql += "?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	id, err := u.s.exec(sql, user.Name, user.Phone, user.PrivateKey,
+		user.PublicKey, user.Address, user.Proxy, user.Controller,
+		user.Recovery, user.Created, user.Updated)
+	if err != nil {
+		return err
+	}
+	user.ID = id
+	return nil
+}
+
+func (u *sqlUsers) FindByProxy(proxy string) (*User, error) {
+	sql := "SELECT " + userColumns + " FROM " + u.s.table("users")
+	sql += " WHERE proxy = ? LIMIT 1"
+	row, err := u.s.queryRow(sql, proxy)
+	if err != nil {
+		return nil, err
+	}
+	return userFromRow(row), nil
+}
+
+func (u *sqlUsers) FindByPublicKey(publicKey string) (*User, error) {
+	sql := "SELECT " + userColumns + " FROM " + u.s.table("users")
+	sql += " WHERE publickey = ? LIMIT 1"
+	row, err := u.s.queryRow(sql, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return userFromRow(row), nil
+}
+
+func (u *sqlUsers) ListPrivateKeys() ([]*User, error) {
+	sql := "SELECT " + userColumns + " FROM " + u.s.table("users")
+	sql += " WHERE privatekey IS NOT NULL AND privatekey <> '' ORDER BY id"
+	rows, err := u.s.query(sql)
+	if err != nil {
+		return nil, err
+	}
+	users := []*User{}
+	for _, row := range rows {
+		users = append(users, userFromRow(row))
+	}
+	return users, nil
+}
+
+func (u *sqlUsers) UpdatePrivateKey(id int64, privateKey string, updated string) error {
+	sql := "UPDATE " + u.s.table("users")
+	sql += " SET privatekey = NULLIF(?, ''), updated = ? WHERE id = ?"
+	_, err := u.s.update(sql, privateKey, updated, id)
+	return err
+}
+
+func (u *sqlUsers) RotateKey(proxy string, oldPublicKey string, publicKey string, address string, rotated string) error {
+	return u.s.transaction(func(o orm.Ormer) error {
+		return u.s.rotateKey(o, proxy, oldPublicKey, publicKey, address, rotated)
+	})
+}
+
+// rotateKey implements UserStore.RotateKey within the transaction of o.
+func (s *sqlStore) rotateKey(o orm.Ormer, proxy string, oldPublicKey string, publicKey string, address string, rotated string) error {
+	rows := []orm.Params{}
+	sql := "SELECT proxy, publickey FROM " + s.table("users") + " WHERE proxy = ? OR publickey = ?"
+	if _, err := o.Raw(sql, proxy, publicKey).Values(&rows); err != nil {
+		return err
+	}
+	found := false
+	for _, row := range rows {
+		if rowString(row, "proxy") != proxy {
+			return errConflict
+		}
+		found = true
+	}
+	if !found {
+		return errNotFound
+	}
+	sql = "UPDATE " + s.table("users") + " SET `publickey` = ?, `address` = ?,"
+	sql += " `rotated` = ?, `updated` = ? WHERE proxy = ? AND publickey = ?"
+	count, err := updateWith(o, sql, publicKey, address, rotated, rotated, proxy, oldPublicKey)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errConflict
+	}
+	sql = "UPDATE " + s.table("tokens") + " SET `valid` = ? WHERE proxy = ? AND valid = ?"
+	if _, err := updateWith(o, sql, false, proxy, true); err != nil {
+		return err
+	}
+	sql = "UPDATE " + s.table("oidc_requests") + " SET `redeemed` = ?"
+	sql += " WHERE proxy = ? AND redeemed IS NULL"
+	_, err = updateWith(o, sql, rotated, proxy)
+	return err
+}
+
+func (u *sqlUsers) SetGuardians(proxy string, guardians []string, updated string) error {
+	sql := "UPDATE " + u.s.table("users")
+	sql += " SET `guardians` = ?, `updated` = ? WHERE proxy = ?"
+	count, err := u.s.update(sql, encodeList(guardians), updated, proxy)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (u *sqlUsers) SetIPFS(proxy string, cid string, updated string) error {
+	sql := "UPDATE " + u.s.table("users")
+	sql += " SET `ipfs` = ?, `updated` = ? WHERE proxy = ?"
+	count, err := u.s.update(sql, cid, updated, proxy)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (t *sqlTokens) Find(token string) (*Token, error) {
+	sql := "SELECT token, type, valid, proxy, scope, client, expires, consumed, created"
+	sql += " FROM " + t.s.table("tokens") + " WHERE token = ? LIMIT 1"
+	row, err := t.s.queryRow(sql, token)
+	if err != nil {
+		return nil, err
+	}
+	item := &Token{
+		Token:    rowString(row, "token"),
+		Type:     rowString(row, "type"),
+		Valid:    rowString(row, "valid") == "1",
+		Proxy:    rowString(row, "proxy"),
+		Scope:    rowString(row, "scope"),
+		Client:   rowString(row, "client"),
+		Expires:  rowString(row, "expires"),
+		Consumed: rowString(row, "consumed"),
+		Created:  rowString(row, "created"),
+	}
+	return item, nil
+}
+
+func (t *sqlTokens) Issue(token *Token) error {
+	sql := t.s.insertIgnore("tokens") + "(`token`, `type`, `valid`,"
+	sql += "`proxy`, `scope`, `client`, `expires`, `created`) VALUES("
+	sql += "?, ?, ?, ?, ?, ?, ?, ?)"
+	count, err := t.s.update(sql, token.Token, token.Type, token.Valid,
+		token.Proxy, token.Scope, token.Client, token.Expires, token.Created)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errConflict
+	}
+	return nil
+}
+
+func (t *sqlTokens) Consume(token string, kind string, proxy string, scope string, valid bool, consumed string) error {
+	sql := "UPDATE " + t.s.table("tokens")
+	sql += " SET `valid` = ?, `proxy` = ?, `scope` = ?, `consumed` = ?"
+	sql += " WHERE token = ? AND type = ? AND consumed IS NULL AND expires >= ?"
+	count, err := t.s.update(sql, valid, proxy, scope, consumed, token, kind, consumed)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errConflict
+	}
+	return nil
+}
+
+const claimColumns = "id, proxy, type, status, claim, created, updated"
+
+func claimFromRow(row orm.Params) *Claim {
+	return &Claim{
+		ID:      rowInt64(row, "id"),
+		Proxy:   rowString(row, "proxy"),
+		Type:    rowString(row, "type"),
+		Status:  rowString(row, "status"),
+		Claim:   rowString(row, "claim"),
+		Created: rowString(row, "created"),
+		Updated: rowString(row, "updated"),
+	}
+}
+
+func (c *sqlClaims) Count(status string, claimType string) (int, error) {
+	sql := "SELECT COUNT(*) AS total FROM " + c.s.table("claims")
+	sql += " WHERE status = ? AND type = ?"
+	row, err := c.s.queryRow(sql, status, claimType)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(rowString(row, "total"))
+}
+
+func (c *sqlClaims) Counts() ([]*ClaimCount, error) {
+	sql := "SELECT status, type, COUNT(*) AS total FROM " + c.s.table("claims")
+	sql += " GROUP BY status, type ORDER BY status, type"
+	rows, err := c.s.query(sql)
+	if err != nil {
+		return nil, err
+	}
+	counts := []*ClaimCount{}
+	for _, row := range rows {
+		counts = append(counts, &ClaimCount{
+			Status: rowString(row, "status"),
+			Type:   rowString(row, "type"),
+			Total:  int(rowInt64(row, "total")),
+		})
+	}
+	return counts, nil
+}
+
+func (c *sqlClaims) Create(claim *Claim, event *ClaimEvent) error {
+	return c.s.transaction(func(o orm.Ormer) error {
+		sql := "INSERT INTO " + c.s.table("claims") + "(`proxy`, `type`,"
+		sql += "`status`, `claim`, `created`, `updated`) VALUES("
+		sql += "?, ?, ?, ?, ?, ?)"
+		res, err := o.Raw(sql, claim.Proxy, claim.Type, claim.Status,
+			claim.Claim, claim.Created, claim.Updated).Exec()
+		if err != nil {
+			return err
+		}
+		if claim.ID, err = res.LastInsertId(); err != nil || event == nil {
+			return err
+		}
+		event.ClaimID = claim.ID
+		return c.s.insertClaimEvent(o, event)
+	})
+}
+
+func (c *sqlClaims) Find(id int64) (*Claim, error) {
+	sql := "SELECT " + claimColumns + " FROM " + c.s.table("claims")
+	sql += " WHERE id = ? LIMIT 1"
+	row, err := c.s.queryRow(sql, id)
+	if err != nil {
+		return nil, err
+	}
+	return claimFromRow(row), nil
+}
+
+func (c *sqlClaims) FindByContent(proxy string, claimType string, content string) (*Claim, error) {
+	sql := "SELECT " + claimColumns + " FROM " + c.s.table("claims")
+	sql += " WHERE proxy = ? AND type = ? AND claim = ? LIMIT 1"
+	row, err := c.s.queryRow(sql, proxy, claimType, content)
+	if err != nil {
+		return nil, err
+	}
+	return claimFromRow(row), nil
+}
+
+func (c *sqlClaims) FindByStatus(proxy string, claimType string, status string) (*Claim, error) {
+	sql := "SELECT " + claimColumns + " FROM " + c.s.table("claims")
+	sql += " WHERE proxy = ? AND status = ? AND type = ? LIMIT 1"
+	row, err := c.s.queryRow(sql, proxy, status, claimType)
+	if err != nil {
+		return nil, err
+	}
+	return claimFromRow(row), nil
+}
+
+func (c *sqlClaims) FindLatest(proxy string, claimType string) (*Claim, error) {
+	sql := "SELECT " + claimColumns + " FROM " + c.s.table("claims")
+	sql += " WHERE proxy = ? AND type = ? ORDER BY created DESC, id DESC LIMIT 1"
+	row, err := c.s.queryRow(sql, proxy, claimType)
+	if err != nil {
+		return nil, err
+	}
+	return claimFromRow(row), nil
+}
+
+func (c *sqlClaims) List(status string, claimType string, limit int, offset int) ([]*Claim, error) {
+	sql := "SELECT " + claimColumns + " FROM " + c.s.table("claims")
+	sql += " WHERE status = ? AND type = ?"
+	sql += " ORDER BY created ASC, id ASC LIMIT ? OFFSET ?"
+	rows, err := c.s.query(sql, status, claimType, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	claims := []*Claim{}
+	for _, row := range rows {
+		claims = append(claims, claimFromRow(row))
+	}
+	return claims, nil
+}
+
+func (c *sqlClaims) Transition(id int64, from string, to string, content string, event *ClaimEvent) error {
+	return c.s.transaction(func(o orm.Ormer) error {
+		sql := "UPDATE " + c.s.table("claims")
+		sql += " SET `status` = ?, `claim` = COALESCE(NULLIF(?, ''), `claim`), `updated` = ?"
+		sql += " WHERE id = ? AND status = ?"
+		num, err := updateWith(o, sql, to, content, event.Created, id, from)
+		if err != nil {
+			return err
+		} else if num == 0 {
+			return errConflict
+		}
+		return c.s.insertClaimEvent(o, event)
+	})
+}
+
+func (c *sqlClaims) Attest(id int64, from string, to string, event *ClaimEvent, attestation *Attestation) error {
+	return c.s.transaction(func(o orm.Ormer) error {
+		sql := "UPDATE " + c.s.table("claims") + " SET `status` = ?, `updated` = ?"
+		sql += " WHERE id = ? AND status = ?"
+		count, err := updateWith(o, sql, to, event.Created, id, from)
+		if err != nil {
+			return err
+		} else if count == 0 {
+			return errConflict
+		}
+		if err := c.s.insertClaimEvent(o, event); err != nil || attestation == nil {
+			return err
+		}
+		if attestation.ID == 0 {
+			sql = "INSERT INTO " + c.s.table("attestations") + "(`claimid`, `attestant`,"
+			sql += "`attestation`, `status`, `created`, `updated`) VALUES(?, ?, ?, ?, ?, ?)"
+			res, err := o.Raw(sql, attestation.ClaimID, attestation.Attestant,
+				attestation.Attestation, attestation.Status, attestation.Created,
+				attestation.Updated).Exec()
+			if err != nil {
+				return err
+			}
+			attestation.ID, err = res.LastInsertId()
+			return err
+		} else if attestation.Status == attestationRevoked {
+			sql = "UPDATE " + c.s.table("attestations")
+			sql += " SET `status` = ?, `reason` = ?, `revoked` = ?, `updated` = ?"
+			sql += " WHERE id = ? AND status = ?"
+			_, err = updateWith(o, sql, attestationRevoked, attestation.Reason,
+				attestation.Revoked, attestation.Updated, attestation.ID, attestationActive)
+			return err
+		}
+		sql = "UPDATE " + c.s.table("attestations")
+		sql += " SET `attestation` = ?, `status` = ?, `updated` = ? WHERE id = ?"
+		_, err = updateWith(o, sql, attestation.Attestation, attestation.Status,
+			attestation.Updated, attestation.ID)
+		return err
+	})
+}
+
+// insertClaimEvent records event within the transaction o.
+func (s *sqlStore) insertClaimEvent(o orm.Ormer, event *ClaimEvent) error {
+	sql := "INSERT INTO " + s.table("claim_events") + "(`claimid`, `fromstatus`,"
+	sql += "`tostatus`, `actor`, `created`) VALUES(?, ?, ?, ?, ?)"
+	start := time.Now()
+	res, err := o.Raw(sql, event.ClaimID, event.From, event.To, event.Actor,
+		event.Created).Exec()
+	observeQuery("exec", start, err)
+	if err != nil {
+		return err
+	}
+	event.ID, err = res.LastInsertId()
+	return err
+}
+
+func (e *sqlClaimEvents) Create(event *ClaimEvent) error {
+	sql := "INSERT INTO " + e.s.table("claim_events") + "(`claimid`, `fromstatus`,"
+	sql += "`tostatus`, `actor`, `created`) VALUES(?, ?, ?, ?, ?)"
+	id, err := e.s.exec(sql, event.ClaimID, event.From, event.To,
+		event.Actor, event.Created)
+	if err != nil {
+		return err
+	}
+	event.ID = id
+	return nil
+}
+
+func (e *sqlClaimEvents) List(claimID int64) ([]*ClaimEvent, error) {
+	sql := "SELECT id, claimid, fromstatus, tostatus, actor, created"
+	sql += " FROM " + e.s.table("claim_events")
+	sql += " WHERE claimid = ? ORDER BY id ASC"
+	rows, err := e.s.query(sql, claimID)
+	if err != nil {
+		return nil, err
+	}
+	events := []*ClaimEvent{}
+	for _, row := range rows {
+		events = append(events, &ClaimEvent{
+			ID:      rowInt64(row, "id"),
+			ClaimID: rowInt64(row, "claimid"),
+			From:    rowString(row, "fromstatus"),
+			To:      rowString(row, "tostatus"),
+			Actor:   rowString(row, "actor"),
+			Created: rowString(row, "created"),
+		})
+	}
+	return events, nil
+}
+
+const attestationColumns = "id, claimid, attestant, attestation, status, reason" +
+	", revoked, created, updated"
+
+func attestationFromRow(row orm.Params) *Attestation {
+	return &Attestation{
+		ID:          rowInt64(row, "id"),
+		ClaimID:     rowInt64(row, "claimid"),
+		Attestant:   rowString(row, "attestant"),
+		Attestation: rowString(row, "attestation"),
+		Status:      rowString(row, "status"),
+		Reason:      rowString(row, "reason"),
+		Revoked:     rowString(row, "revoked"),
+		Created:     rowString(row, "created"),
+		Updated:     rowString(row, "updated"),
+	}
+}
+
+func (a *sqlAttestations) Create(attestation *Attestation) error {
+	sql := "INSERT INTO " + a.s.table("attestations") + "(`claimid`, `attestant`,"
+	sql += "`attestation`, `status`, `created`, `updated`) VALUES("
+	sql += "?, ?, ?, ?, ?, ?)"
+	id, err := a.s.exec(sql, attestation.ClaimID, attestation.Attestant,
+		attestation.Attestation, attestation.Status, attestation.Created,
+		attestation.Updated)
+	if err != nil {
+		return err
+	}
+	attestation.ID = id
+	return nil
+}
+
+func (a *sqlAttestations) Find(id int64) (*Attestation, error) {
+	sql := "SELECT " + attestationColumns + " FROM " + a.s.table("attestations")
+	sql += " WHERE id = ? LIMIT 1"
+	row, err := a.s.queryRow(sql, id)
+	if err != nil {
+		return nil, err
+	}
+	return attestationFromRow(row), nil
+}
+
+func (a *sqlAttestations) FindByAttestant(claimID int64, attestant string) (*Attestation, error) {
+	sql := "SELECT " + attestationColumns + " FROM " + a.s.table("attestations")
+	sql += " WHERE claimid = ? AND attestant = ? LIMIT 1"
+	row, err := a.s.queryRow(sql, claimID, attestant)
+	if err != nil {
+		return nil, err
+	}
+	return attestationFromRow(row), nil
+}
+
+func (a *sqlAttestations) FindByClaim(claimID int64) (*Attestation, error) {
+	sql := "SELECT " + attestationColumns + " FROM " + a.s.table("attestations")
+	sql += " WHERE claimid = ? LIMIT 1"
+	row, err := a.s.queryRow(sql, claimID)
+	if err != nil {
+		return nil, err
+	}
+	return attestationFromRow(row), nil
+}
+
+func (a *sqlAttestations) FindLatest(claimID int64, status string) (*Attestation, error) {
+	sql := "SELECT " + attestationColumns + " FROM " + a.s.table("attestations")
+	sql += " WHERE claimid = ? AND status = ? ORDER BY created DESC, id DESC LIMIT 1"
+	row, err := a.s.queryRow(sql, claimID, status)
+	if err != nil {
+		return nil, err
+	}
+	return attestationFromRow(row), nil
+}
+
+func (a *sqlAttestations) ListRevoked() ([]*Attestation, error) {
+	sql := "SELECT " + attestationColumns + " FROM " + a.s.table("attestations")
+	sql += " WHERE status = ? ORDER BY id ASC"
+	rows, err := a.s.query(sql, attestationRevoked)
+	if err != nil {
+		return nil, err
+	}
+	attestations := []*Attestation{}
+	for _, row := range rows {
+		attestations = append(attestations, attestationFromRow(row))
+	}
+	return attestations, nil
+}
+
+func (a *sqlAttestations) Revoke(id int64, reason string, revoked string, event *ClaimEvent) error {
+	return a.s.transaction(func(o orm.Ormer) error {
+		sql := "UPDATE " + a.s.table("attestations")
+		sql += " SET `status` = ?, `reason` = ?, `revoked` = ?, `updated` = ?"
+		sql += " WHERE id = ? AND status = ?"
+		num, err := updateWith(o, sql, attestationRevoked, reason, revoked, revoked,
+			id, attestationActive)
+		if err != nil {
+			return err
+		} else if num == 0 {
+			return errConflict
+		} else if event == nil {
+			return nil
+		}
+		sql = "UPDATE " + a.s.table("claims") + " SET `status` = ?, `updated` = ?"
+		sql += " WHERE id = ? AND status = ? AND NOT EXISTS (SELECT 1 FROM "
+		sql += a.s.table("attestations") + " WHERE claimid = ? AND status = ?)"
+		num, err = updateWith(o, sql, event.To, event.Created, event.ClaimID, event.From,
+			event.ClaimID, attestationActive)
+		if err != nil || num == 0 {
+			return err
+		}
+		return a.s.insertClaimEvent(o, event)
+	})
+}
+
+func (p *sqlReplays) Record(jti string, expires string, now string) error {
+	sql := "DELETE FROM " + p.s.table("jwt_replays") + " WHERE expires < ?"
+	if _, err := p.s.update(sql, now); err != nil {
+		return err
+	}
+	sql = p.s.insertIgnore("jwt_replays") + "(`jti`, `expires`) VALUES(?, ?)"
+	count, err := p.s.update(sql, jti, expires)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errConflict
+	}
+	return nil
+}
+
+// Lists are stored as JSON arrays.
+func encodeList(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	bs, _ := json.Marshal(list)
+	return string(bs)
+}
+
+func decodeList(value string) []string {
+	list := []string{}
+	json.Unmarshal([]byte(value), &list)
+	return list
+}
+
+const clientColumns = "id, name, publickeys, scopes, redirecturls, status, created, updated"
+
+func clientFromRow(row orm.Params) *Client {
+	return &Client{
+		ID:           rowInt64(row, "id"),
+		Name:         rowString(row, "name"),
+		PublicKeys:   decodeList(rowString(row, "publickeys")),
+		Scopes:       decodeList(rowString(row, "scopes")),
+		RedirectURLs: decodeList(rowString(row, "redirecturls")),
+		Status:       rowString(row, "status"),
+		Created:      rowString(row, "created"),
+		Updated:      rowString(row, "updated"),
+	}
+}
+
+func (c *sqlClients) Create(client *Client) error {
+	sql := c.s.insertIgnore("clients") + "(`name`, `publickeys`, `scopes`,"
+	sql += "`redirecturls`, `status`, `created`, `updated`) VALUES("
+	sql += "?, ?, ?, ?, ?, ?, ?)"
+	count, err := c.s.update(sql, client.Name, encodeList(client.PublicKeys),
+		encodeList(client.Scopes), encodeList(client.RedirectURLs),
+		client.Status, client.Created, client.Updated)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errConflict
+	}
+	stored, err := c.Find(client.Name)
+	if err != nil {
+		return err
+	}
+	client.ID = stored.ID
+	return nil
+}
+
+func (c *sqlClients) Find(name string) (*Client, error) {
+	sql := "SELECT " + clientColumns + " FROM " + c.s.table("clients")
+	sql += " WHERE name = ? LIMIT 1"
+	row, err := c.s.queryRow(sql, name)
+	if err != nil {
+		return nil, err
+	}
+	return clientFromRow(row), nil
+}
+
+func (c *sqlClients) List() ([]*Client, error) {
+	sql := "SELECT " + clientColumns + " FROM " + c.s.table("clients") + " ORDER BY name"
+	rows, err := c.s.query(sql)
+	if err != nil {
+		return nil, err
+	}
+	clients := []*Client{}
+	for _, row := range rows {
+		clients = append(clients, clientFromRow(row))
+	}
+	return clients, nil
+}
+
+func (c *sqlClients) Update(client *Client) error {
+	sql := "UPDATE " + c.s.table("clients")
+	sql += " SET `publickeys` = ?, `scopes` = ?, `redirecturls` = ?,"
+	sql += " `status` = ?, `updated` = ? WHERE name = ?"
+	_, err := c.s.update(sql, encodeList(client.PublicKeys),
+		encodeList(client.Scopes), encodeList(client.RedirectURLs),
+		client.Status, client.Updated, client.Name)
+	return err
+}
+
+const consentColumns = "id, proxy, requester, scope, evidence, status, created, revoked"
+
+func consentFromRow(row orm.Params) *Consent {
+	return &Consent{
+		ID:        rowInt64(row, "id"),
+		Proxy:     rowString(row, "proxy"),
+		Requester: rowString(row, "requester"),
+		Scope:     rowString(row, "scope"),
+		Evidence:  rowString(row, "evidence"),
+		Status:    rowString(row, "status"),
+		Created:   rowString(row, "created"),
+		Revoked:   rowString(row, "revoked"),
+	}
+}
+
+func (c *sqlConsents) Create(consent *Consent) error {
+	sql := "INSERT INTO " + c.s.table("consents") + "(`proxy`, `requester`, `scope`,"
+	sql += "`evidence`, `status`, `created`) VALUES(?, ?, ?, ?, ?, ?)"
+	id, err := c.s.exec(sql, consent.Proxy, consent.Requester, consent.Scope,
+		consent.Evidence, consent.Status, consent.Created)
+	if err != nil {
+		return err
+	}
+	consent.ID = id
+	return nil
+}
+
+func (c *sqlConsents) FindActive(proxy string, requester string) (*Consent, error) {
+	sql := "SELECT " + consentColumns + " FROM " + c.s.table("consents")
+	sql += " WHERE proxy = ? AND requester = ? AND status = ? ORDER BY id DESC LIMIT 1"
+	row, err := c.s.queryRow(sql, proxy, requester, consentActive)
+	if err != nil {
+		return nil, err
+	}
+	return consentFromRow(row), nil
+}
+
+func (c *sqlConsents) List(proxy string, requester string) ([]*Consent, error) {
+	sql := "SELECT " + consentColumns + " FROM " + c.s.table("consents") + " WHERE proxy = ?"
+	args := []interface{}{proxy}
+	if len(requester) > 0 {
+		sql += " AND requester = ?"
+		args = append(args, requester)
+	}
+	rows, err := c.s.query(sql+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	consents := []*Consent{}
+	for _, row := range rows {
+		consents = append(consents, consentFromRow(row))
+	}
+	return consents, nil
+}
+
+func (c *sqlConsents) Revoke(proxy string, requester string, revoked string) (int64, error) {
+	sql := "UPDATE " + c.s.table("consents") + " SET `status` = ?, `revoked` = ?"
+	sql += " WHERE proxy = ? AND requester = ? AND status = ?"
+	return c.s.update(sql, consentRevoked, revoked, proxy, requester, consentActive)
+}
+
+const authRequestColumns = "token, client, redirecturi, scope, state, nonce, challenge" +
+	", code, proxy, expires, created, redeemed"
+
+func authRequestFromRow(row orm.Params) *AuthRequest {
+	return &AuthRequest{
+		Token:       rowString(row, "token"),
+		Client:      rowString(row, "client"),
+		RedirectURI: rowString(row, "redirecturi"),
+		Scope:       rowString(row, "scope"),
+		State:       rowString(row, "state"),
+		Nonce:       rowString(row, "nonce"),
+		Challenge:   rowString(row, "challenge"),
+		Code:        rowString(row, "code"),
+		Proxy:       rowString(row, "proxy"),
+		Expires:     rowString(row, "expires"),
+		Created:     rowString(row, "created"),
+		Redeemed:    rowString(row, "redeemed"),
+	}
+}
+
+func (a *sqlAuthRequests) Create(request *AuthRequest) error {
+	sql := a.s.insertIgnore("oidc_requests") + "(`token`, `client`, `redirecturi`, `scope`,"
+	sql += "`state`, `nonce`, `challenge`, `expires`, `created`) VALUES("
+	sql += "?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	count, err := a.s.update(sql, request.Token, request.Client, request.RedirectURI,
+		request.Scope, request.State, request.Nonce, request.Challenge,
+		request.Expires, request.Created)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errConflict
+	}
+	return nil
+}
+
+func (a *sqlAuthRequests) Find(token string) (*AuthRequest, error) {
+	sql := "SELECT " + authRequestColumns + " FROM " + a.s.table("oidc_requests")
+	sql += " WHERE token = ? LIMIT 1"
+	row, err := a.s.queryRow(sql, token)
+	if err != nil {
+		return nil, err
+	}
+	return authRequestFromRow(row), nil
+}
+
+func (a *sqlAuthRequests) FindByCode(code string) (*AuthRequest, error) {
+	sql := "SELECT " + authRequestColumns + " FROM " + a.s.table("oidc_requests")
+	sql += " WHERE code = ? LIMIT 1"
+	row, err := a.s.queryRow(sql, code)
+	if err != nil {
+		return nil, err
+	}
+	return authRequestFromRow(row), nil
+}
+
+func (a *sqlAuthRequests) Complete(token string, code string, proxy string, scope string, expires string) error {
+	sql := "UPDATE " + a.s.table("oidc_requests")
+	sql += " SET `code` = ?, `proxy` = ?, `scope` = ?, `expires` = ?"
+	sql += " WHERE token = ? AND code IS NULL"
+	count, err := a.s.update(sql, code, proxy, scope, expires, token)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		if _, err := a.Find(token); err != nil {
+			return err
+		}
+		return errConflict
+	}
+	return nil
+}
+
+func (a *sqlAuthRequests) Redeem(code string, redeemed string) (*AuthRequest, error) {
+	sql := "UPDATE " + a.s.table("oidc_requests") + " SET `redeemed` = ?"
+	sql += " WHERE code = ? AND redeemed IS NULL AND expires >= ?"
+	count, err := a.s.update(sql, redeemed, code, redeemed)
+	if err != nil {
+		return nil, err
+	}
+	sql = "SELECT " + authRequestColumns + " FROM " + a.s.table("oidc_requests")
+	sql += " WHERE code = ? LIMIT 1"
+	row, err := a.s.queryRow(sql, code)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errConflict
+	}
+	return authRequestFromRow(row), nil
+}
+
+const recoveryColumns = "id, proxy, publickey, address, approvals, status, executable" +
+	", created, updated"
+
+func recoveryFromRow(row orm.Params) *Recovery {
+	return &Recovery{
+		ID:         rowInt64(row, "id"),
+		Proxy:      rowString(row, "proxy"),
+		PublicKey:  rowString(row, "publickey"),
+		Address:    rowString(row, "address"),
+		Approvals:  decodeList(rowString(row, "approvals")),
+		Status:     rowString(row, "status"),
+		Executable: rowString(row, "executable"),
+		Created:    rowString(row, "created"),
+		Updated:    rowString(row, "updated"),
+	}
+}
+
+func (r *sqlRecoveries) Create(recovery *Recovery) error {
+	return r.s.transaction(func(o orm.Ormer) error {
+		rows := []orm.Params{}
+		sql := "SELECT id FROM " + r.s.table("recoveries") + " WHERE proxy = ? AND status = ?"
+		if num, err := o.Raw(sql, recovery.Proxy, recoveryPending).Values(&rows); err != nil {
+			return err
+		} else if num > 0 {
+			return errConflict
+		}
+		sql = "INSERT INTO " + r.s.table("recoveries") + "(`proxy`, `publickey`, `address`,"
+		sql += "`approvals`, `status`, `created`, `updated`) VALUES(?, ?, ?, ?, ?, ?, ?)"
+		res, err := o.Raw(sql, recovery.Proxy, recovery.PublicKey, recovery.Address,
+			encodeList(recovery.Approvals), recovery.Status, recovery.Created,
+			recovery.Updated).Exec()
+		if err != nil {
+			return err
+		}
+		recovery.ID, err = res.LastInsertId()
+		return err
+	})
+}
+
+func (r *sqlRecoveries) Find(id int64) (*Recovery, error) {
+	sql := "SELECT " + recoveryColumns + " FROM " + r.s.table("recoveries")
+	sql += " WHERE id = ? LIMIT 1"
+	row, err := r.s.queryRow(sql, id)
+	if err != nil {
+		return nil, err
+	}
+	return recoveryFromRow(row), nil
+}
+
+func (r *sqlRecoveries) FindPending(proxy string) (*Recovery, error) {
+	sql := "SELECT " + recoveryColumns + " FROM " + r.s.table("recoveries")
+	sql += " WHERE proxy = ? AND status = ? ORDER BY id DESC LIMIT 1"
+	row, err := r.s.queryRow(sql, proxy, recoveryPending)
+	if err != nil {
+		return nil, err
+	}
+	return recoveryFromRow(row), nil
+}
+
+// finish reports errNotFound or errConflict for an update of recovery id
+// that matched no pending row.
+func (r *sqlRecoveries) finish(id int64, count int64, err error) error {
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		if _, err := r.Find(id); err != nil {
+			return err
+		}
+		return errConflict
+	}
+	return nil
+}
+
+func (r *sqlRecoveries) Approve(recovery *Recovery, approvals []string, executable string, updated string) error {
+	sql := "UPDATE " + r.s.table("recoveries") + " SET `approvals` = ?,"
+	sql += " `executable` = NULLIF(?, ''), `updated` = ?"
+	sql += " WHERE id = ? AND status = ? AND approvals = ?"
+	count, err := r.s.update(sql, encodeList(approvals), executable, updated,
+		recovery.ID, recoveryPending, encodeList(recovery.Approvals))
+	return r.finish(recovery.ID, count, err)
+}
+
+func (r *sqlRecoveries) Cancel(id int64, updated string) error {
+	sql := "UPDATE " + r.s.table("recoveries") + " SET `status` = ?, `updated` = ?"
+	sql += " WHERE id = ? AND status = ?"
+	count, err := r.s.update(sql, recoveryCancelled, updated, id, recoveryPending)
+	return r.finish(id, count, err)
+}
+
+func (r *sqlRecoveries) Execute(id int64, oldPublicKey string, updated string) error {
+	recovery, err := r.Find(id)
+	if err != nil {
+		return err
+	}
+	return r.s.transaction(func(o orm.Ormer) error {
+		sql := "UPDATE " + r.s.table("recoveries") + " SET `status` = ?, `updated` = ?"
+		sql += " WHERE id = ? AND status = ?"
+		count, err := updateWith(o, sql, recoveryExecuted, updated, id, recoveryPending)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errConflict
+		}
+		return r.s.rotateKey(o, recovery.Proxy, oldPublicKey, recovery.PublicKey,
+			recovery.Address, updated)
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import "testing"
+
+// testStores returns the in-memory store and a freshly migrated SQLite
+// store, so that both backends can be held to the same contract.
+func testStores(t *testing.T) map[string]Store {
+	m := testSQLiteStore(t)
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	return map[string]Store{driverMemory: newMemoryStore(), driverSQLite: sqliteStore}
+}
+
+func TestStoreUsers(t *testing.T) {
+	for driver, s := range testStores(t) {
+		users := s.Users()
+		user := &User{Name: "name", PublicKey: "key", Address: "address", Proxy: testUserProxy, Created: "2026-01-01 00:00:00"}
+		if err := users.Create(user); err != nil || user.ID == 0 {
+			t.Fatalf("%s: Create = %v, ID %d", driver, err, user.ID)
+		}
+		if _, err := users.FindByProxy(testAttestantProxy); err != errNotFound {
+			t.Errorf("%s: FindByProxy(unknown) err = %v, want errNotFound", driver, err)
+		}
+		if err := users.RotateKey(testUserProxy, "stale", "new", "address2", "2026-01-02 00:00:00"); err != errConflict {
+			t.Errorf("%s: RotateKey(stale key) err = %v, want errConflict", driver, err)
+		}
+		if err := users.RotateKey(testUserProxy, "key", "new", "address2", "2026-01-02 00:00:00"); err != nil {
+			t.Fatalf("%s: RotateKey: %v", driver, err)
+		}
+		found, err := users.FindByPublicKey("new")
+		if err != nil || found.Proxy != testUserProxy || found.Address != "address2" || found.Rotated != "2026-01-02 00:00:00" {
+			t.Errorf("%s: after rotation found %+v, %v", driver, found, err)
+		}
+		if err := users.SetGuardians(testUserProxy, []string{"a", "b"}, "2026-01-03 00:00:00"); err != nil {
+			t.Fatalf("%s: SetGuardians: %v", driver, err)
+		}
+		if found, _ := users.FindByProxy(testUserProxy); len(found.Guardians) != 2 || found.Guardians[1] != "b" {
+			t.Errorf("%s: guardians = %v", driver, found.Guardians)
+		}
+	}
+}
+
+func TestStoreTokens(t *testing.T) {
+	for driver, s := range testStores(t) {
+		tokens := s.Tokens()
+		token := &Token{Token: "token", Type: "login", Expires: "2026-01-01 00:05:00", Created: "2026-01-01 00:00:00"}
+		if err := tokens.Issue(token); err != nil {
+			t.Fatalf("%s: Issue: %v", driver, err)
+		}
+		if err := tokens.Issue(token); err != errConflict {
+			t.Errorf("%s: second Issue err = %v, want errConflict", driver, err)
+		}
+		steps := []struct {
+			name     string
+			kind     string
+			consumed string
+			want     error
+		}{
+			{"other type", "claim", "2026-01-01 00:01:00", errConflict},
+			{"expired", "login", "2026-01-01 00:06:00", errConflict},
+			{"valid", "login", "2026-01-01 00:01:00", nil},
+			{"consumed twice", "login", "2026-01-01 00:02:00", errConflict},
+		}
+		for _, step := range steps {
+			if err := tokens.Consume("token", step.kind, testUserProxy, "name", true, step.consumed); err != step.want {
+				t.Errorf("%s: %s: err = %v, want %v", driver, step.name, err, step.want)
+			}
+		}
+		found, err := tokens.Find("token")
+		if err != nil || !found.Valid || found.Proxy != testUserProxy || found.Consumed != "2026-01-01 00:01:00" {
+			t.Errorf("%s: consumed token = %+v, %v", driver, found, err)
+		}
+	}
+}
+
+func TestStoreClaims(t *testing.T) {
+	for driver, s := range testStores(t) {
+		claims := s.Claims()
+		claim := &Claim{Proxy: testUserProxy, Type: "EMAIL", Status: string(ClaimPending), Claim: "first"}
+		event := &ClaimEvent{To: string(ClaimPending), Actor: testUserProxy}
+		if err := claims.Create(claim, event); err != nil || event.ClaimID != claim.ID {
+			t.Fatalf("%s: Create = %v, event claim %d, want %d", driver, err, event.ClaimID, claim.ID)
+		}
+		if found, err := claims.FindByContent(testUserProxy, "EMAIL", "first"); err != nil || found.ID != claim.ID {
+			t.Errorf("%s: FindByContent = %v, %v", driver, found, err)
+		}
+		approve := &ClaimEvent{ClaimID: claim.ID, From: string(ClaimPending), To: string(ClaimApproved), Actor: "idhub"}
+		if err := claims.Transition(claim.ID, string(ClaimPending), string(ClaimApproved), "", approve); err != nil {
+			t.Fatalf("%s: Transition: %v", driver, err)
+		}
+		if err := claims.Transition(claim.ID, string(ClaimPending), string(ClaimRejected), "", approve); err != errConflict {
+			t.Errorf("%s: stale Transition err = %v, want errConflict", driver, err)
+		}
+		if count, _ := claims.Count(string(ClaimApproved), "EMAIL"); count != 1 {
+			t.Errorf("%s: Count(APPROVED) = %d, want 1", driver, count)
+		}
+		if events, _ := s.ClaimEvents().List(claim.ID); len(events) != 2 {
+			t.Errorf("%s: events = %v, want 2", driver, events)
+		}
+
+		attestations := s.Attestations()
+		attestation := &Attestation{ClaimID: claim.ID, Attestant: "idhub", Attestation: "jwt", Status: attestationActive}
+		if err := attestations.Create(attestation); err != nil {
+			t.Fatalf("%s: Create attestation: %v", driver, err)
+		}
+		revoke := &ClaimEvent{ClaimID: claim.ID, From: string(ClaimApproved), To: string(ClaimRevoked), Actor: "idhub"}
+		if err := attestations.Revoke(attestation.ID, "reason", "2026-01-02 00:00:00", revoke); err != nil {
+			t.Fatalf("%s: Revoke: %v", driver, err)
+		}
+		if err := attestations.Revoke(attestation.ID, "reason", "2026-01-02 00:00:00", nil); err != errConflict {
+			t.Errorf("%s: second Revoke err = %v, want errConflict", driver, err)
+		}
+		if found, _ := claims.Find(claim.ID); found.Status != string(ClaimRevoked) {
+			t.Errorf("%s: claim status = %s, want %s", driver, found.Status, ClaimRevoked)
+		}
+		if revoked, _ := attestations.ListRevoked(); len(revoked) != 1 || revoked[0].Reason != "reason" {
+			t.Errorf("%s: ListRevoked = %v", driver, revoked)
+		}
+	}
+}
+
+func TestStoreReplays(t *testing.T) {
+	for driver, s := range testStores(t) {
+		replays := s.Replays()
+		if err := replays.Record("jti", "2026-01-01 00:05:00", "2026-01-01 00:00:00"); err != nil {
+			t.Fatalf("%s: Record: %v", driver, err)
+		}
+		if err := replays.Record("jti", "2026-01-01 00:05:00", "2026-01-01 00:01:00"); err != errConflict {
+			t.Errorf("%s: replay err = %v, want errConflict", driver, err)
+		}
+		if err := replays.Record("jti", "2026-01-01 00:15:00", "2026-01-01 00:10:00"); err != nil {
+			t.Errorf("%s: Record after expiry: %v", driver, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Token types recorded when a token is issued. A token is only accepted by
+// the endpoint that validates its type.
+const (
+	tokenAuthorization = "AUTHORIZATION"
+	tokenClaim         = "CLAIM"
+	tokenLogin         = "LOGIN"
+)
+
+// tokenTTL is how long, in seconds, an issued token may be validated.
+const tokenTTL = 300
+
+func formatUnix(sec int64) string {
+	return time.Unix(sec, 0).Format("2006-01-02 15:04:05")
+}
+
+// issueToken mints and stores a token of type kind that client expects to
+// be validated for scope before exp.
+func issueToken(kind string, scope string, client string, exp int64) (*Token, error) {
+	item := &Token{
+		Token:   strings.Replace(uuid.NewV4().String(), "-", "", -1),
+		Type:    kind,
+		Scope:   scope,
+		Client:  client,
+		Expires: formatUnix(exp),
+		Created: getNow(),
+	}
+	if err := Storage().Tokens().Issue(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// requestScope parses a scope presented in a JWT context.
+func requestScope(value string, result map[string]interface{}) (Scope, bool) {
+	scope, err := parseScope(value)
+	if err != nil {
+		setAPIError(badRequest("scope", "Invalid scope: "+err.Error()+"."), result)
+		return nil, false
+	}
+	return scope, true
+}
+
+// checkToken returns the issued token when it may still be validated as a
+// token of type kind with the scope the user approved.
+func checkToken(r *http.Request, token string, kind string, approved Scope, result map[string]interface{}) *Token {
+	item, err := Storage().Tokens().Find(token)
+	if err == errNotFound {
+		setAPIError(unauthorized("Unknown token."), result)
+	} else if err != nil {
+		setFailure(r, err, result)
+	} else if item.Type != kind {
+		setAPIError(unauthorized("Token was not issued for "+strings.ToLower(kind)+"."), result)
+	} else if len(item.Consumed) > 0 {
+		setAPIError(conflict("Token has already been used."), result)
+	} else if item.Expires < getNow() {
+		setAPIError(unauthorized("Token has expired."), result)
+	} else if issued, err := parseScope(item.Scope); err != nil || !issued.accepts(approved) {
+		setAPIError(forbidden("Scope does not match the issued token."), result)
+	} else {
+		return item
+	}
+	return nil
+}
+
+// consumeToken records the outcome of validating item with the approved
+// scope and wakes the websocket waiting for it. Only the first caller
+// succeeds.
+func consumeToken(r *http.Request, item *Token, proxy string, approved Scope, valid bool, result map[string]interface{}) bool {
+	now := getNow()
+	err := Storage().Tokens().Consume(item.Token, item.Type, proxy, approved.String(), valid, now)
+	if err == errConflict {
+		setAPIError(conflict("Token has already been used."), result)
+		return false
+	} else if err != nil {
+		setFailure(r, err, result)
+		return false
+	}
+	item.Valid = valid
+	item.Proxy = proxy
+	item.Scope = approved.String()
+	item.Consumed = now
+	hub.publish(item)
+	return true
+}
+
+// checkReplay accepts a verified JWT only once. JWTs are identified by
+// their jti claim, or by the hash of their signing input when they carry
+// none, so that re-encoding the signature does not make a new token. They
+// are remembered until they expire.
+func checkReplay(r *http.Request, token string, payload map[string]interface{}, result map[string]interface{}) bool {
+	key := "jwt:" + signingInput(token)
+	if jti, ok := payload["jti"].(string); ok && len(jti) > 0 {
+		key = "jti:" + jti
+	}
+	sum := sha256.Sum256([]byte(key))
+	exp, ok, err := claimInt64(payload, "exp")
+	if err != nil || !ok {
+		exp = time.Now().Unix() + tokenTTL
+	}
+	err = Storage().Replays().Record(hex.EncodeToString(sum[:]), formatUnix(exp+jwtLeeway()), getNow())
+	if err == errConflict {
+		setAPIError(unauthorized("JWT has already been used."), result)
+		return false
+	} else if err != nil {
+		setFailure(r, err, result)
+		return false
+	}
+	return true
+}
+
+// checkSubject checks that a JWT was signed for subject.
+func checkSubject(payload map[string]interface{}, subject string, result map[string]interface{}) bool {
+	if sub, _ := payload["sub"].(string); sub != subject {
+		setAPIError(badRequest("sub", "JWT subject must be \""+subject+"\"."), result)
+		return false
+	}
+	return true
+}
+
+// authenticateUser verifies a JWT signed by the registered user proxy with
+// publicKey and accepts it only once.
+func authenticateUser(r *http.Request, token string, payload map[string]interface{}, proxy string, publicKey string, result map[string]interface{}) bool {
+	user, err := Storage().Users().FindByProxy(proxy)
+	if err == errNotFound {
+		setAPIError(unauthorized("Unknown user "+proxy+"."), result)
+		return false
+	} else if err != nil {
+		setFailure(r, err, result)
+		return false
+	}
+	if !strings.EqualFold(user.PublicKey, publicKey) {
+		setAPIError(unauthorized("Public key is not registered for this user."), result)
+		return false
+	}
+	return verifyJWT(r, publicKey, token, result) &&
+		checkJWTClaims(payload, true, result) && checkReplay(r, token, payload, result)
+}
+
+// authenticateAttestant verifies a JWT signed with publicKey by the
+// registered user configured as attestant, and accepts it only once.
+func authenticateAttestant(r *http.Request, token string, payload map[string]interface{}, attestant string, publicKey string, result map[string]interface{}) bool {
+	cfg := attestantConfig(attestant)
+	if cfg == nil {
+		setAPIError(forbidden("Unknown attestant "+attestant+"."), result)
+		return false
+	}
+	return authenticateUser(r, token, payload, cfg.Proxy, publicKey, result)
+}
+
+// attestantConfig returns the configured attestant named name, if any.
+func attestantConfig(name string) *AttestantConfig {
+	for _, item := range Config().Attestants {
+		if item != nil && item.Name == name {
+			return item
+		}
+	}
+	return nil
+}
+
+// attests reports whether the attestant may attest claims of claimType.
+func (a *AttestantConfig) attests(claimType string) bool {
+	for _, item := range a.Types {
+		if item == claimType {
+			return true
+		}
+	}
+	return false
+}
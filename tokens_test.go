@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckReplay(t *testing.T) {
+	exp := float64(time.Now().Unix() + 300)
+	tests := []struct {
+		name    string
+		first   map[string]interface{}
+		second  map[string]interface{}
+		same    bool
+		replays bool
+	}{
+		{"repeated jti", map[string]interface{}{"jti": "a", "exp": exp}, map[string]interface{}{"jti": "a", "exp": exp}, false, true},
+		{"distinct jti", map[string]interface{}{"jti": "a", "exp": exp}, map[string]interface{}{"jti": "b", "exp": exp}, false, false},
+		{"repeated token without jti", map[string]interface{}{"exp": exp}, map[string]interface{}{"exp": exp}, true, true},
+		{"distinct tokens without jti", map[string]interface{}{"exp": exp}, map[string]interface{}{"exp": exp + 1}, false, false},
+		{"empty jti falls back to the token", map[string]interface{}{"jti": "", "exp": exp}, map[string]interface{}{"jti": "", "exp": exp}, true, true},
+		{"without exp", map[string]interface{}{"jti": "a"}, map[string]interface{}{"jti": "a"}, false, true},
+	}
+	for _, test := range tests {
+		useTestConfig()
+		first := testJWT(t, algES256K, test.first)
+		second := first
+		if !test.same {
+			second = testJWT(t, algES256K, test.second)
+		}
+		result := map[string]interface{}{"error": []string{}}
+		if !checkReplay(nil, first, test.first, result) {
+			t.Errorf("%s: first use rejected: %v", test.name, firstAPIError(result))
+			continue
+		}
+		accepted := checkReplay(nil, second, test.second, result)
+		if test.replays && accepted {
+			t.Errorf("%s: replay accepted", test.name)
+		} else if !test.replays && !accepted {
+			t.Errorf("%s: second token rejected: %v", test.name, firstAPIError(result))
+		} else if test.replays && firstAPIError(result).Status != 401 {
+			t.Errorf("%s: replay answered %d, want 401", test.name, firstAPIError(result).Status)
+		}
+	}
+}
+
+func TestCheckReplayReencodedSignature(t *testing.T) {
+	useTestConfig()
+	payload := map[string]interface{}{"exp": float64(time.Now().Unix() + 300)}
+	token := testJWT(t, algES256K, payload)
+	result := map[string]interface{}{"error": []string{}}
+	if !checkReplay(nil, token, payload, result) {
+		t.Fatalf("first use rejected: %v", firstAPIError(result))
+	}
+	for _, replay := range []string{token + "=", token + "AA", " " + token + " "} {
+		if checkReplay(nil, replay, payload, result) {
+			t.Errorf("replay %q accepted", replay)
+		}
+	}
+}
+
+func TestAuthenticateAttestant(t *testing.T) {
+	useTestConfig()
+	proxy := "0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5"
+	other := "0x0000000000000000000000000000000000000001"
+	Config().Attestants = []*AttestantConfig{{Name: "idhub", Proxy: proxy}, {Name: "bank", Proxy: other}}
+	publicKey := testPublicKey(t, algES256K)
+	Storage().Users().Create(&User{Proxy: proxy, PublicKey: publicKey})
+	payload := map[string]interface{}{"exp": float64(time.Now().Unix() + 300)}
+	token := testJWT(t, algES256K, payload)
+	tests := []struct {
+		name      string
+		attestant string
+		valid     bool
+		status    int
+	}{
+		{"unknown attestant", "nobody", false, 403},
+		{"attestant of another user", "bank", false, 401},
+		{"configured attestant", "idhub", true, 0},
+		{"replay", "idhub", false, 401},
+	}
+	for _, test := range tests {
+		result := map[string]interface{}{"error": []string{}}
+		valid := authenticateAttestant(nil, token, payload, test.attestant, publicKey, result)
+		if valid != test.valid {
+			t.Errorf("%s: valid = %v, want %v (%v)", test.name, valid, test.valid, firstAPIError(result))
+		} else if !valid && firstAPIError(result).Status != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, firstAPIError(result).Status, test.status)
+		}
+	}
+}
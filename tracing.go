@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// W3C trace context. Every inbound request is a server span, continuing the
+// trace of its traceparent header when it has one, and every upstream call
+// a client span whose traceparent is sent along. When tracing.endpoint is
+// set, finished spans are exported in batches to that OTLP/HTTP collector
+// in its JSON encoding.
+
+// OTLP span kinds.
+const (
+	spanServer = 2
+	spanClient = 3
+)
+
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+type span struct {
+	traceID    string
+	spanID     string
+	parentID   string
+	flags      string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	failed     bool
+	attributes map[string]interface{}
+}
+
+func randomID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceparent returns the traceparent header naming s as the parent.
+func (s *span) traceparent() string {
+	return "00-" + s.traceID + "-" + s.spanID + "-" + s.flags
+}
+
+// finish ends s and queues it for export.
+func (s *span) finish(failed bool) {
+	s.end = time.Now()
+	s.failed = failed
+	spans.export(s)
+}
+
+type spanKey struct{}
+
+// spanFrom returns the span carried by ctx, if any.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a span named name as a child of the span in ctx, or of
+// the remote parent in traceparent, or as the root of a new trace.
+func startSpan(ctx context.Context, name string, kind int, traceparent string) *span {
+	s := &span{
+		spanID:     randomID(8),
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID, s.parentID, s.flags = parent.traceID, parent.spanID, parent.flags
+	} else if m := traceparentPattern.FindStringSubmatch(traceparent); m != nil &&
+		m[1] != strings.Repeat("0", 32) && m[2] != strings.Repeat("0", 16) {
+		s.traceID, s.parentID, s.flags = m[1], m[2], m[3]
+	} else {
+		s.traceID, s.flags = randomID(16), "00"
+		if spans.enabled() {
+			s.flags = "01"
+		}
+	}
+	return s
+}
+
+// withTracing serves every request in a server span, which
+// instrumentRoutes names after the route pattern.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		s := startSpan(r.Context(), "HTTP "+r.Method, spanServer, r.Header.Get("traceparent"))
+		s.attributes["http.method"] = r.Method
+		s.attributes["http.target"] = r.URL.Path
+		if id := requestID(r); len(id) > 0 {
+			s.attributes["http.request_id"] = id
+		}
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+		s.attributes["http.status_code"] = recorder.status
+		s.finish(recorder.status >= 500)
+	})
+}
+
+// nameSpan names the server span of r after the route it matched.
+func nameSpan(r *http.Request, route string) {
+	if s := spanFrom(r.Context()); s != nil {
+		s.name = r.Method + " " + route
+		s.attributes["http.route"] = route
+	}
+}
+
+// spanExporter batches finished spans for the OTLP collector. Spans are
+// dropped rather than block requests when the collector falls behind.
+type spanExporter struct {
+	lock     sync.Mutex
+	endpoint string
+	service  string
+	queue    chan *span
+	flushed  chan chan struct{}
+	client   *http.Client
+}
+
+var spans = &spanExporter{}
+
+const (
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+)
+
+// configureTracing starts exporting spans when cfg names an endpoint.
+func configureTracing(cfg *TracingConfig) {
+	if cfg == nil || len(cfg.Endpoint) == 0 {
+		return
+	}
+	service := cfg.ServiceName
+	if len(service) == 0 {
+		service = "winter"
+	}
+	spans.lock.Lock()
+	spans.endpoint = cfg.Endpoint
+	spans.service = service
+	spans.queue = make(chan *span, 4*spanBatchSize)
+	spans.flushed = make(chan chan struct{})
+	spans.client = &http.Client{Transport: upstream.transport, Timeout: 5 * time.Second}
+	spans.lock.Unlock()
+	go spans.run()
+}
+
+func (e *spanExporter) enabled() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.queue != nil
+}
+
+func (e *spanExporter) export(s *span) {
+	if !e.enabled() || s.flags != "01" {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	batch := []*span{}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-e.flushed:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			batch = []*span{}
+			close(done)
+			continue
+		}
+		e.send(batch)
+		batch = []*span{}
+	}
+}
+
+// flush exports the queued spans, waiting until ctx is done at most.
+func (e *spanExporter) flush(ctx context.Context) {
+	if !e.enabled() {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case e.flushed <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	}
+	return map[string]interface{}{"stringValue": ""}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	encoded := []map[string]interface{}{}
+	for key, value := range attributes {
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": otlpValue(value)})
+	}
+	return encoded
+}
+
+func (e *spanExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	encoded := []map[string]interface{}{}
+	for _, s := range batch {
+		status := 0
+		if s.failed {
+			status = 2
+		}
+		item := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            map[string]interface{}{"code": status},
+		}
+		if len(s.parentID) > 0 {
+			item["parentSpanId"] = s.parentID
+		}
+		encoded = append(encoded, item)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": e.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/donh/winter"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logWarn(nil, "export spans error", fields{"error": err, "spans": len(batch)})
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logWarn(nil, "export spans error", fields{"status": resp.StatusCode, "spans": len(batch)})
+	}
+}
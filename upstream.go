@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Outbound calls to the services configured in APIConfig go through one
+// shared client. Every call is named after its APIConfig field, which
+// selects its timeout, whether it may be retried and its circuit breaker,
+// and is bound to the inbound request so that it stops when the request is
+// cancelled.
+
+// idempotentServices may be retried: they read, or prepare transactions
+// without sending them. Calls that fund addresses or send signed
+// transactions are made once.
+var idempotentServices = map[string]bool{
+	"decodeJWT":           true,
+	"encodeJWT":           true,
+	"getBalance":          true,
+	"getIPFS":             true,
+	"prepareIPFS":         true,
+	"prepareProxy":        true,
+	"transferProxyChange": true,
+	"verifyJWT":           true,
+}
+
+// defaultUpstreamTimeouts apply to services whose timeout is not set in
+// UpstreamConfig.Timeouts.
+var defaultUpstreamTimeouts = map[string]time.Duration{
+	"createProxy":       60 * time.Second,
+	"getIPFS":           30 * time.Second,
+	"prepareIPFS":       30 * time.Second,
+	"transferProxySign": 60 * time.Second,
+}
+
+// maxUpstreamResponse bounds the responses read from upstream services.
+const maxUpstreamResponse = 4 << 20
+
+// upstreamConfig returns the configured upstream settings with defaults.
+func upstreamConfig() UpstreamConfig {
+	cfg := UpstreamConfig{}
+	if Config().Upstream != nil {
+		cfg = *Config().Upstream
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	} else if cfg.Retries == 0 {
+		cfg.Retries = 2
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 200
+	}
+	if cfg.BreakerFailures <= 0 {
+		cfg.BreakerFailures = 5
+	}
+	return cfg
+}
+
+func upstreamTimeout(cfg UpstreamConfig, service string) time.Duration {
+	if seconds, ok := cfg.Timeouts[service]; ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if timeout, ok := defaultUpstreamTimeouts[service]; ok {
+		return timeout
+	}
+	return seconds(cfg.Timeout, 10*time.Second)
+}
+
+// breaker is the circuit breaker of one service. It opens after
+// BreakerFailures consecutive failures and lets one trial call through
+// once BreakerCooldown has passed.
+type breaker struct {
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+type upstreamClient struct {
+	transport *http.Transport
+	client    *http.Client
+	lock      sync.Mutex
+	breakers  map[string]*breaker
+}
+
+var upstream = newUpstreamClient()
+
+func newUpstreamClient() *upstreamClient {
+	u := &upstreamClient{
+		transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		breakers: map[string]*breaker{},
+	}
+	// Timeouts come from the context of each call.
+	u.client = &http.Client{Transport: u.transport}
+	return u
+}
+
+// allow reports whether service may be called now.
+func (u *upstreamClient) allow(service string, cfg UpstreamConfig) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	b := u.breakers[service]
+	if b == nil || b.failures < cfg.BreakerFailures {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < seconds(cfg.BreakerCooldown, 30*time.Second) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// tripped reports whether the circuit of service is open.
+func (u *upstreamClient) tripped(service string, cfg UpstreamConfig) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	b := u.breakers[service]
+	return b != nil && b.failures >= cfg.BreakerFailures &&
+		(b.trial || time.Since(b.openedAt) < seconds(cfg.BreakerCooldown, 30*time.Second))
+}
+
+// record counts the outcome of a call to service.
+func (u *upstreamClient) record(service string, failed bool, cfg UpstreamConfig) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	b := u.breakers[service]
+	if b == nil {
+		b = &breaker{}
+		u.breakers[service] = b
+	}
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= cfg.BreakerFailures {
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends a trial call to service without counting its outcome.
+func (u *upstreamClient) release(service string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if b := u.breakers[service]; b != nil {
+		b.trial = false
+	}
+}
+
+// do sends a request to service at destination on behalf of r and returns
+// the body of its 2xx response. Idempotent services are retried with
+// exponential backoff after network errors, 429 and 5xx responses.
+func (u *upstreamClient) do(r *http.Request, service string, method string, destination string, contentType string, body []byte) ([]byte, error) {
+	cfg := upstreamConfig()
+	if !u.allow(service, cfg) {
+		upstreamRequests.inc(service, "rejected")
+		return nil, unavailable(service + " is unavailable, retry later.")
+	}
+	start := time.Now()
+	defer upstreamDuration.since(start, service)
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout(cfg, service))
+	defer cancel()
+
+	attempts := 1
+	if idempotentServices[service] {
+		attempts += cfg.Retries
+	}
+	backoff := time.Duration(cfg.Backoff) * time.Millisecond
+	var content []byte
+	var status int
+	var err error
+attempts:
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff << uint(attempt-1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				break attempts
+			case <-timer.C:
+			}
+		}
+		content, status, err = u.send(ctx, service, method, destination, contentType, body)
+		if err == nil || !retryable(status) || ctx.Err() != nil {
+			break
+		}
+	}
+	if r != nil && r.Context().Err() != nil {
+		// The inbound request was cancelled; that says nothing about the
+		// health of the service, but a trial call must let the next one
+		// through.
+		u.release(service)
+		upstreamRequests.inc(service, "cancelled")
+		return nil, upstreamFailure(r.Context().Err().Error())
+	}
+	u.record(service, err != nil && retryable(status), cfg)
+	if err != nil {
+		logWarn(r, "upstream call failed", fields{"service": service, "status": status, "error": err})
+		upstreamRequests.inc(service, "error")
+	} else {
+		upstreamRequests.inc(service, "ok")
+	}
+	return content, err
+}
+
+// retryable reports whether a call that failed with status, 0 when no
+// response was received, may succeed when repeated.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// send makes one attempt and returns the response body, or the status of
+// the failed response.
+func (u *upstreamClient) send(ctx context.Context, service string, method string, destination string, contentType string, body []byte) (content []byte, status int, err error) {
+	s := startSpan(ctx, method+" "+service, spanClient, "")
+	s.attributes["http.method"] = method
+	s.attributes["peer.service"] = service
+	defer func() {
+		s.attributes["http.status_code"] = status
+		s.finish(err != nil)
+	}()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, destination, reader)
+	if err != nil {
+		return nil, http.StatusBadRequest, upstreamFailure(err.Error())
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("traceparent", s.traceparent())
+	if id := contextRequestID(ctx); len(id) > 0 {
+		req.Header.Set("X-Request-ID", id)
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, upstreamFailure(err.Error())
+	}
+	defer resp.Body.Close()
+	content, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxUpstreamResponse))
+	if err != nil {
+		return nil, 0, upstreamFailure(err.Error())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, resp.StatusCode, upstreamFailure("upstream answered " + resp.Status)
+	}
+	return content, resp.StatusCode, nil
+}
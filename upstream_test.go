@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamBreaker(t *testing.T) {
+	useTestConfig()
+	Config().Upstream = &UpstreamConfig{BreakerFailures: 2, BreakerCooldown: 30, Retries: -1}
+	var calls, healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rw.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	u := newUpstreamClient()
+	call := func() error {
+		_, err := u.do(nil, "getBalance", "GET", server.URL, "", nil)
+		return err
+	}
+	// cooldown moves the opening of the circuit past its cooldown.
+	cooldown := func() {
+		u.lock.Lock()
+		u.breakers["getBalance"].openedAt = time.Now().Add(-time.Minute)
+		u.lock.Unlock()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := call(); err == nil {
+			t.Fatalf("call %d succeeded against a failing service", i)
+		}
+	}
+	if err := call(); toAPIError(nil, err).Status != http.StatusServiceUnavailable {
+		t.Errorf("open circuit: err = %v, want unavailable", err)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("open circuit: service called %d times, want 2", atomic.LoadInt32(&calls))
+	}
+
+	cooldown()
+	if !u.allow("getBalance", upstreamConfig()) {
+		t.Fatalf("half-open circuit rejected the trial call")
+	}
+	if u.allow("getBalance", upstreamConfig()) {
+		t.Errorf("half-open circuit let a second call through during the trial")
+	}
+	u.release("getBalance")
+
+	if err := call(); err == nil || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("failed trial: err = %v, calls = %d, want an error and 3 calls", err, atomic.LoadInt32(&calls))
+	}
+	if !u.tripped("getBalance", upstreamConfig()) {
+		t.Errorf("circuit closed after a failed trial")
+	}
+
+	cooldown()
+	atomic.StoreInt32(&healthy, 1)
+	if err := call(); err != nil {
+		t.Fatalf("successful trial: %v", err)
+	}
+	if u.tripped("getBalance", upstreamConfig()) {
+		t.Errorf("circuit still open after a successful trial")
+	}
+	if err := call(); err != nil || atomic.LoadInt32(&calls) != 5 {
+		t.Errorf("closed circuit: err = %v, calls = %d, want 5 calls", err, atomic.LoadInt32(&calls))
+	}
+}
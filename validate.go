@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	addressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+	hexPattern     = regexp.MustCompile(`^(0x)?[0-9a-fA-F]+$`)
+	jwtPattern     = regexp.MustCompile(`^[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*$`)
+	phonePattern   = regexp.MustCompile(`^\+?[0-9]{6,15}$`)
+	numberPattern  = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// Request bodies. Field sizes follow the columns the values are stored in.
+
+type createUserRequest struct {
+	Name        string `json:"name" validate:"required,max=128"`
+	Phone       string `json:"phone" validate:"required,max=16,phone"`
+	PublicKey   string `json:"publicKey" validate:"required,max=150,hex"`
+	Address     string `json:"address" validate:"required,max=70,address"`
+	RawTxSigned string `json:"rawTxSigned" validate:"hex"`
+	PrivateKey  string `json:"privateKey"`
+}
+
+type clientTokenRequest struct {
+	ClientJWT string `json:"clientJWT" validate:"required,jwt"`
+}
+
+type userLoginRequest struct {
+	UserJWT string `json:"userJWT" validate:"required,jwt"`
+}
+
+type userAuthorizationRequest struct {
+	AuthorizationJWT string `json:"authorizationJWT" validate:"required,jwt"`
+}
+
+type createClaimRequest struct {
+	ClaimJWT string `json:"claimJWT" validate:"required,jwt"`
+}
+
+type createAttestationRequest struct {
+	Attestant   string `json:"attestant" validate:"required,max=30"`
+	Attestation string `json:"attestation" validate:"required,jwt"`
+	ClaimID     string `json:"claimID" validate:"required,number"`
+	ClaimType   string `json:"claimType" validate:"required,max=30"`
+	Proxy       string `json:"proxy" validate:"required,max=50,address"`
+	Status      string `json:"status" validate:"required,max=15"`
+}
+
+type getAttestationRequest struct {
+	AttestationJWT string `json:"attestationJWT" validate:"required,jwt"`
+}
+
+type revokeAttestationRequest struct {
+	RevocationJWT string `json:"revocationJWT" validate:"required,jwt"`
+}
+
+type credentialRequest struct {
+	CredentialJWT string `json:"credentialJWT" validate:"required,jwt"`
+	Format        string `json:"format"`
+}
+
+type presentationRequest struct {
+	Presentation string `json:"presentation" validate:"required,jwt"`
+	Challenge    string `json:"challenge" validate:"max=255"`
+	Audience     string `json:"audience" validate:"max=255"`
+}
+
+type socketRequest struct {
+	Token string `json:"token"`
+}
+
+// JWT contexts. Unlike request bodies these may carry extra claims.
+
+// clientContext identifies the client by name; its JWT is verified against
+// the keys registered for that name, not against clientPublicKey. A
+// requester that names the user with userProxy is served from a standing
+// consent of that user when there is one.
+type clientContext struct {
+	ClientName      string `json:"clientName" validate:"max=128"`
+	ClientPublicKey string `json:"clientPublicKey" validate:"max=150,hex"`
+	RequesterName   string `json:"requesterName" validate:"max=128"`
+	Scope           string `json:"scope" validate:"max=100"`
+	UserProxy       string `json:"userProxy" validate:"max=50,address"`
+}
+
+type userContext struct {
+	UserProxy     string `json:"userProxy" validate:"required,max=50,address"`
+	UserPublicKey string `json:"userPublicKey" validate:"required,max=150,hex"`
+	Scope         string `json:"scope" validate:"max=100"`
+	Token         string `json:"token" validate:"max=40"`
+}
+
+type attestantContext struct {
+	AttestantPublicKey string `json:"attestantPublicKey" validate:"required,max=150,hex"`
+	AttestationID      string `json:"attestationID" validate:"number"`
+	Reason             string `json:"reason" validate:"max=255"`
+}
+
+// attestationContext is the signed context of an attestation. Its claim
+// fields must repeat those of the request body.
+type attestationContext struct {
+	Attestant          string `json:"attestant" validate:"required,max=30"`
+	AttestantPublicKey string `json:"attestantPublicKey" validate:"required,max=150,hex"`
+	ClaimID            string `json:"claimID" validate:"required,number"`
+	ClaimType          string `json:"claimType" validate:"required,max=30"`
+	Proxy              string `json:"proxy" validate:"required,max=50,address"`
+	Reason             string `json:"reason" validate:"max=255"`
+	Status             string `json:"status" validate:"required,max=15"`
+}
+
+// jsonFields returns the JSON names of the fields of the struct v points to.
+func jsonFields(v interface{}) map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) > 0 && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// decodeRequest strictly decodes the JSON body of r into v and validates it.
+// Unknown fields, trailing data and invalid values are recorded in result
+// as 400 errors and a body over the server limit as a 413; it reports
+// whether v may be used.
+func decodeRequest(r *http.Request, v interface{}, result map[string]interface{}) bool {
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		// http.MaxBytesReader reports the body limit with this message only.
+		if err.Error() == "http: request body too large" {
+			setAPIError(tooLarge("Request body is too large."), result)
+		} else {
+			setAPIError(badRequest("", "Request body could not be read."), result)
+		}
+		return false
+	}
+	decoder := json.NewDecoder(buf)
+	raw := map[string]json.RawMessage{}
+	if err := decoder.Decode(&raw); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			setAPIError(badRequest("", "Request body must be a JSON object."), result)
+		} else {
+			setAPIError(badRequest("", "Invalid JSON body: "+err.Error()), result)
+		}
+		return false
+	}
+	if decoder.More() {
+		setAPIError(badRequest("", "Invalid JSON body: unexpected data after object"), result)
+		return false
+	}
+	fields := jsonFields(v)
+	names := []string{}
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	valid := true
+	for _, name := range names {
+		if !fields[name] {
+			setAPIError(badRequest(name, "Unknown field "+name+"."), result)
+			valid = false
+		}
+	}
+	if !valid {
+		return false
+	}
+	for _, name := range names {
+		if err := decodeField(v, name, raw[name]); err != nil {
+			setAPIError(badRequest(name, err.Error()), result)
+			valid = false
+		}
+	}
+	return valid && validateStruct(v, result)
+}
+
+func decodeField(v interface{}, name string, value json.RawMessage) error {
+	object := map[string]json.RawMessage{name: value}
+	bs, _ := json.Marshal(object)
+	if err := json.Unmarshal(bs, v); err != nil {
+		return fmt.Errorf("%s has an invalid type.", name)
+	}
+	return nil
+}
+
+// decodeContext decodes and validates the context claim of a JWT payload.
+func decodeContext(payload map[string]interface{}, v interface{}, result map[string]interface{}) bool {
+	context, ok := payload["context"].(map[string]interface{})
+	if !ok {
+		setAPIError(badRequest("context", "JWT has no context."), result)
+		return false
+	}
+	bs, _ := json.Marshal(context)
+	if err := json.Unmarshal(bs, v); err != nil {
+		setAPIError(badRequest("context", "Invalid JWT context: "+err.Error()), result)
+		return false
+	}
+	return validateStruct(v, result)
+}
+
+// validateStruct applies the validate tags of the struct v points to and
+// records one error per invalid field.
+func validateStruct(v interface{}, result map[string]interface{}) bool {
+	valid := true
+	value := reflect.ValueOf(v).Elem()
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		rules := field.Tag.Get("validate")
+		if len(rules) == 0 || field.Type.Kind() != reflect.String {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if message := validateString(name, value.Field(i).String(), rules); len(message) > 0 {
+			setAPIError(badRequest(name, message), result)
+			valid = false
+		}
+	}
+	return valid
+}
+
+// validateString checks s against comma separated rules and returns the
+// first violation. Format rules only apply to non-empty values.
+func validateString(name string, s string, rules string) string {
+	for _, rule := range strings.Split(rules, ",") {
+		switch {
+		case rule == "required":
+			if len(strings.TrimSpace(s)) == 0 {
+				return name + " is required."
+			}
+		case strings.HasPrefix(rule, "max="):
+			max, _ := strconv.Atoi(strings.TrimPrefix(rule, "max="))
+			if utf8.RuneCountInString(s) > max {
+				return fmt.Sprintf("%s must be at most %d characters.", name, max)
+			}
+		case rule == "address":
+			if len(s) > 0 && !addressPattern.MatchString(s) {
+				return name + " must be a 0x-prefixed 20 byte hex address."
+			}
+		case rule == "hex":
+			if len(s) > 0 && !hexPattern.MatchString(s) {
+				return name + " must be hex encoded."
+			}
+		case rule == "jwt":
+			if len(s) > 0 && !jwtPattern.MatchString(s) {
+				return name + " must be a compact JWT."
+			}
+		case rule == "number":
+			if len(s) > 0 && !numberPattern.MatchString(s) {
+				return name + " must be a number."
+			}
+		case rule == "phone":
+			if len(s) > 0 && !phonePattern.MatchString(s) {
+				return name + " must be a phone number of 6 to 15 digits."
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateString(t *testing.T) {
+	tests := []struct {
+		value string
+		rules string
+		valid bool
+	}{
+		{"", "required", false},
+		{"  ", "required", false},
+		{"name", "required,max=4", true},
+		{"names", "required,max=4", false},
+		{"ñame", "max=4", true},
+		{"0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5", "address", true},
+		{"52bc44d5378309ee2abf1539bf71de1b7d7be3b5", "address", false},
+		{"0x52bc", "address", false},
+		{"04abcdef", "hex", true},
+		{"04abcdeg", "hex", false},
+		{"eyJhbGciOiJFUzI1NksifQ.e30.c2ln", "jwt", true},
+		{"eyJhbGciOiJFUzI1NksifQ.e30", "jwt", false},
+		{"123", "number", true},
+		{"12a", "number", false},
+		{"", "number", true},
+		{"+886912345678", "phone", true},
+		{"12345", "phone", false},
+	}
+	for _, test := range tests {
+		message := validateString("field", test.value, test.rules)
+		if test.valid && len(message) > 0 {
+			t.Errorf("%q with %s: %s", test.value, test.rules, message)
+		} else if !test.valid && len(message) == 0 {
+			t.Errorf("%q with %s: accepted", test.value, test.rules)
+		}
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"valid", `{"clientJWT": "eyJhbGciOiJFUzI1NksifQ.e30.c2ln"}`, 0},
+		{"unknown field", `{"clientJWT": "eyJhbGciOiJFUzI1NksifQ.e30.c2ln", "admin": true}`, 400},
+		{"trailing data", `{"clientJWT": "eyJhbGciOiJFUzI1NksifQ.e30.c2ln"} {}`, 400},
+		{"not an object", `["clientJWT"]`, 400},
+		{"invalid value", `{"clientJWT": "not a JWT"}`, 400},
+		{"missing value", `{}`, 400},
+		{"not JSON", `clientJWT`, 400},
+	}
+	for _, test := range tests {
+		var req clientTokenRequest
+		result := map[string]interface{}{"error": []string{}}
+		valid := decodeRequest(httptest.NewRequest("POST", "/", strings.NewReader(test.body)), &req, result)
+		if test.status == 0 && !valid {
+			t.Errorf("%s: rejected: %v", test.name, firstAPIError(result))
+		} else if test.status != 0 && (valid || firstAPIError(result).Status != test.status) {
+			t.Errorf("%s: valid = %v, error %v, want %d", test.name, valid, firstAPIError(result), test.status)
+		}
+	}
+}
+
+func TestDecodeRequestBodyLimit(t *testing.T) {
+	useTestConfig()
+	var status int
+	handler := limitBody(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req clientTokenRequest
+		result := map[string]interface{}{"error": []string{}}
+		if !decodeRequest(r, &req, result) {
+			status = firstAPIError(result).Status
+		}
+	}), 16)
+	// A streamed body has no Content-Length, so only the reader sees the
+	// limit.
+	body, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte(`{"clientJWT": "` + strings.Repeat("a", 64) + `"}`))
+		writer.Close()
+	}()
+	req := httptest.NewRequest("POST", "/", body)
+	req.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if status != 413 {
+		t.Errorf("status = %d, want 413", status)
+	}
+}
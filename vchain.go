@@ -1,16 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
-	"github.com/astaxie/beego/orm"
 	"github.com/bitly/go-simplejson"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/googollee/go-socket.io"
-	"github.com/satori/go.uuid"
 	"github.com/toolkits/file"
-	"log"
 	"math"
 	"net/http"
 	"net/url"
@@ -20,6 +16,18 @@ import (
 	"time"
 )
 
+// AdminConfig ...
+type AdminConfig struct {
+	Token string `json:"token"`
+}
+
+// AttestantConfig ...
+type AttestantConfig struct {
+	Name  string   `json:"name"`
+	Proxy string   `json:"proxy"`
+	Types []string `json:"types"`
+}
+
 // APIConfig ...
 type APIConfig struct {
 	CreateProxy         string `json:"createProxy"`
@@ -37,20 +45,103 @@ type APIConfig struct {
 	VerifyJWT           string `json:"verifyJWT"`
 }
 
+// DIDConfig ...
+type DIDConfig struct {
+	CacheSize   int    `json:"cacheSize"`
+	CacheTTL    int    `json:"cacheTTL"`
+	IPFSGateway string `json:"ipfsGateway"`
+	Mode        string `json:"mode"`
+	ResolverURL string `json:"resolverURL"`
+}
+
 // DBConfig ...
 type DBConfig struct {
 	Address string `json:"address"`
+	Driver  string `json:"driver"`
 	Idle    int    `json:"idle"`
 	Max     int    `json:"max"`
+	Migrate bool   `json:"migrate"`
 }
 
 // JWTConfig ...
 type JWTConfig struct {
+	Algorithm        string `json:"algorithm"`
+	Audience         string `json:"audience"`
+	Issuer           string `json:"issuer"`
+	Leeway           int    `json:"leeway"`
+	Mode             string `json:"mode"`
 	ServerPrivateKey string `json:"serverPrivateKey"`
 	ServerPublicKey  string `json:"serverPublicKey"`
 	ServerURL        string `json:"serverURL"`
 }
 
+// LogConfig ...
+type LogConfig struct {
+	Level  string `json:"level"`
+	Output string `json:"output"`
+}
+
+// MetricsConfig ...
+type MetricsConfig struct {
+	Token string `json:"token"`
+}
+
+// OIDCConfig ...
+type OIDCConfig struct {
+	AccessTokenTTL int    `json:"accessTokenTTL"`
+	Issuer         string `json:"issuer"`
+}
+
+// RecoveryConfig ...
+type RecoveryConfig struct {
+	Approvals int `json:"approvals"`
+	Delay     int `json:"delay"`
+}
+
+// IPFSConfig ...
+type IPFSConfig struct {
+	Dir   string `json:"dir"`
+	Store string `json:"store"`
+}
+
+// KeystoreConfig ...
+type KeystoreConfig struct {
+	MasterKeyFile string `json:"masterKeyFile"`
+}
+
+// TracingConfig ...
+type TracingConfig struct {
+	Endpoint    string `json:"endpoint"`
+	ServiceName string `json:"serviceName"`
+}
+
+// UpstreamConfig ...
+type UpstreamConfig struct {
+	Backoff         int            `json:"backoff"`
+	BreakerCooldown int            `json:"breakerCooldown"`
+	BreakerFailures int            `json:"breakerFailures"`
+	Required        []string       `json:"required"`
+	Retries         int            `json:"retries"`
+	Timeout         int            `json:"timeout"`
+	Timeouts        map[string]int `json:"timeouts"`
+}
+
+// WebsocketConfig ...
+type WebsocketConfig struct {
+	Timeout int `json:"timeout"`
+}
+
+// ServerConfig ...
+type ServerConfig struct {
+	IdleTimeout       int   `json:"idleTimeout"`
+	MaxBodyBytes      int64 `json:"maxBodyBytes"`
+	MaxHeaderBytes    int   `json:"maxHeaderBytes"`
+	ReadHeaderTimeout int   `json:"readHeaderTimeout"`
+	ReadTimeout       int   `json:"readTimeout"`
+	ShutdownTimeout   int   `json:"shutdownTimeout"`
+	WriteTimeout      int   `json:"writeTimeout"`
+}
+
 // PathConfig ...
 type PathConfig struct {
 	Claim string `json:"claim"`
@@ -59,12 +150,27 @@ type PathConfig struct {
 
 // GlobalConfig ...
 type GlobalConfig struct {
-	API      *APIConfig  `json:"api"`
-	Database *DBConfig   `json:"database"`
-	Delegate string      `json:"delegate"`
-	JWT      *JWTConfig  `json:"jwt"`
-	Path     *PathConfig `json:"path"`
-	Port     int         `json:"port"`
+	Admin        *AdminConfig       `json:"admin"`
+	API          *APIConfig         `json:"api"`
+	Attestants   []*AttestantConfig `json:"attestants"`
+	Database     *DBConfig          `json:"database"`
+	Delegate     string             `json:"delegate"`
+	DID          *DIDConfig         `json:"did"`
+	Gateway      string             `json:"gateway"`
+	IPFS         *IPFSConfig        `json:"ipfs"`
+	JWT          *JWTConfig         `json:"jwt"`
+	Keystore     *KeystoreConfig    `json:"keystore"`
+	LegacyErrors bool               `json:"legacyErrors"`
+	Log          *LogConfig         `json:"log"`
+	Metrics      *MetricsConfig     `json:"metrics"`
+	OIDC         *OIDCConfig        `json:"oidc"`
+	Path         *PathConfig        `json:"path"`
+	Port         int                `json:"port"`
+	Recovery     *RecoveryConfig    `json:"recovery"`
+	Server       *ServerConfig      `json:"server"`
+	Tracing      *TracingConfig     `json:"tracing"`
+	Upstream     *UpstreamConfig    `json:"upstream"`
+	Websocket    *WebsocketConfig   `json:"websocket"`
 }
 
 var (
@@ -88,21 +194,21 @@ func setConfig(newConfig *GlobalConfig) {
 
 func parseConfig(cfg string) {
 	if cfg == "" {
-		log.Fatalln("config file not specified: use -c $filename")
+		logFatal(nil, "config file not specified: use -c $filename", nil)
 	}
 	if !file.IsExist(cfg) {
-		log.Fatalln("config file specified not found:", cfg)
+		logFatal(nil, "config file specified not found", fields{"file": cfg})
 	}
 	configFile = cfg
 
 	configContent, err := file.ToTrimString(cfg)
 	if err != nil {
-		log.Fatalln("read config file", cfg, "error:", err.Error())
+		logFatal(nil, "read config file error", fields{"file": cfg, "error": err})
 	}
 	var c GlobalConfig
 	err = json.Unmarshal([]byte(configContent), &c)
 	if err != nil {
-		log.Fatalln("parse config file", cfg, "error:", err.Error())
+		logFatal(nil, "parse config file error", fields{"file": cfg, "error": err})
 	}
 	setConfig(&c)
 }
@@ -117,14 +223,29 @@ func setResponse(rw http.ResponseWriter, resp map[string]interface{}) {
 	if _, ok := resp["params"]; ok {
 		delete(resp, "params")
 	}
+	status := http.StatusOK
 	if _, ok := resp["result"]; ok {
 		result := resp["result"].(map[string]interface{})
 		if val, ok := result["error"]; ok {
 			errors := val.([]string)
 			if len(errors) > 0 {
 				delete(resp, "result")
-				resp["error"] = errors
+				if legacyErrors() {
+					resp["error"] = errors
+				} else {
+					details, _ := result["errorDetails"].([]*APIError)
+					if len(details) == 0 {
+						details = []*APIError{firstAPIError(result)}
+					}
+					resp["error"] = details[0]
+					resp["errors"] = details
+					if id := rw.Header().Get("X-Request-ID"); len(id) > 0 {
+						resp["requestId"] = id
+					}
+					status = details[0].Status
+				}
 			} else {
+				delete(resp["result"].(map[string]interface{}), "errorDetails")
 				delete(resp["result"].(map[string]interface{}), "error")
 				if val, ok = result["items"]; ok {
 					resp["result"] = val
@@ -139,16 +260,17 @@ func setResponse(rw http.ResponseWriter, resp map[string]interface{}) {
 		}
 	}
 	resp["time"] = getNow()
-	renderJSON(rw, resp)
+	renderJSON(rw, status, resp)
 }
 
-func renderJSON(w http.ResponseWriter, v interface{}) {
+func renderJSON(w http.ResponseWriter, status int, v interface{}) {
 	bs, err := json.Marshal(v)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
 	w.Write(bs)
 }
 
@@ -158,61 +280,49 @@ func getNow() string {
 	return now
 }
 
-func setError(error string, result map[string]interface{}) {
-	log.Println("Error =", error)
-	result["error"] = append(result["error"].([]string), error)
-}
-
-func postByJSON(req *http.Request, destination string, params map[string]interface{}, result map[string]interface{}) map[string]interface{} {
-	log.Println("func postByJSON() destination =", destination)
-	log.Println("func postByJSON() params =", params)
-	JSONString, _ := json.Marshal(params)
-	reqPost, err := http.NewRequest("POST", destination, bytes.NewBuffer(JSONString))
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	reqPost.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(reqPost)
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	defer resp.Body.Close()
-
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	json, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	response := map[string]interface{}{}
-	response, _ = json.Map()
-	return response
+// postByJSON posts params as JSON to service at destination and returns
+// its JSON response.
+func postByJSON(req *http.Request, service string, destination string, params map[string]interface{}, result map[string]interface{}) map[string]interface{} {
+	logDebug(req, "upstream request", fields{"service": service, "destination": destination, "params": params})
+	body, _ := json.Marshal(params)
+	content, err := upstream.do(req, service, "POST", destination, "application/json", body)
+	return parseUpstream(req, content, err, result)
 }
 
-func postByForm(req *http.Request, destination string, params map[string]string, result map[string]interface{}) map[string]interface{} {
-	log.Println("func postByForm() destination =", destination)
-	log.Println("func postByForm() params =", params)
+// postByForm posts params as a form to service at destination and returns
+// its JSON response.
+func postByForm(req *http.Request, service string, destination string, params map[string]string, result map[string]interface{}) map[string]interface{} {
+	logDebug(req, "upstream request", fields{"service": service, "destination": destination, "params": params})
 	form := url.Values{}
 	for key, value := range params {
 		form.Add(key, value)
 	}
-	client := &http.Client{}
-	resp, err := client.PostForm(destination, form)
+	content, err := upstream.do(req, service, "POST", destination, "application/x-www-form-urlencoded", []byte(form.Encode()))
+	return parseUpstream(req, content, err, result)
+}
+
+func getByJSON(req *http.Request, service string, destination string, result map[string]interface{}) map[string]interface{} {
+	logDebug(req, "upstream request", fields{"service": service, "destination": destination})
+	content, err := upstream.do(req, service, "GET", destination, "", nil)
+	return parseUpstream(req, content, err, result)
+}
+
+// parseUpstream decodes the JSON object answered by an upstream service,
+// recording err or a malformed response in result.
+func parseUpstream(r *http.Request, content []byte, err error, result map[string]interface{}) map[string]interface{} {
+	response := map[string]interface{}{}
 	if err != nil {
-		setError(err.Error(), result)
+		setFailure(r, err, result)
+		return response
 	}
-	defer resp.Body.Close()
-
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	json, err := simplejson.NewJson(buf.Bytes())
+	json, err := simplejson.NewJson(content)
 	if err != nil {
-		setError(err.Error(), result)
+		setAPIError(upstreamFailure(err.Error()), result)
+		return response
+	}
+	if decoded, err := json.Map(); err == nil {
+		response = decoded
 	}
-	response := map[string]interface{}{}
-	response, _ = json.Map()
 	return response
 }
 
@@ -221,119 +331,58 @@ func createUser(rw http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	user := map[string]interface{}{}
-	user, _ = sjson.Map()
-	address := user["address"].(string)
-	privateKey := user["privateKey"].(string)
-
-	needCoins := true
-	URL := Config().API.GetBalance + "/" + address
-	req, err := http.NewRequest("GET", URL, nil)
-	if err != nil {
-		setError(err.Error(), result)
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	defer resp.Body.Close()
-
-	buf = new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	sjson, err = simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	response := map[string]interface{}{}
-	response, _ = sjson.Map()
-
-	if value, ok := response["1"]; ok {
-		balance, err := strconv.ParseFloat(value.(string), 64)
-		if (err == nil) && (balance > 10) {
-			needCoins = false
-		}
-	}
-
-	if needCoins {
-		URL = Config().API.GetCoin
-		params := map[string]interface{}{
-			"addr":   address,
-			"amount": "10",
-		}
-		response = postByJSON(r, URL, params, result)
-	}
-
-	URL = Config().API.PrepareProxy
-	params := map[string]string{
-		"delegates":     Config().Delegate,
-		"senderAddress": address,
-		"userKey":       address,
-	}
-	response = postByForm(r, URL, params, result)
-	rawTranscation := response["rawTx"].(string)
-
-	URL = Config().API.SignTransaction
-	paramsJSON := map[string]interface{}{
-		"pri_key": privateKey,
-		"raw_tx":  rawTranscation,
-	}
-	response = postByJSON(r, URL, paramsJSON, result)
-	signedTranscation := response["result"].(string)
-
-	URL = Config().API.CreateProxy
-	params = map[string]string{
-		"rawTxSigned":   signedTranscation,
-		"senderAddress": address,
-		"userKey":       address,
-	}
-	response = postByForm(r, URL, params, result)
-	contract := response["contract"].(map[string]interface{})
-	proxy := contract["proxy"].(string)
-	user["proxy"] = proxy
-	user["controller"] = contract["controller"].(string)
-	user["recovery"] = contract["recovery"].(string)
-
-	account := map[string]string{}
-	o := orm.NewOrm()
-	o.Using("vchain")
-	rows := []orm.Params{}
-	sql := "SELECT id FROM `vchain`.`users` WHERE publickey = ? LIMIT 1"
-	num, err := o.Raw(sql, user["publicKey"]).Values(&rows)
-	if err != nil {
-		setError(err.Error(), result)
-	} else if num == 0 {
-		now := getNow()
-		sql = "INSERT INTO `vchain`.`users`(`name`, `phone`,"
-		sql += "`privatekey`, `publickey`, `address`, `proxy`,"
-		sql += "`controller`, `recovery`, `created`, `updated`) VALUES("
-		sql += "?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
-		_, err := o.Raw(sql, user["name"], user["phone"],
-			user["privateKey"], user["publicKey"],
-			user["address"], user["proxy"], user["controller"],
-			user["recovery"], now, now).Exec()
-		if err != nil {
-			setError(err.Error(), result)
+	// Registration takes two calls: the first returns the unsigned rawTx,
+	// the second carries it as rawTxSigned after the client has signed it.
+	var req createUserRequest
+	user := map[string]string{}
+	if decodeRequest(r, &req, result) {
+		if len(req.PrivateKey) > 0 {
+			setAPIError(badRequest("privateKey", "Private keys are not accepted; sign rawTx and send rawTxSigned."), result)
+		} else if len(req.RawTxSigned) == 0 {
+			rawTx, err := prepareOnboarding(r, req.Address)
+			if err != nil {
+				setFailure(r, err, result)
+			} else {
+				result["rawTx"] = rawTx
+			}
+		} else if contract, err := gateway.CreateProxy(r, req.Address, req.RawTxSigned); err != nil {
+			setFailure(r, err, result)
 		} else {
-			account["name"] = user["name"].(string)
-			account["phone"] = user["phone"].(string)
-			account["privateKey"] = user["privateKey"].(string)
-			account["publicKey"] = user["publicKey"].(string)
-			account["address"] = user["address"].(string)
-			account["proxy"] = user["proxy"].(string)
-			account["controller"] = user["controller"].(string)
-			account["recovery"] = user["recovery"].(string)
+			users := Storage().Users()
+			_, err = users.FindByPublicKey(req.PublicKey)
+			if err == nil {
+				setAPIError(conflict("User existed."), result)
+			} else if err != errNotFound {
+				setFailure(r, err, result)
+			} else {
+				now := getNow()
+				err = users.Create(&User{
+					Name:       req.Name,
+					Phone:      req.Phone,
+					PublicKey:  req.PublicKey,
+					Address:    req.Address,
+					Proxy:      contract.Proxy,
+					Controller: contract.Controller,
+					Recovery:   contract.Recovery,
+					Created:    now,
+					Updated:    now,
+				})
+				if err != nil {
+					setFailure(r, err, result)
+				} else {
+					user["proxy"] = contract.Proxy
+					user["controller"] = contract.Controller
+					user["recovery"] = contract.Recovery
+				}
+			}
 		}
-	}
 
+	}
 	nodes := map[string]interface{}{}
+	user["name"] = req.Name
+	user["phone"] = req.Phone
+	user["publicKey"] = req.PublicKey
+	user["address"] = req.Address
 	result["user"] = user
 	nodes["result"] = result
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
@@ -345,60 +394,31 @@ func generateLoginToken(rw http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload := map[string]interface{}{}
-	payload, _ = sjson.Map()
-	clientJWT := payload["clientJWT"].(string)
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": clientJWT,
-	}
-	response := postByJSON(r, URL, params, result)
-	body := response["payload"]
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	publicKey := context["clientPublicKey"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  clientJWT,
-	}
-	response = postByJSON(r, URL, params, result)
-
+	var req clientTokenRequest
+	var context clientContext
+	var client *Client
+	var scope Scope
 	serverJWT := ""
 	token := ""
-	if verification, ok := response["result"]; ok {
-		if verification == "True" {
-			token = strings.Replace(uuid.NewV4().String(), "-", "", -1)
-			serverContext := map[string]string{
-				"clientName":      context["clientName"].(string),
-				"scope":           context["scope"].(string),
-				"serverPublicKey": Config().JWT.ServerPublicKey,
-				"token":           token,
-			}
+	if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ClientJWT, result)
+		valid := firstAPIError(result) == nil && decodeContext(body, &context, result)
+		if valid {
+			scope, valid = requestScope(context.Scope, result)
+		}
+		if valid {
+			client = authorizeClient(r, context.ClientName, req.ClientJWT, scope, result)
+		}
+		if client != nil && checkJWTClaims(body, true, result) && checkReplay(r, req.ClientJWT, body, result) {
 			iat := time.Now().UTC().Unix()
-			exp := iat + 300
-			serverJSON := map[string]interface{}{
-				"iss":     "idhub.chancheng.server",
-				"aud":     "idhub.chancheng.user",
-				"iat":     iat,
-				"exp":     exp,
-				"sub":     "login token",
-				"context": serverContext,
-			}
-
-			URL = Config().API.EncodeJWT
-			params = map[string]interface{}{
-				"payload":     serverJSON,
-				"private_key": Config().JWT.ServerPrivateKey,
+			exp := iat + tokenTTL
+			item, err := issueToken(tokenLogin, scope.String(), client.Name, exp)
+			if err != nil {
+				setFailure(r, err, result)
+			} else {
+				token = item.Token
+				serverJWT = loginJWT(r, item, iat, exp, result)
 			}
-			response = postByJSON(r, URL, params, result)
-			serverJWT = response["token"].(string)
 		}
 	}
 
@@ -410,74 +430,45 @@ func generateLoginToken(rw http.ResponseWriter, r *http.Request) {
 	setResponse(rw, nodes)
 }
 
+// loginJWT returns the server JWT the mobile app signs in to the client
+// that requested the login token item.
+func loginJWT(r *http.Request, item *Token, iat int64, exp int64, result map[string]interface{}) string {
+	serverContext := map[string]string{
+		"clientName":      item.Client,
+		"scope":           item.Scope,
+		"serverPublicKey": Config().JWT.ServerPublicKey,
+		"token":           item.Token,
+	}
+	serverJSON := map[string]interface{}{
+		"iss":     serverIssuer,
+		"aud":     userAudience,
+		"iat":     iat,
+		"exp":     exp,
+		"sub":     "login token",
+		"context": serverContext,
+	}
+	return encodeJWT(r, serverJSON, result)
+}
+
 func validateUsersLoginJWT(rw http.ResponseWriter, r *http.Request) {
 	errors := []string{}
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload, _ := sjson.Map()
-	userJWT := payload["userJWT"].(string)
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": userJWT,
-	}
-	response := postByJSON(r, URL, params, result)
-	body := response["payload"]
+	var req userLoginRequest
+	var context userContext
 	valid := false
-	expired := true
-	exp, err := body.(map[string]interface{})["exp"].(json.Number).Int64()
-	if err == nil {
-		diff := exp - time.Now().UTC().Unix()
-		if diff > 0 {
-			expired = false
-		}
-	}
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	proxy := context["userProxy"].(string)
-	publicKey := context["userPublicKey"].(string)
-	scope := context["scope"].(string)
-	token := context["token"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  userJWT,
-	}
-	response = postByJSON(r, URL, params, result)
-
-	if (response["result"] == "True") && !expired {
-		valid = true
-	}
-
-	now := getNow()
-	o := orm.NewOrm()
-	o.Using("vchain")
-	rows := []orm.Params{}
-	sql := "SELECT token FROM `vchain`.`tokens` WHERE token = ? LIMIT 1"
-	num, err := o.Raw(sql, token).Values(&rows)
-	if err != nil {
-		setError(err.Error(), result)
-	} else if num == 0 {
-		sql = "INSERT INTO `vchain`.`tokens`(`token`, `valid`,"
-		sql += "`proxy`, `scope`, `created`) VALUES("
-		sql += "?, ?, ?, ?, ?)"
-		_, err = o.Raw(sql, token, valid, proxy, scope, now).Exec()
-		if err != nil {
-			setError(err.Error(), result)
-		}
-	} else if num > 0 {
-		sql := "UPDATE `vchain`.`tokens`"
-		sql += " SET `valid` = ?, `proxy` = ?, `scope` = ?,"
-		sql += " `created` = ? WHERE token = ?"
-		_, err = o.Raw(sql, valid, proxy, scope, now, token).Exec()
-		if err != nil {
-			setError(err.Error(), result)
+	if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.UserJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) {
+			if len(context.Token) == 0 {
+				setAPIError(badRequest("token", "token is required."), result)
+			} else if scope, ok := requestScope(context.Scope, result); ok {
+				if item := checkToken(r, context.Token, tokenLogin, scope, result); item != nil &&
+					authenticateUser(r, req.UserJWT, body, context.UserProxy, context.UserPublicKey, result) {
+					valid = consumeToken(r, item, context.UserProxy, scope, true, result)
+				}
+			}
 		}
 	}
 
@@ -488,139 +479,105 @@ func validateUsersLoginJWT(rw http.ResponseWriter, r *http.Request) {
 	setResponse(rw, nodes)
 }
 
-func getAttestationData(proxy string, attestationType string, result map[string]interface{}) map[string]string {
+func getAttestationData(r *http.Request, proxy string, attestationType string, result map[string]interface{}) map[string]string {
 	item := map[string]string{}
-	claimID := ""
-	o := orm.NewOrm()
-	o.Using("vchain")
-	rows := []orm.Params{}
-	sql := "SELECT id FROM `vchain`.`claims` WHERE proxy = ?"
-	sql += " AND status = ? AND type = ? LIMIT 1"
-	num, err := o.Raw(sql, proxy, "APPROVED", attestationType).Values(&rows)
+	claim, err := Storage().Claims().FindByStatus(proxy, attestationType, string(ClaimApproved))
 	if err != nil {
-		setError(err.Error(), result)
-	} else if num > 0 {
-		row := rows[0]
-		claimID = row["id"].(string)
-	}
-	if len(claimID) > 0 {
-		sql = "SELECT attestant, attestation, created"
-		sql += " FROM `vchain`.`attestations` WHERE claimid = ? LIMIT 1"
-		num, err := o.Raw(sql, claimID).Values(&rows)
-		if err != nil {
-			setError(err.Error(), result)
-		} else if num > 0 {
-			row := rows[0]
-			item["attestant"] = row["attestant"].(string)
-			item["attestation"] = row["attestation"].(string)
-			item["created"] = row["created"].(string)
+		if err != errNotFound {
+			setFailure(r, err, result)
 		}
+		return item
+	}
+	attestation, err := Storage().Attestations().FindByClaim(claim.ID)
+	if err != nil && err != errNotFound {
+		setFailure(r, err, result)
+	} else if err == nil {
+		item["attestant"] = attestation.Attestant
+		item["attestation"] = attestation.Attestation
+		item["created"] = attestation.Created
 	}
 	return item
 }
 
-func getUserData(proxy string, scope string, result map[string]interface{}) map[string]string {
+// getUserData returns the user fields released by scope.
+func getUserData(r *http.Request, proxy string, scope Scope, result map[string]interface{}) map[string]string {
 	user := map[string]string{}
-	o := orm.NewOrm()
-	o.Using("vchain")
-	rows := []orm.Params{}
-	sql := "SELECT name, idnumber, phone, email, privatekey, publickey, address"
-	sql += ", proxy, controller, recovery, ipfs, description, created"
-	sql += " FROM `vchain`.`users` WHERE proxy = ? LIMIT 1"
-	num, err := o.Raw(sql, proxy).Values(&rows)
-	if err != nil {
-		setError(err.Error(), result)
-	} else if num > 0 {
-		row := rows[0]
-		if strings.Contains(scope, "address") {
-			user["address"] = row["address"].(string)
-		}
-		if strings.Contains(scope, "controller") {
-			user["controller"] = row["controller"].(string)
-		}
-		if strings.Contains(scope, "created") {
-			user["created"] = row["created"].(string)
-		}
-		if strings.Contains(scope, "description") {
-			user["description"] = row["description"].(string)
-		}
-		if strings.Contains(scope, "email") {
-			user["email"] = row["email"].(string)
-		}
-		if strings.Contains(scope, "ID") {
-			user["ID"] = row["idnumber"].(string)
-		}
-		if strings.Contains(scope, "ipfs") {
-			user["ipfs"] = row["ipfs"].(string)
-		}
-		if strings.Contains(scope, "name") {
-			user["name"] = row["name"].(string)
-		}
-		if strings.Contains(scope, "phone") {
-			user["phone"] = row["phone"].(string)
-		}
-		if strings.Contains(scope, "proxy") {
-			user["proxy"] = row["proxy"].(string)
-		}
-		if strings.Contains(scope, "publicKey") {
-			user["publicKey"] = row["publickey"].(string)
-		}
-		if strings.Contains(scope, "recovery") {
-			user["recovery"] = row["recovery"].(string)
-		}
-		if strings.Contains(scope, "updated") {
-			user["updated"] = row["updated"].(string)
+	row, err := Storage().Users().FindByProxy(proxy)
+	if err != nil && err != errNotFound {
+		setFailure(r, err, result)
+	} else if err == nil {
+		for _, name := range scope.userFields() {
+			user[name] = userScopes[name](row)
 		}
 	}
 	return user
 }
 
-func getResultForWebsocket(token string) map[string]interface{} {
+func websocketTimeout() time.Duration {
+	if cfg := Config().Websocket; cfg != nil && cfg.Timeout > 0 {
+		return time.Duration(cfg.Timeout) * time.Second
+	}
+	return 300 * time.Second
+}
+
+// errTokenTimeout is returned by waitForToken when the token was not
+// validated in time.
+var errTokenTimeout = errors.New("token was not validated in time")
+
+// errShuttingDown is returned by waitForToken when the server shuts down
+// before the token was validated.
+var errShuttingDown = errors.New("server is shutting down")
+
+// waitForToken blocks until token has been validated by the mobile app or
+// the websocket timeout elapses or the server shuts down. Tokens the server never issued are
+// reported as errNotFound.
+func waitForToken(token string) (*Token, error) {
+	ch, cancel := hub.subscribe(token)
+	defer cancel()
+
+	row, err := Storage().Tokens().Find(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Consumed) > 0 {
+		return row, nil
+	}
+	timer := time.NewTimer(websocketTimeout())
+	defer timer.Stop()
+	select {
+	case row = <-ch:
+		return row, nil
+	case <-timer.C:
+		return nil, errTokenTimeout
+	case <-hub.closing():
+		return nil, errShuttingDown
+	}
+}
+
+func getResultForWebsocket(r *http.Request, row *Token) map[string]interface{} {
 	errors := []string{}
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	valid := false
-	proxy := ""
-	scope := ""
-	o := orm.NewOrm()
-	o.Using("vchain")
-	rows := []orm.Params{}
-	sql := "SELECT token, valid, proxy, scope, created"
-	sql += " FROM `vchain`.`tokens` WHERE token = ? LIMIT 1"
-	row := orm.Params{}
-	for i := 1; i <= 300; i++ {
-		num, err := o.Raw(sql, token).Values(&rows)
-		if err != nil {
-			setError(err.Error(), result)
-			break
-		} else if num > 0 {
-			row = rows[0]
-			if row["valid"].(string) == "1" {
-				valid = true
+	valid := row.Valid
+	proxy := row.Proxy
+	scope, err := parseScope(row.Scope)
+	if err != nil {
+		setAPIError(internalError("Token has an invalid scope: "+err.Error()+"."), result)
+	} else if valid {
+		result["user"] = getUserData(r, proxy, scope, result)
+		if types := scope.attestations(); len(types) > 0 {
+			attestations := map[string]interface{}{}
+			for _, attestationType := range types {
+				attestations[attestationType] = getAttestationData(r, proxy, attestationType, result)
 			}
-			proxy = row["proxy"].(string)
-			scope = row["scope"].(string)
-			break
-		}
-		if len(scope) == 0 {
-			time.Sleep(1 * time.Second)
-		} else {
-			break
-		}
-	}
-
-	if valid {
-		if scope == "ID" {
-			result["ID"] = getAttestationData(proxy, scope, result)
-		} else {
-			result["user"] = getUserData(proxy, scope, result)
-			result["login"] = valid
+			result["attestations"] = attestations
 		}
+		result["login"] = valid
 	}
 
 	nodes := map[string]interface{}{}
-	result["scope"] = scope
+	result["scope"] = row.Scope
 	nodes["result"] = result
 	return nodes
 }
@@ -630,73 +587,44 @@ func createClaim(rw http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload, _ := sjson.Map()
-	claimJWT := payload["claimJWT"].(string)
-
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": claimJWT,
-	}
-	response := postByJSON(r, URL, params, result)
-	body := response["payload"]
+	var req createClaimRequest
+	var context userContext
 	valid := false
-	expired := true
-	exp, err := body.(map[string]interface{})["exp"].(json.Number).Int64()
-	if err == nil {
-		diff := exp - time.Now().UTC().Unix()
-		if diff > 0 {
-			expired = false
-		}
-	}
-	subject := body.(map[string]interface{})["sub"].(string)
-	claimType := strings.Replace(subject, "claim for ", "", -1)
-	claimType = strings.ToUpper(claimType)
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	proxy := context["userProxy"].(string)
-	publicKey := context["userPublicKey"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  claimJWT,
-	}
-	response = postByJSON(r, URL, params, result)
-
-	if (response["result"] == "True") && !expired {
-		valid = true
-	}
 	claim := map[string]string{}
-	if valid {
-		now := getNow()
-		o := orm.NewOrm()
-		o.Using("vchain")
-		rows := []orm.Params{}
-		sql := "SELECT id, proxy, type, status FROM `vchain`.`claims`"
-		sql += " WHERE proxy = ? AND type = ? AND claim = ? LIMIT 1"
-		num, err := o.Raw(sql, proxy, claimType, claimJWT).Values(&rows)
-		if err != nil {
-			setError(err.Error(), result)
-		} else if num == 0 {
-			sql = "INSERT INTO `vchain`.`claims`(`proxy`, `type`,"
-			sql += "`status`, `claim`, `created`, `updated`) VALUES("
-			sql += "?, ?, ?, ?, ?, ?)"
-			_, err = o.Raw(sql, proxy, claimType, "PENDING", claimJWT, now, now).Exec()
+	if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ClaimJWT, result)
+		subject, _ := body["sub"].(string)
+		claimType := strings.Replace(subject, "claim for ", "", -1)
+		claimType = strings.ToUpper(claimType)
+		if firstAPIError(result) == nil {
+			if !strings.HasPrefix(subject, "claim for ") || !claimTypePattern.MatchString(claimType) {
+				setAPIError(badRequest("sub", "JWT subject must be \"claim for <type>\"."), result)
+			} else if decodeContext(body, &context, result) &&
+				authenticateUser(r, req.ClaimJWT, body, context.UserProxy, context.UserPublicKey, result) {
+				valid = true
+			}
+		}
+		// A claim token is optional, but one that is presented must be
+		// unused and is consumed by the claim.
+		if valid && len(context.Token) > 0 {
+			var scope Scope
+			var item *Token
+			if scope, valid = requestScope(context.Scope, result); valid {
+				item = checkToken(r, context.Token, tokenClaim, scope, result)
+			}
+			valid = item != nil && consumeToken(r, item, context.UserProxy, scope, true, result)
+		}
+		if valid {
+			row, err := submitClaim(context.UserProxy, claimType, req.ClaimJWT)
 			if err != nil {
-				setError(err.Error(), result)
+				setFailure(r, err, result)
 			} else {
-				claim["proxy"] = proxy
-				claim["type"] = claimType
-				claim["status"] = "PENDING"
-				claim["content"] = claimJWT
+				claim["claimID"] = strconv.FormatInt(row.ID, 10)
+				claim["proxy"] = row.Proxy
+				claim["type"] = row.Type
+				claim["status"] = row.Status
+				claim["content"] = row.Claim
 			}
-		} else if num > 0 {
-			setError("Claim existed.", result)
 		}
 	}
 	nodes := map[string]interface{}{}
@@ -712,59 +640,39 @@ func generateClaimToken(rw http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload := map[string]interface{}{}
-	payload, _ = sjson.Map()
-	clientJWT := payload["clientJWT"].(string)
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": clientJWT,
-	}
-	response := postByJSON(r, URL, params, result)
-	body := response["payload"]
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	publicKey := context["clientPublicKey"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  clientJWT,
-	}
-	response = postByJSON(r, URL, params, result)
-
+	var req clientTokenRequest
+	var context clientContext
+	var client *Client
 	serverJWT := ""
 	token := ""
-	if verification, ok := response["result"]; ok {
-		if verification == "True" {
-			token = strings.Replace(uuid.NewV4().String(), "-", "", -1)
-			serverContext := map[string]string{
-				"clientName":      context["clientName"].(string),
-				"serverPublicKey": Config().JWT.ServerPublicKey,
-				"token":           token,
-			}
+	if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ClientJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) {
+			client = authorizeClient(r, context.ClientName, req.ClientJWT, Scope{}, result)
+		}
+		if client != nil && checkJWTClaims(body, true, result) && checkReplay(r, req.ClientJWT, body, result) {
 			iat := time.Now().UTC().Unix()
-			exp := iat + 300
-			serverJSON := map[string]interface{}{
-				"iss":     "idhub.chancheng.server",
-				"aud":     "idhub.chancheng.user",
-				"iat":     iat,
-				"exp":     exp,
-				"sub":     "claim token",
-				"context": serverContext,
-			}
-
-			URL = Config().API.EncodeJWT
-			params = map[string]interface{}{
-				"payload":     serverJSON,
-				"private_key": Config().JWT.ServerPrivateKey,
+			exp := iat + tokenTTL
+			item, err := issueToken(tokenClaim, "", client.Name, exp)
+			if err != nil {
+				setFailure(r, err, result)
+			} else {
+				token = item.Token
+				serverContext := map[string]string{
+					"clientName":      context.ClientName,
+					"serverPublicKey": Config().JWT.ServerPublicKey,
+					"token":           item.Token,
+				}
+				serverJSON := map[string]interface{}{
+					"iss":     serverIssuer,
+					"aud":     userAudience,
+					"iat":     iat,
+					"exp":     exp,
+					"sub":     "claim token",
+					"context": serverContext,
+				}
+				serverJWT = encodeJWT(r, serverJSON, result)
 			}
-			response = postByJSON(r, URL, params, result)
-			serverJWT = response["token"].(string)
 		}
 	}
 
@@ -787,7 +695,7 @@ func getClaims(rw http.ResponseWriter, req *http.Request) {
 			value := slice[0]
 			valueInt, err := strconv.Atoi(value)
 			if err != nil {
-				setError(err.Error(), result)
+				setAPIError(badRequest("page", err.Error()), result)
 			} else {
 				page = valueInt
 			}
@@ -797,40 +705,31 @@ func getClaims(rw http.ResponseWriter, req *http.Request) {
 	limit := 5
 	pages := 0
 	total := 0
-	o := orm.NewOrm()
-	o.Using("vchain")
-	sql := "SELECT COUNT(*) FROM `vchain`.`claims` WHERE status = ? AND type = ?"
-	var rows []orm.Params
-	num, err := o.Raw(sql, "PENDING", "ID").Values(&rows)
+	countInt, err := Storage().Claims().Count(string(ClaimPending), "ID")
 	if err != nil {
-		setError(err.Error(), result)
-	} else if num > 0 {
-		row := rows[0]
-		countInt, err := strconv.Atoi(row["COUNT(*)"].(string))
-		if err == nil {
-			pages = int(math.Ceil(float64(countInt) / float64(limit)))
-			total = countInt
-		}
+		setFailure(req, err, result)
+	} else {
+		pages = int(math.Ceil(float64(countInt) / float64(limit)))
+		total = countInt
 	}
 	if page > pages {
 		page = pages
 	}
 	offset := (page - 1) * limit
+	if offset < 0 {
+		offset = 0
+	}
 
-	sqlcmd := "SELECT id, status, claim, created "
-	sqlcmd += "FROM `vchain`.`claims` "
-	sqlcmd += "WHERE status = ? AND type = ? "
-	sqlcmd += "ORDER BY created ASC LIMIT ? OFFSET ?"
-	num, err = o.Raw(sqlcmd, "PENDING", "ID", limit, offset).Values(&rows)
+	rows, err := Storage().Claims().List(string(ClaimPending), "ID", limit, offset)
 	if err != nil {
-		setError(err.Error(), result)
-	} else if num > 0 {
+		setFailure(req, err, result)
+	} else {
 		for _, row := range rows {
 			claim := map[string]string{
-				"claimID": row["id"].(string),
-				"claim":   row["claim"].(string),
-				"status":  row["status"].(string),
-				"created": row["created"].(string),
+				"claimID": strconv.FormatInt(row.ID, 10),
+				"claim":   row.Claim,
+				"status":  row.Status,
+				"created": row.Created,
 			}
 			claims = append(claims, claim)
 		}
@@ -846,106 +745,112 @@ func getClaims(rw http.ResponseWriter, req *http.Request) {
 	setResponse(rw, nodes)
 }
 
+// matchAttestationContext rejects an attestation request whose body does
+// not repeat the claim fields signed in its context.
+func matchAttestationContext(req *createAttestationRequest, context *attestationContext, result map[string]interface{}) bool {
+	fields := []struct {
+		name    string
+		body    string
+		context string
+	}{
+		{"attestant", req.Attestant, context.Attestant},
+		{"claimID", req.ClaimID, context.ClaimID},
+		{"claimType", req.ClaimType, context.ClaimType},
+		{"proxy", req.Proxy, context.Proxy},
+		{"status", req.Status, context.Status},
+	}
+	valid := true
+	for _, field := range fields {
+		if field.body != field.context {
+			setAPIError(badRequest(field.name, "Does not match the signed attestation."), result)
+			valid = false
+		}
+	}
+	return valid
+}
+
 func createAttestation(rw http.ResponseWriter, r *http.Request) {
 	errors := []string{}
 	result := map[string]interface{}{}
 	result["error"] = errors
 	attested := false
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload, _ := sjson.Map()
-	attestant := payload["attestant"].(string)
-	attestation := payload["attestation"].(string)
-	claimID := payload["claimID"].(string)
-	claimType := payload["claimType"].(string)
-	proxy := payload["proxy"].(string)
-	status := payload["status"].(string)
-
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": attestation,
-	}
-	response := postByJSON(r, URL, params, result)
-	body := response["payload"]
+	var req createAttestationRequest
+	var context attestationContext
 	valid := false
-	expired := true
-	exp, err := body.(map[string]interface{})["exp"].(json.Number).Int64()
-	if err == nil {
-		diff := exp - time.Now().UTC().Unix()
-		if diff > 0 {
-			expired = false
+	if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.Attestation, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) &&
+			matchAttestationContext(&req, &context, result) &&
+			authenticateAttestant(r, req.Attestation, body, context.Attestant, context.AttestantPublicKey, result) {
+			valid = true
 		}
 	}
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	publicKey := context["attestantPublicKey"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  attestation,
-	}
-	response = postByJSON(r, URL, params, result)
-
-	if (response["result"] == "True") && !expired {
-		valid = true
-	}
+	attestant := context.Attestant
+	attestation := req.Attestation
+	proxy := context.Proxy
+	claimType := context.ClaimType
+	status := context.Status
 	item := map[string]string{}
+	var claimIDInt int64
 	if valid {
-		o := orm.NewOrm()
-		o.Using("vchain")
-		rows := []orm.Params{}
-		sql := "SELECT id FROM `vchain`.`claims`"
-		sql += " WHERE id = ? AND proxy = ? AND type = ? LIMIT 1"
-		num, err := o.Raw(sql, claimID, proxy, claimType).Values(&rows)
+		var err error
+		claimIDInt, err = strconv.ParseInt(context.ClaimID, 10, 64)
 		if err != nil {
 			valid = false
-			setError(err.Error(), result)
-		} else if num > 0 {
-			now := getNow()
-			sql = "UPDATE `vchain`.`claims`"
-			sql += " SET `status` = ?, `updated` = ?"
-			sql += " WHERE id = ?"
-			_, err = o.Raw(sql, status, now, claimID).Exec()
+			setAPIError(badRequest("claimID", "Invalid claim ID."), result)
+		} else if !attestantConfig(attestant).attests(claimType) {
+			valid = false
+			setAPIError(forbidden("Attestant "+attestant+" may not attest "+claimType+" claims."), result)
+		}
+	}
+	if valid {
+		claim, err := Storage().Claims().Find(claimIDInt)
+		if err != nil && err != errNotFound {
+			valid = false
+			setFailure(r, err, result)
+		} else if err == errNotFound || claim.Proxy != proxy || claim.Type != claimType {
+			valid = false
+			setAPIError(notFound("Claim not found."), result)
+		} else if strings.EqualFold(claim.Proxy, attestantConfig(attestant).Proxy) {
+			valid = false
+			setAPIError(forbidden("Attestants cannot attest their own claims."), result)
+		} else if to, err := parseClaimStatus(status); err != nil {
+			valid = false
+			setFailure(r, err, result)
+		} else {
+			// The attestant's attestation is issued with an approval,
+			// replaced by a new one, or revoked with the reason and time
+			// it first stopped being active.
+			var change *Attestation
+			existing, err := Storage().Attestations().FindByAttestant(claim.ID, attestant)
+			if err == errNotFound && to == ClaimApproved {
+				change = &Attestation{
+					ClaimID:     claim.ID,
+					Attestant:   attestant,
+					Attestation: attestation,
+					Status:      attestationActive,
+				}
+			} else if err == nil && to == ClaimApproved {
+				change = existing
+				change.Attestation = attestation
+				change.Status = attestationActive
+			} else if err == nil && existing.Status == attestationActive {
+				change = existing
+				change.Status = attestationRevoked
+				change.Reason = revocationReason(to, context.Reason)
+			}
+			if err == nil || err == errNotFound {
+				err = attestClaim(claim, to, attestant, change)
+			}
 			if err != nil {
 				valid = false
-				setError(err.Error(), result)
+				setFailure(r, err, result)
 			} else {
-				item["status"] = status
-				item["updated"] = now
+				item["status"] = claim.Status
+				item["updated"] = claim.Updated
 				attested = true
-			}
-			sql = "SELECT id FROM `vchain`.`attestations`"
-			sql += " WHERE claimid = ? AND attestant = ? LIMIT 1"
-			num, err := o.Raw(sql, claimID, attestant).Values(&rows)
-			if err != nil {
-				valid = false
-				setError(err.Error(), result)
-			} else if (num == 0) && (status == "APPROVED") {
-				sql = "INSERT INTO `vchain`.`attestations`(`claimid`, `attestant`,"
-				sql += "`attestation`, `status`, `created`, `updated`) VALUES("
-				sql += "?, ?, ?, ?, ?, ?)"
-				_, err = o.Raw(sql, claimID, attestant, attestation, status, now, now).Exec()
-				if err != nil {
-					valid = false
-					setError(err.Error(), result)
-				} else {
-					item["attestant"] = attestant
-					item["attestation"] = attestation
-				}
-			} else if num > 0 {
-				sql = "UPDATE `vchain`.`attestations`"
-				sql += " SET `attestation` = ?, `status` = ?, `updated` = ?"
-				sql += " WHERE claimid = ?"
-				_, err = o.Raw(sql, attestation, status, now, claimID).Exec()
-				if err != nil {
-					valid = false
-					setError(err.Error(), result)
-				} else {
+				if existing != nil || change != nil {
 					item["attestant"] = attestant
 					item["attestation"] = attestation
 				}
@@ -965,72 +870,36 @@ func getAttestation(rw http.ResponseWriter, req *http.Request) {
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(req.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload, _ := sjson.Map()
-	attestationJWT := payload["attestationJWT"].(string)
-
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": attestationJWT,
-	}
-	response := postByJSON(req, URL, params, result)
-	body := response["payload"]
+	var request getAttestationRequest
+	var context userContext
 	valid := false
-	expired := true
-	exp, err := body.(map[string]interface{})["exp"].(json.Number).Int64()
-	if err == nil {
-		diff := exp - time.Now().UTC().Unix()
-		if diff > 0 {
-			expired = false
+	claimType := ""
+	if decodeRequest(req, &request, result) {
+		body := decodeJWT(req, request.AttestationJWT, result)
+		subject, _ := body["sub"].(string)
+		claimType = strings.Replace(subject, "attestation retrieval for ", "", -1)
+		claimType = strings.ToUpper(claimType)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) &&
+			authenticateUser(req, request.AttestationJWT, body, context.UserProxy, context.UserPublicKey, result) {
+			valid = true
 		}
 	}
-	subject := body.(map[string]interface{})["sub"].(string)
-	claimType := strings.Replace(subject, "attestation retrieval for ", "", -1)
-	claimType = strings.ToUpper(claimType)
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	proxy := context["userProxy"].(string)
-	publicKey := context["userPublicKey"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  attestationJWT,
-	}
-	response = postByJSON(req, URL, params, result)
-
-	if (response["result"] == "True") && !expired {
-		valid = true
-	}
+	proxy := context.UserProxy
 	item := map[string]string{}
 	status := "ERROR"
 	attestation := ""
 	if valid {
-		o := orm.NewOrm()
-		o.Using("vchain")
-		sql := "SELECT id, status FROM `vchain`.`claims`"
-		sql += " WHERE proxy = ? AND type = ? ORDER BY created DESC LIMIT 1"
-		var rows []orm.Params
-		num, err := o.Raw(sql, proxy, claimType).Values(&rows)
-		if err != nil {
-			setError(err.Error(), result)
-		} else if num > 0 {
-			row := rows[0]
-			claimID := row["id"].(string)
-			status = row["status"].(string)
-			if status == "APPROVED" {
-				sql = "SELECT attestation FROM `vchain`.`attestations`"
-				sql += " WHERE claimid = ? AND status = ? ORDER BY created DESC LIMIT 1"
-				num, err := o.Raw(sql, claimID, "ACTIVE").Values(&rows)
-				if err != nil {
-					setError(err.Error(), result)
-				} else if num > 0 {
-					row = rows[0]
-					attestation = row["attestation"].(string)
+		claim, err := Storage().Claims().FindLatest(proxy, claimType)
+		if err != nil && err != errNotFound {
+			setFailure(req, err, result)
+		} else if err == nil {
+			status = claim.Status
+			if status == string(ClaimApproved) {
+				row, err := Storage().Attestations().FindLatest(claim.ID, attestationActive)
+				if err != nil && err != errNotFound {
+					setFailure(req, err, result)
+				} else if err == nil {
+					attestation = row.Attestation
 				}
 			}
 		}
@@ -1051,66 +920,56 @@ func generateAuthorizationToken(rw http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload := map[string]interface{}{}
-	payload, _ = sjson.Map()
-	clientJWT := payload["clientJWT"].(string)
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": clientJWT,
-	}
-	response := postByJSON(r, URL, params, result)
-	body := response["payload"]
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	publicKey := context["clientPublicKey"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  clientJWT,
-	}
-	response = postByJSON(r, URL, params, result)
-
+	var req clientTokenRequest
+	var context clientContext
+	var client *Client
+	var scope Scope
+	consented := false
 	serverJWT := ""
 	token := ""
-	if verification, ok := response["result"]; ok {
-		if verification == "True" {
-			token = strings.Replace(uuid.NewV4().String(), "-", "", -1)
-			serverContext := map[string]string{
-				"requesterName":   context["requesterName"].(string),
-				"scope":           context["scope"].(string),
-				"serverPublicKey": Config().JWT.ServerPublicKey,
-				"token":           token,
-			}
+	if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.ClientJWT, result)
+		valid := firstAPIError(result) == nil && decodeContext(body, &context, result)
+		if valid {
+			scope, valid = requestScope(context.Scope, result)
+		}
+		if valid {
+			client = authorizeClient(r, context.RequesterName, req.ClientJWT, scope, result)
+		}
+		if client != nil && checkJWTClaims(body, true, result) && checkReplay(r, req.ClientJWT, body, result) {
 			iat := time.Now().UTC().Unix()
-			exp := iat + 300
-			serverJSON := map[string]interface{}{
-				"iss":     "idhub.chancheng.server",
-				"aud":     "idhub.chancheng.user",
-				"iat":     iat,
-				"exp":     exp,
-				"sub":     "authorization request",
-				"context": serverContext,
-			}
-
-			URL = Config().API.EncodeJWT
-			params = map[string]interface{}{
-				"payload":     serverJSON,
-				"private_key": Config().JWT.ServerPrivateKey,
+			exp := iat + tokenTTL
+			item, err := issueToken(tokenAuthorization, scope.String(), client.Name, exp)
+			if err != nil {
+				setFailure(r, err, result)
+			} else {
+				token = item.Token
+				if len(context.UserProxy) > 0 {
+					consented = applyStandingConsent(r, item, context.UserProxy, client.Name, result)
+				}
+				serverContext := map[string]string{
+					"requesterName":   context.RequesterName,
+					"scope":           item.Scope,
+					"serverPublicKey": Config().JWT.ServerPublicKey,
+					"token":           item.Token,
+				}
+				serverJSON := map[string]interface{}{
+					"iss":     serverIssuer,
+					"aud":     userAudience,
+					"iat":     iat,
+					"exp":     exp,
+					"sub":     "authorization request",
+					"context": serverContext,
+				}
+				serverJWT = encodeJWT(r, serverJSON, result)
 			}
-			response = postByJSON(r, URL, params, result)
-			serverJWT = response["token"].(string)
 		}
 	}
 
 	nodes := map[string]interface{}{}
 	result["JWT"] = serverJWT
 	result["token"] = token
+	result["consented"] = consented
 	nodes["result"] = result
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
 	setResponse(rw, nodes)
@@ -1121,69 +980,23 @@ func validateUserAauthorizationJWT(rw http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{}
 	result["error"] = errors
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	sjson, err := simplejson.NewJson(buf.Bytes())
-	if err != nil {
-		setError(err.Error(), result)
-	}
-	payload, _ := sjson.Map()
-	authorizationJWT := payload["authorizationJWT"].(string)
-	URL := Config().API.DecodeJWT
-	params := map[string]interface{}{
-		"token": authorizationJWT,
-	}
-	response := postByJSON(r, URL, params, result)
-	body := response["payload"]
+	var req userAuthorizationRequest
+	var context userContext
 	valid := false
-	expired := true
-	exp, err := body.(map[string]interface{})["exp"].(json.Number).Int64()
-	if err == nil {
-		diff := exp - time.Now().UTC().Unix()
-		if diff > 0 {
-			expired = false
-		}
-	}
-	context := body.(map[string]interface{})["context"].(map[string]interface{})
-	proxy := context["userProxy"].(string)
-	publicKey := context["userPublicKey"].(string)
-	scope := context["scope"].(string)
-	token := context["token"].(string)
-
-	URL = Config().API.VerifyJWT
-	params = map[string]interface{}{
-		"pubkey": publicKey,
-		"token":  authorizationJWT,
-	}
-	response = postByJSON(r, URL, params, result)
-
-	if (response["result"] == "True") && !expired {
-		valid = true
-	}
-
-	now := getNow()
-	o := orm.NewOrm()
-	o.Using("vchain")
-	rows := []orm.Params{}
-	sql := "SELECT token FROM `vchain`.`tokens` WHERE token = ? LIMIT 1"
-	num, err := o.Raw(sql, token).Values(&rows)
-	if err != nil {
-		setError(err.Error(), result)
-	} else if num == 0 {
-		sql = "INSERT INTO `vchain`.`tokens`(`token`, `valid`,"
-		sql += "`proxy`, `scope`, `created`) VALUES("
-		sql += "?, ?, ?, ?, ?)"
-		_, err = o.Raw(sql, token, valid, proxy, scope, now).Exec()
-		if err != nil {
-			setError(err.Error(), result)
-		}
-	} else if num > 0 {
-		sql := "UPDATE `vchain`.`tokens`"
-		sql += " SET `valid` = ?, `proxy` = ?, `scope` = ?,"
-		sql += " `created` = ? WHERE token = ?"
-		_, err = o.Raw(sql, valid, proxy, scope, now, token).Exec()
-		if err != nil {
-			setError(err.Error(), result)
+	if decodeRequest(r, &req, result) {
+		body := decodeJWT(r, req.AuthorizationJWT, result)
+		if firstAPIError(result) == nil && decodeContext(body, &context, result) {
+			if len(context.Token) == 0 {
+				setAPIError(badRequest("token", "token is required."), result)
+			} else if scope, ok := requestScope(context.Scope, result); ok {
+				if item := checkToken(r, context.Token, tokenAuthorization, scope, result); item != nil &&
+					authenticateUser(r, req.AuthorizationJWT, body, context.UserProxy, context.UserPublicKey, result) {
+					valid = consumeToken(r, item, context.UserProxy, scope, true, result)
+					if valid {
+						recordConsent(r, context.UserProxy, item.Client, scope, req.AuthorizationJWT, result)
+					}
+				}
+			}
 		}
 	}
 
@@ -1198,56 +1011,146 @@ func main() {
 	cfg := flag.String("c", "cfg.json", "specify config file")
 	flag.Parse()
 	parseConfig(*cfg)
-	db := Config().Database
-	orm.RegisterDataBase("default", "mysql", db.Address, db.Idle, db.Max)
+	if err := configureLogger(Config().Log); err != nil {
+		logFatal(nil, "log config error", fields{"error": err})
+	}
+	configureTracing(Config().Tracing)
+	if err := checkOIDCConfig(); err != nil {
+		logFatal(nil, "oidc config error", fields{"error": err})
+	}
+	if flag.Arg(0) == "migrate" {
+		dbConfig := *Config().Database
+		dbConfig.Migrate = false
+		db, err := openStore(&dbConfig)
+		if err != nil {
+			logFatal(nil, "open database error", fields{"error": err})
+		}
+		setStorage(db)
+		runMigrate(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "keys" || flag.Arg(0) == "clients" {
+		db, err := openStore(Config().Database)
+		if err != nil {
+			logFatal(nil, "open database error", fields{"error": err})
+		}
+		setStorage(db)
+		if flag.Arg(0) == "keys" {
+			runKeys(flag.Args()[1:])
+		} else {
+			runClients(flag.Args()[1:])
+		}
+		return
+	}
+	db, err := openStore(Config().Database)
+	if err != nil {
+		logFatal(nil, "open database error", fields{"error": err})
+	}
+	setStorage(db)
+
+	gateway, err = newChainGateway(Config().Gateway)
+	if err != nil {
+		logFatal(nil, "chain gateway error", fields{"error": err})
+	}
+	contentStore, err = newContentStore(Config().IPFS)
+	if err != nil {
+		logFatal(nil, "content store error", fields{"error": err})
+	}
+	resolver = newResolver(Config().DID)
 
 	server, err := socketio.NewServer(nil)
 	if err != nil {
-		log.Fatal(err)
+		logFatal(nil, "socket.io server error", fields{"error": err})
 	}
+	sockets = server
 	server.On("connection", func(so socketio.Socket) {
 		so.On("connection", func(message string) {
-			log.Println("connection message =", message)
-			sjson, err := simplejson.NewJson([]byte(message))
-			if err != nil {
+			if !hub.enter() {
+				so.Emit("shutdown", map[string]interface{}{"time": getNow()})
+				so.Disconnect()
+				return
+			}
+			defer hub.leave()
+			var request socketRequest
+			err := json.Unmarshal([]byte(message), &request)
+			if err != nil || len(validateString("token", request.Token, "required,max=40")) > 0 {
 				so.Emit("error", "Invalid websocket request")
+				so.Disconnect()
+				return
+			}
+			token := request.Token
+			logDebug(so.Request(), "websocket waiting on token", fields{"token": token})
+			row, err := waitForToken(token)
+			if err == errTokenTimeout {
+				so.Emit("timeout", map[string]interface{}{
+					"token": token,
+					"time":  getNow(),
+				})
+			} else if err == errShuttingDown {
+				so.Emit("shutdown", map[string]interface{}{
+					"token": token,
+					"time":  getNow(),
+				})
+			} else if err == errNotFound {
+				so.Emit("error", "Unknown token")
+			} else if err != nil {
+				logError(so.Request(), "websocket token error", fields{"error": err})
+				so.Emit("error", err.Error())
+			} else {
+				result := getResultForWebsocket(so.Request(), row)
+				logInfo(so.Request(), "websocket token validated", fields{"valid": row.Valid, "type": row.Type})
+				so.Emit(token, result)
 			}
-			payload := map[string]interface{}{}
-			payload, _ = sjson.Map()
-			token := payload["token"].(string)
-			log.Println("SOCKET token =", token)
-			result := getResultForWebsocket(token)
-			log.Println("SOCKET result =", result)
-			so.Emit(token, result)
 			so.Disconnect()
 		})
 		so.On("disconnection", func() {
-			log.Println("on disconnect")
+			logDebug(so.Request(), "websocket disconnected", nil)
 		})
 	})
 	server.On("error", func(so socketio.Socket, err error) {
-		log.Println("error:", err)
+		logWarn(so.Request(), "websocket error", fields{"error": err})
 		so.Emit("error", err)
 	})
 
+	http.HandleFunc("/api/v1/admin/clients", adminClients)
+	http.HandleFunc("/api/v1/admin/clients/", adminClient)
 	http.HandleFunc("/api/v1/attestations", getAttestation)
+	http.HandleFunc("/api/v1/attestations/", attestationRoutes)
 	http.HandleFunc("/api/v1/attestations/add", createAttestation)
+	http.HandleFunc("/api/v1/attestations/revocations", getRevocationList)
 	http.HandleFunc("/api/v1/authorizations/jwt", validateUserAauthorizationJWT)
 	http.HandleFunc("/api/v1/authorizations/token", generateAuthorizationToken)
 	http.HandleFunc("/api/v1/claims", getClaims)
+	http.HandleFunc("/api/v1/claims/", getClaimHistory)
 	http.HandleFunc("/api/v1/claims/add", createClaim)
 	http.HandleFunc("/api/v1/claims/token", generateClaimToken)
+	http.HandleFunc("/api/v1/consents", getConsents)
+	http.HandleFunc("/api/v1/consents/revoke", revokeConsents)
+	http.HandleFunc("/api/v1/credentials", getCredential)
+	http.HandleFunc("/api/v1/dids/", resolveDID)
 	http.HandleFunc("/api/v1/login/jwt", validateUsersLoginJWT)
 	http.HandleFunc("/api/v1/login/token", generateLoginToken)
+	http.HandleFunc("/api/v1/presentations/verify", verifyPresentation)
+	http.HandleFunc("/api/v1/profiles", publishProfile)
+	http.HandleFunc("/api/v1/profiles/", getProfile)
+	http.HandleFunc("/api/v1/recoveries/", recoveryRoutes)
 	http.HandleFunc("/api/v1/users/add", createUser)
+	http.HandleFunc("/api/v1/users/guardians", setGuardians)
+	http.HandleFunc("/api/v1/users/rotate", rotateUserKey)
+	if Config().OIDC != nil {
+		http.HandleFunc("/.well-known/openid-configuration", oidcDiscovery)
+		http.HandleFunc("/oauth/authorize", oidcAuthorize)
+		http.HandleFunc("/oauth/authorize/wait", oidcAuthorizeWait)
+		http.HandleFunc("/oauth/jwks", oidcJWKS)
+		http.HandleFunc("/oauth/token", oidcToken)
+		http.HandleFunc("/oauth/userinfo", oidcUserInfo)
+	}
 	http.Handle("/api/v1/socket/", server)
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/readyz", readyz)
 
 	port := Config().Port
 	addr := "0.0.0.0:" + strconv.Itoa(port)
-	s := &http.Server{
-		Addr:           addr,
-		MaxHeaderBytes: 1 << 30,
-	}
-	log.Println("http.Start ok, listening on", addr)
-	log.Fatalln(s.ListenAndServe())
+	serve(newServer(addr, withRequestID(withTracing(instrumentRoutes(http.DefaultServeMux)))))
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testAttestantProxy = "0x52bc44d5378309ee2abf1539bf71de1b7d7be3b5"
+	testUserProxy      = "0x0000000000000000000000000000000000000001"
+)
+
+// postAttestation posts an attestation of claim whose signed context and
+// body are overridden by signed and fields, and returns the status code
+// answered by createAttestation.
+func postAttestation(t *testing.T, claim *Claim, status string, signed map[string]string, fields map[string]string) int {
+	context := map[string]interface{}{
+		"attestant":          "idhub",
+		"attestantPublicKey": testPublicKey(t, algES256K),
+		"claimID":            strconv.FormatInt(claim.ID, 10),
+		"claimType":          claim.Type,
+		"proxy":              claim.Proxy,
+		"status":             status,
+	}
+	for name, value := range signed {
+		context[name] = value
+	}
+	token := testJWT(t, algES256K, map[string]interface{}{
+		"exp":     float64(time.Now().Unix() + 300),
+		"context": context,
+	})
+	body := map[string]string{"attestation": token}
+	for name, value := range context {
+		if value, ok := value.(string); ok && name != "attestantPublicKey" {
+			body[name] = value
+		}
+	}
+	for name, value := range fields {
+		body[name] = value
+	}
+	bs, _ := json.Marshal(body)
+	rw := httptest.NewRecorder()
+	createAttestation(rw, httptest.NewRequest("POST", "/api/v1/attestations/add", bytes.NewReader(bs)))
+	return rw.Code
+}
+
+func TestCreateAttestation(t *testing.T) {
+	useTestConfig()
+	Config().Attestants = []*AttestantConfig{{Name: "idhub", Proxy: testAttestantProxy, Types: []string{"EMAIL"}}}
+	Storage().Users().Create(&User{Proxy: testAttestantProxy, PublicKey: testPublicKey(t, algES256K)})
+	claim := func(proxy string, claimType string) *Claim {
+		claim := &Claim{Proxy: proxy, Type: claimType, Status: string(ClaimPending)}
+		if err := Storage().Claims().Create(claim, nil); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		return claim
+	}
+	email := claim(testUserProxy, "EMAIL")
+	tests := []struct {
+		name   string
+		claim  *Claim
+		status string
+		signed map[string]string
+		fields map[string]string
+		want   int
+	}{
+		{"body status differs", email, "REJECTED", nil, map[string]string{"status": "APPROVED"}, 400},
+		{"body proxy differs", email, "APPROVED", nil, map[string]string{"proxy": testAttestantProxy}, 400},
+		{"body claim differs", email, "APPROVED", nil, map[string]string{"claimID": "999"}, 400},
+		{"claim ID out of range", email, "APPROVED", map[string]string{"claimID": "99999999999999999999"}, nil, 400},
+		{"unknown attestant", email, "APPROVED", map[string]string{"attestant": "bank"}, nil, 403},
+		{"unauthorised claim type", claim(testUserProxy, "PHONE"), "APPROVED", nil, nil, 403},
+		{"self-attestation", claim(testAttestantProxy, "EMAIL"), "APPROVED", nil, nil, 403},
+		{"approval", email, "APPROVED", nil, nil, 200},
+	}
+	for _, test := range tests {
+		if code := postAttestation(t, test.claim, test.status, test.signed, test.fields); code != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, code, test.want)
+		}
+	}
+	if claim, _ := Storage().Claims().Find(email.ID); claim.Status != string(ClaimApproved) {
+		t.Errorf("claim status = %s, want %s", claim.Status, ClaimApproved)
+	}
+}
+
+func TestGenerateLoginTokenRequiresFreshClientJWT(t *testing.T) {
+	useTestConfig()
+	Config().JWT.ServerPrivateKey = testPrivateKey
+	Storage().Clients().Create(&Client{
+		Name:       "shop",
+		PublicKeys: []string{testPublicKey(t, algES256K)},
+		Scopes:     []string{"name"},
+		Status:     clientActive,
+	})
+	context := map[string]interface{}{"clientName": "shop", "scope": "name"}
+	fresh := testJWT(t, algES256K, map[string]interface{}{"exp": float64(time.Now().Unix() + 300), "context": context})
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"without exp", testJWT(t, algES256K, map[string]interface{}{"context": context}), 401},
+		{"fresh", fresh, 200},
+		{"replay", fresh, 401},
+	}
+	for _, test := range tests {
+		bs, _ := json.Marshal(map[string]string{"clientJWT": test.token})
+		rw := httptest.NewRecorder()
+		generateLoginToken(rw, httptest.NewRequest("POST", "/api/v1/login/token", bytes.NewReader(bs)))
+		if rw.Code != test.want {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, rw.Code, test.want, rw.Body.String())
+		}
+	}
+}